@@ -146,6 +146,11 @@ func (ae *ParseArgs) Execute(argv []string, ac Receiver) error {
 	ae.index = 1
 	for ; ae.index < len(argv); ae.index++ {
 		a := argv[ae.index]
+		if a == "--" {
+			// end of options
+			ae.ua = append(ae.ua, argv[ae.index+1:]...)
+			return nil
+		}
 		if len(a) == 0 || a[0] != '-' {
 			if ae.SubcmdMode {
 				ae.ua = append(ae.ua, argv[ae.index:]...)
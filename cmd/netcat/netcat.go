@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/balibuild/tunnelssh/cli"
 	"github.com/balibuild/tunnelssh/tunnel"
@@ -15,15 +17,104 @@ import (
 // IsDebugMode todo
 var IsDebugMode bool
 
-func main() {
-	if len(os.Args) < 2 {
-		name := filepath.Base(os.Args[0])
-		fmt.Fprintf(os.Stderr, "usage: %s host port\n       %s host:port", name, name)
-		os.Exit(1)
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, `usage: %s [-V] [-q seconds] [-w seconds] host port
+       %s [-V] [-q seconds] [-w seconds] host:port
+  -V  --verbose       Make the operation more talkative
+  -q  --quit          After EOF on stdin, wait seconds for the remote then quit (negative: wait forever, default)
+  -w  --wait          Timeout for connect and idle connection (connect default: 30s)
+`, name, name)
+}
+
+// defaultConnectTimeout connect timeout without -w, same as BoringMachine.Dial
+const defaultConnectTimeout = 30 * time.Second
+
+type netcat struct {
+	quit    time.Duration // -q, < 0 wait remote close forever
+	timeout time.Duration // -w, connect and idle timeout
+}
+
+func parseSeconds(oa string) (time.Duration, error) {
+	n, err := strconv.Atoi(oa)
+	if err != nil {
+		return 0, cli.ErrorCat("invalid seconds: ", oa)
 	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// Invoke todo
+func (nc *netcat) Invoke(val int, oa, raw string) error {
+	var err error
+	switch val {
+	case 'h':
+		usage()
+		os.Exit(0)
+	case 'V':
+		IsDebugMode = true
+	case 'q':
+		nc.quit, err = parseSeconds(oa)
+	case 'w':
+		if nc.timeout, err = parseSeconds(oa); err == nil && nc.timeout <= 0 {
+			err = cli.ErrorCat("invalid timeout: ", oa)
+		}
+	}
+	return err
+}
+
+// idleConn close conn when no data is transferred within timeout
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+	expired atomic.Bool
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	ic := &idleConn{Conn: conn, timeout: timeout}
+	ic.timer = time.AfterFunc(timeout, func() {
+		ic.expired.Store(true)
+		_ = conn.Close()
+	})
+	return ic
+}
+
+func (ic *idleConn) Read(b []byte) (int, error) {
+	n, err := ic.Conn.Read(b)
+	ic.timer.Reset(ic.timeout)
+	return n, err
+}
+
+func (ic *idleConn) Write(b []byte) (int, error) {
+	n, err := ic.Conn.Write(b)
+	ic.timer.Reset(ic.timeout)
+	return n, err
+}
+
+// CloseWrite todo
+func (ic *idleConn) CloseWrite() error {
+	return tunnel.CloseWrite(ic.Conn)
+}
+
+func main() {
+	nc := &netcat{quit: -1}
+	var ae cli.ParseArgs
+	ae.Add("help", cli.NOARG, 'h')
+	ae.Add("verbose", cli.NOARG, 'V')
+	ae.Add("quit", cli.REQUIRED, 'q')
+	ae.Add("wait", cli.REQUIRED, 'w')
 	if cli.IsTrue(os.Getenv("TUNNEL_DEBUG")) {
 		IsDebugMode = true
 	}
+	if err := ae.Execute(os.Args, nc); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		os.Exit(1)
+	}
+	args := ae.Unresolved()
+	if len(args) == 0 || len(args) > 2 {
+		usage()
+		os.Exit(1)
+	}
 	var bm tunnel.BoringMachine
 	if IsDebugMode {
 		bm.Debug = func(msg string) {
@@ -31,30 +122,60 @@ func main() {
 		}
 	}
 	var address string
-	if len(os.Args) == 2 {
-		address = os.Args[1]
+	if len(args) == 1 {
+		address = args[0]
 	} else {
-		address = net.JoinHostPort(os.Args[1], os.Args[2])
+		address = net.JoinHostPort(args[0], args[1])
 	}
 
 	bm.DebugPrint("Use netcat to connect: %s", address)
 	_ = bm.Initialize()
-	conn, err := bm.Dial("tcp", address)
+	connectTimeout := nc.timeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	conn, err := bm.DialTimeout("tcp", address, connectTimeout)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "unable dial %s %v\n", address, err)
 		os.Exit(1)
 	}
 	bm.DebugPrint("Address: %s reomote: %s", address, conn.RemoteAddr().String())
+	var ic *idleConn
+	if nc.timeout > 0 {
+		ic = newIdleConn(conn, nc.timeout)
+		conn = ic
+	}
 	defer conn.Close()
-	var wg sync.WaitGroup
-	wg.Add(2)
+	remoteC := make(chan struct{})
+	stdinC := make(chan struct{})
 	go func() {
-		io.Copy(conn, os.Stdin)
-		wg.Done()
+		_, _ = io.Copy(os.Stdout, conn)
+		close(remoteC)
 	}()
 	go func() {
-		io.Copy(os.Stdout, conn)
-		wg.Done()
+		_, _ = io.Copy(conn, os.Stdin)
+		// one-shot protocols answer after EOF, keep reading the remote
+		if err := tunnel.CloseWrite(conn); err != nil {
+			bm.DebugPrint("CloseWrite: %v", err)
+		}
+		close(stdinC)
 	}()
-	wg.Wait()
+	select {
+	case <-remoteC:
+	case <-stdinC:
+		bm.DebugPrint("stdin EOF, quit timeout %v", nc.quit)
+		switch {
+		case nc.quit < 0:
+			<-remoteC
+		case nc.quit > 0:
+			select {
+			case <-remoteC:
+			case <-time.After(nc.quit):
+			}
+		}
+	}
+	if ic != nil && ic.expired.Load() {
+		fmt.Fprintf(os.Stderr, "netcat: %s idle timeout\n", address)
+		os.Exit(1)
+	}
 }
@@ -4,7 +4,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"syscall"
 	"unicode/utf16"
 	"unsafe"
@@ -186,13 +185,11 @@ func CredUIPromptForCredentials(prompt, user string) (string, error) {
 // https://github.com/jeroen/askpass/blob/master/src/win32/win-askpass.c
 // Credui.dll
 
-// AskPassword todo
-func AskPassword(caption, user string) int {
+// readPassword todo
+func readPassword(caption, user string) (string, error) {
 	passwd, err := CredUIPromptForWindowsCredentials(caption, user)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Credentials: %s\n", err)
-		return 1
+		return "", fmt.Errorf("Credentials: %s", err)
 	}
-	fmt.Fprintf(os.Stdout, "%s\n", passwd)
-	return 0
+	return passwd, nil
 }
@@ -6,12 +6,14 @@ import (
 	"os"
 
 	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/tunnel"
 )
 
 type askPassOption struct {
 	PasswordMode bool
 	Args         []string
 	User         string
+	Save         string // proxy url
 }
 
 func usage() {
@@ -22,6 +24,7 @@ usage: %s <option> args ...
   -V|--verbose     Make the operation more talkative
   -u|--user        UserName for password enter
   -p|--password    Prompt user to enter password. default Yes/No confirmation
+  -s|--save        Save entered password for proxy url to credential store (TUNNEL_CREDENTIAL_STORE)
 
 `, os.Args[0])
 }
@@ -56,6 +59,8 @@ func (a *askPassOption) Invoke(val int, oa, raw string) error {
 		a.User = oa
 	case 'p':
 		a.PasswordMode = true
+	case 's':
+		a.Save = oa
 	}
 	return nil
 }
@@ -67,6 +72,7 @@ func (a *askPassOption) ParseArgv() error {
 	ae.Add("verbose", cli.NOARG, 'V')
 	ae.Add("password", cli.NOARG, 'p')
 	ae.Add("user", cli.REQUIRED, 'u')
+	ae.Add("save", cli.REQUIRED, 's')
 
 	if err := ae.Execute(os.Args, a); err != nil {
 		return err
@@ -81,6 +87,42 @@ func (a *askPassOption) ParseArgv() error {
 	return nil
 }
 
+// saveCredential store proxy credential, passphrase of encrypted file from environment
+func saveCredential(proxyurl, user, password string) error {
+	cred, err := tunnel.ProxyCredentialKey(proxyurl)
+	if err != nil {
+		return err
+	}
+	if user != "N/A" {
+		cred.User = user
+	}
+	if len(cred.User) == 0 {
+		return errors.New("save credential: missing user")
+	}
+	cred.Password = password
+	store, err := tunnel.DefaultCredentialStore(nil)
+	if err != nil {
+		return err
+	}
+	return store.Store(cred)
+}
+
+// AskPassword todo
+func AskPassword(caption, user, save string) int {
+	passwd, err := readPassword(caption, user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(save) != 0 {
+		if err := saveCredential(save, user, passwd); err != nil {
+			fmt.Fprintf(os.Stderr, "unable save credential: %v\n", err)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", passwd)
+	return 0
+}
+
 func main() {
 	var a askPassOption
 	if err := a.ParseArgv(); err != nil {
@@ -89,7 +131,7 @@ func main() {
 		os.Exit(1)
 	}
 	if a.PasswordMode {
-		os.Exit(AskPassword(a.Args[0], a.User))
+		os.Exit(AskPassword(a.Args[0], a.User, a.Save))
 	}
 	os.Exit(AskYes(a.Args[0], "TunnelSSH AskPass Yes/No confirm"))
 }
@@ -48,18 +48,16 @@ func AskYes(caption, title string) int {
 	}
 }
 
-// AskPassword todo
-func AskPassword(caption, user string) int {
+// readPassword todo
+func readPassword(caption, user string) (string, error) {
 	ttyin, err := os.OpenFile(ttypath, os.O_RDONLY, 0)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable open tty: %v\n", err)
-		return 1
+		return "", fmt.Errorf("unable open tty: %v", err)
 	}
 	defer ttyin.Close()
 	state, err := term.GetState(int(ttyin.Fd()))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to get terminal state: %s", err)
-		return 1
+		return "", fmt.Errorf("failed to get terminal state: %s", err)
 	}
 
 	stopC := make(chan struct{})
@@ -84,10 +82,7 @@ func AskPassword(caption, user string) int {
 	}
 	b, err := term.ReadPassword(int(ttyin.Fd()))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to read password: %s", err)
-		return 1
+		return "", fmt.Errorf("failed to read password: %s", err)
 	}
-
-	fmt.Fprintf(os.Stdout, "%s\n", string(b))
-	return 0
+	return string(b), nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// tunnelscp: scp compatible wrapper, run 'tunnelssh scp args...'
+
+func lookupTunnelSSH() (string, error) {
+	name := "tunnelssh"
+	if runtime.GOOS == "windows" {
+		name = "tunnelssh.exe"
+	}
+	if exe, err := os.Executable(); err == nil {
+		tunnelssh := filepath.Join(filepath.Dir(exe), name)
+		if _, err := os.Stat(tunnelssh); err == nil {
+			return tunnelssh, nil
+		}
+	}
+	return exec.LookPath(name)
+}
+
+func main() {
+	tunnelssh, err := lookupTunnelSSH()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\x1b[31mtunnelssh not found: %s\x1b[0m\n", err)
+		os.Exit(1)
+	}
+	cmd := exec.Command(tunnelssh, append([]string{"scp"}, os.Args[1:]...)...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+			os.Exit(cmd.ProcessState.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
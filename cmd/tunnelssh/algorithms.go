@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm lists of Ciphers, KexAlgorithms, MACs, HostKeyAlgorithms and PubkeyAcceptedAlgorithms,
+// OpenSSH syntax:
+//   a,b    replace the default list
+//   +a,b   append to the default list
+//   -a*,b  remove from the default list, wildcards allowed
+//   ^a,b   move to the head of the default list
+
+var supportedCiphers = []string{
+	"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+	"chacha20-poly1305@openssh.com",
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"aes128-cbc", "3des-cbc",
+	"arcfour256", "arcfour128", "arcfour",
+}
+
+// defaultCiphers x/crypto/ssh default
+var defaultCiphers = supportedCiphers[:6]
+
+var supportedKexAlgorithms = []string{
+	"curve25519-sha256", "curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	"diffie-hellman-group16-sha512",
+	"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	"diffie-hellman-group1-sha1",
+}
+
+// defaultKexAlgorithms x/crypto/ssh default
+var defaultKexAlgorithms = supportedKexAlgorithms[:7]
+
+var supportedMACs = []string{
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+	"hmac-sha2-256", "hmac-sha2-512",
+	"hmac-sha1", "hmac-sha1-96",
+}
+
+// defaultMACs x/crypto/ssh default
+var defaultMACs = supportedMACs
+
+var supportedKeyTypes = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+var supportedCertTypes = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoSKED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoSKECDSA256v01,
+	ssh.CertAlgoRSAv01,
+	ssh.CertAlgoDSAv01,
+}
+
+// supportedSignatureAlgorithms key types with RSA SHA-2 signatures
+var supportedSignatureAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+var supportedHostKeyAlgorithms = concatAlgorithms(supportedCertTypes,
+	[]string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01}, supportedSignatureAlgorithms)
+
+var supportedPubkeyAlgorithms = supportedHostKeyAlgorithms
+
+func concatAlgorithms(lists ...[]string) []string {
+	var algos []string
+	for _, l := range lists {
+		algos = append(algos, l...)
+	}
+	return algos
+}
+
+func containsAlgorithm(algos []string, a string) bool {
+	for _, x := range algos {
+		if x == a {
+			return true
+		}
+	}
+	return false
+}
+
+// expandAlgorithms names and wildcard patterns to supported algorithms
+func expandAlgorithms(name string, items, supported []string) ([]string, error) {
+	var algos []string
+	for _, item := range items {
+		if strings.ContainsAny(item, "*?[") {
+			for _, a := range supported {
+				if ok, _ := path.Match(item, a); ok && !containsAlgorithm(algos, a) {
+					algos = append(algos, a)
+				}
+			}
+			continue
+		}
+		if !containsAlgorithm(supported, item) {
+			return nil, cli.ErrorCat("Bad ", name, " '", item, "', see tunnelssh -Q")
+		}
+		if !containsAlgorithm(algos, item) {
+			algos = append(algos, item)
+		}
+	}
+	return algos, nil
+}
+
+// applyAlgorithms resolve OpenSSH algorithm list spec against defaults
+func applyAlgorithms(name, spec string, defaults, supported []string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if len(spec) == 0 {
+		return defaults, nil
+	}
+	op := spec[0]
+	if op == '+' || op == '-' || op == '^' {
+		spec = spec[1:]
+	}
+	var items []string
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			items = append(items, s)
+		}
+	}
+	var algos []string
+	switch op {
+	case '-':
+		for _, a := range defaults {
+			removed := false
+			for _, item := range items {
+				if ok, _ := path.Match(item, a); ok {
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				algos = append(algos, a)
+			}
+		}
+	case '+':
+		added, err := expandAlgorithms(name, items, supported)
+		if err != nil {
+			return nil, err
+		}
+		algos = append(algos, defaults...)
+		for _, a := range added {
+			if !containsAlgorithm(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	case '^':
+		head, err := expandAlgorithms(name, items, supported)
+		if err != nil {
+			return nil, err
+		}
+		algos = append(algos, head...)
+		for _, a := range defaults {
+			if !containsAlgorithm(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	default:
+		var err error
+		if algos, err = expandAlgorithms(name, items, supported); err != nil {
+			return nil, err
+		}
+	}
+	if len(algos) == 0 {
+		return nil, cli.ErrorCat(name, " '", spec, "' leaves no algorithm")
+	}
+	return algos, nil
+}
+
+// resolveAlgorithms apply Ciphers, KexAlgorithms, MACs from -o or ssh_config to ssh.Config
+func (sc *SSHClient) resolveAlgorithms() error {
+	var err error
+	if sc.config.Ciphers, err = applyAlgorithms("Ciphers", sc.ciphers, defaultCiphers, supportedCiphers); err != nil {
+		return err
+	}
+	if sc.config.KeyExchanges, err = applyAlgorithms("KexAlgorithms", sc.kexAlgorithms, defaultKexAlgorithms, supportedKexAlgorithms); err != nil {
+		return err
+	}
+	if sc.config.MACs, err = applyAlgorithms("MACs", sc.macs, defaultMACs, supportedMACs); err != nil {
+		return err
+	}
+	if len(sc.pubkeyAlgorithms) != 0 {
+		if sc.pubkeyAccepted, err = applyAlgorithms("PubkeyAcceptedAlgorithms", sc.pubkeyAlgorithms, supportedPubkeyAlgorithms, supportedPubkeyAlgorithms); err != nil {
+			return err
+		}
+		DebugPrint("Host: %s PubkeyAcceptedAlgorithms %s", sc.host, strings.Join(sc.pubkeyAccepted, ","))
+	}
+	DebugPrint("Host: %s Ciphers %s", sc.host, strings.Join(sc.config.Ciphers, ","))
+	DebugPrint("Host: %s KexAlgorithms %s", sc.host, strings.Join(sc.config.KeyExchanges, ","))
+	DebugPrint("Host: %s MACs %s", sc.host, strings.Join(sc.config.MACs, ","))
+	return nil
+}
+
+// signatureAlgorithms of a public key format
+func signatureAlgorithms(keyFormat string) []string {
+	switch keyFormat {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyFormat}
+}
+
+// acceptedSigners drop signers without accepted algorithm, restrict RSA signature algorithms
+func (sc *SSHClient) acceptedSigners(signers []ssh.Signer) []ssh.Signer {
+	if len(sc.pubkeyAccepted) == 0 {
+		return signers
+	}
+	accepted := make([]ssh.Signer, 0, len(signers))
+	for _, s := range signers {
+		all := signatureAlgorithms(s.PublicKey().Type())
+		var algos []string
+		for _, a := range all {
+			if containsAlgorithm(sc.pubkeyAccepted, a) {
+				algos = append(algos, a)
+			}
+		}
+		if len(algos) == 0 {
+			DebugPrint("Skipping %s key %s: not in PubkeyAcceptedAlgorithms", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()))
+			continue
+		}
+		if len(algos) != len(all) {
+			as, ok := s.(ssh.AlgorithmSigner)
+			if !ok {
+				continue
+			}
+			ms, err := ssh.NewSignerWithAlgorithms(as, algos)
+			if err != nil {
+				DebugPrint("NewSignerWithAlgorithms: %v", err)
+				continue
+			}
+			s = ms
+		}
+		accepted = append(accepted, s)
+	}
+	return accepted
+}
+
+// queryAlgorithms -Q, list supported algorithms like OpenSSH
+func queryAlgorithms(query string) error {
+	var algos []string
+	switch strings.ToLower(query) {
+	case "cipher", "ciphers":
+		algos = supportedCiphers
+	case "cipher-auth":
+		algos = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"}
+	case "kex", "kexalgorithms":
+		algos = supportedKexAlgorithms
+	case "mac", "macs":
+		algos = supportedMACs
+	case "key":
+		algos = concatAlgorithms(supportedKeyTypes, supportedCertTypes)
+	case "key-plain":
+		algos = supportedKeyTypes
+	case "key-cert":
+		algos = supportedCertTypes
+	case "key-sig", "sig":
+		algos = supportedSignatureAlgorithms
+	case "hostkeyalgorithms":
+		algos = supportedHostKeyAlgorithms
+	case "pubkeyacceptedalgorithms", "pubkeyacceptedkeytypes":
+		algos = supportedPubkeyAlgorithms
+	case "help":
+		algos = []string{"cipher", "cipher-auth", "kex", "mac", "key", "key-cert", "key-plain", "key-sig", "HostKeyAlgorithms", "PubkeyAcceptedAlgorithms"}
+	default:
+		return cli.ErrorCat("Unsupported query '", query, "', see -Q help")
+	}
+	for _, a := range algos {
+		fmt.Fprintln(os.Stdout, a)
+	}
+	return nil
+}
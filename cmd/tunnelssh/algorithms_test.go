@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyAlgorithms(t *testing.T) {
+	supported := []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr", "aes128-cbc", "3des-cbc"}
+	defaults := supported[:4]
+	tests := []struct {
+		spec string
+		want []string
+		err  string
+	}{
+		{"", defaults, ""},
+		{"aes256-ctr,aes128-ctr", []string{"aes256-ctr", "aes128-ctr"}, ""},
+		{"aes128-ctr,aes128-ctr", []string{"aes128-ctr"}, ""},
+		{"aes*-gcm@openssh.com", []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com"}, ""},
+		{"+aes128-cbc", []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr", "aes128-cbc"}, ""},
+		{"+*-cbc", []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr", "aes128-cbc", "3des-cbc"}, ""},
+		{"+aes128-ctr", defaults, ""},
+		{"-aes128-ctr", []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes256-ctr"}, ""},
+		{"-*-gcm@openssh.com, aes256-ctr", []string{"aes128-ctr"}, ""},
+		{"-3des-cbc", defaults, ""},
+		{"^aes256-ctr", []string{"aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr"}, ""},
+		{"^aes128-cbc,*-ctr", []string{"aes128-cbc", "aes128-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com"}, ""},
+		{"blowfish-cbc", nil, "Bad Ciphers 'blowfish-cbc'"},
+		{"+blowfish-cbc", nil, "Bad Ciphers 'blowfish-cbc'"},
+		{"^aes128-ctr,blowfish-cbc", nil, "Bad Ciphers 'blowfish-cbc'"},
+		{"-*", nil, "leaves no algorithm"},
+		{"twofish*", nil, "leaves no algorithm"},
+	}
+	for _, tt := range tests {
+		got, err := applyAlgorithms("Ciphers", tt.spec, defaults, supported)
+		if len(tt.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,7 +19,6 @@ import (
 	"github.com/balibuild/tunnelssh/pty"
 	"github.com/balibuild/tunnelssh/tunnel"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
 )
 
 // SSHClient client
@@ -27,6 +29,11 @@ type SSHClient struct {
 	home                string
 	IdentityFile        string
 	ka                  *KeyAgent
+	sk                  *SecurityKeyProvider
+	skProvider          string
+	p11                 *PKCS11Provider
+	p11Shared           bool // p11 shared by multi mode, closed after all hosts
+	pkcs11              string
 	argv                []string // unresolved command argv
 	env                 map[string]string
 	host                string
@@ -34,9 +41,30 @@ type SSHClient struct {
 	mode                TerminalMode
 	v4                  bool
 	v6                  bool
+	addressFamily       string // AddressFamily any, inet, inet6
+	hostKeyAlgorithms   string // HostKeyAlgorithms from -o or ssh_config
+	ciphers             string
+	kexAlgorithms       string
+	macs                string
+	pubkeyAlgorithms    string
+	pubkeyAccepted      []string // resolved PubkeyAcceptedAlgorithms, nil: all
 	insecure            bool
 	serverAliveInterval int
+	serverAliveCountMax int
 	connectTimeout      int
+	keepalive           *keepAlive
+	forwards            []*Forward
+	noCommand           bool
+	subsystem           bool   // -s, argv is the subsystem name
+	remoteCommand       string // RemoteCommand, used when no command is given
+	stdioForward        string // -W host:port
+	escapeChar          string // -e or EscapeChar
+	recordFile          string // --record asciicast file
+	recordInput         bool
+	rec                 *recorder
+	bm                  *tunnel.BoringMachine // shared by multi mode
+	ft                  *forwardTable
+	reconnect           bool
 	sys                 *sysInfo
 	wg                  sync.WaitGroup
 }
@@ -86,6 +114,28 @@ func (sc *SSHClient) WatchSignals() chan os.Signal {
 	return sigC
 }
 
+// remoteSignals local signals forwarded to a non-PTY remote process
+var remoteSignals = map[os.Signal]ssh.Signal{
+	os.Interrupt:    ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+}
+
+// forwardSignal send signal request to remote process, false when session should be dropped
+func (sc *SSHClient) forwardSignal(sig os.Signal) bool {
+	name, ok := remoteSignals[sig]
+	if !ok {
+		return false
+	}
+	DebugPrint("Forward signal %s to remote", name)
+	if err := sc.sess.Signal(name); err != nil {
+		DebugPrint("send signal %s: %v", name, err)
+		return false
+	}
+	return true
+}
+
 type windowChangeReq struct {
 	W, H, Wpx, Hpx uint32
 }
@@ -95,7 +145,7 @@ func (sc *SSHClient) invokeResizeTerminal(ctx context.Context) {
 	sc.wg.Add(1)
 	go func() {
 		defer sc.wg.Done()
-		w, h, err := pty.GetWinSize()
+		w, h, wpx, hpx, err := pty.GetWinSizeEx()
 		if err != nil {
 			DebugPrint("failed get windows size %v", err)
 		}
@@ -108,140 +158,307 @@ func (sc *SSHClient) invokeResizeTerminal(ctx context.Context) {
 					return
 				}
 			}
-			nw, nh, err := pty.GetWinSize()
+			nw, nh, nwpx, nhpx, err := pty.GetWinSizeEx()
 			if err != nil {
 				continue
 			}
-			if nw == w && nh == h {
+			if nw == w && nh == h && nwpx == wpx && nhpx == hpx {
 				continue
 			}
 			_, err = sc.sess.SendRequest("window-change", false, ssh.Marshal(
-				windowChangeReq{W: uint32(nw), H: uint32(nh)},
+				windowChangeReq{W: uint32(nw), H: uint32(nh), Wpx: uint32(nwpx), Hpx: uint32(nhpx)},
 			))
 			if err != nil {
 				continue
 			}
-			w = nw
-			h = nh
+			w, h, wpx, hpx = nw, nh, nwpx, nhpx
+			if sc.rec != nil {
+				sc.rec.resize(nw, nh)
+			}
 		}
 	}()
 }
 
-// RunInteractive to open a shell
-func (sc *SSHClient) RunInteractive() error {
-	DebugPrint("ssh shell mode. host: %s", sc.host)
+// wantTTY RequestTTY logic, login: shell session without command
+func (sc *SSHClient) wantTTY(login bool) bool {
+	isTerminal := pty.IsTerminal(os.Stdin)
+	switch sc.mode {
+	case TerminalModeNone:
+		return false
+	case TerminalModeForce:
+		return true
+	case TerminalModeYes:
+	default:
+		if !login {
+			return false
+		}
+	}
+	if !isTerminal {
+		_, _ = os.Stderr.WriteString("Pseudo-terminal will not be allocated because stdin is not a terminal.\r\n")
+	}
+	return isTerminal
+}
+
+// legacyTerminalModes when termios of stdin is unavailable: Windows console, -tt without terminal
+var legacyTerminalModes = ssh.TerminalModes{
+	ssh.ECHO:          0,
+	ssh.IGNCR:         1,
+	ssh.TTY_OP_ISPEED: 115200, // baud in
+	ssh.TTY_OP_OSPEED: 115200, // baud out
+}
+
+// RFC 4254 6.2
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// encodeTerminalModes opcode uint32 pairs ending with TTY_OP_END
+func encodeTerminalModes(modes ssh.TerminalModes) string {
+	opcodes := make([]int, 0, len(modes))
+	for k := range modes {
+		opcodes = append(opcodes, int(k))
+	}
+	sort.Ints(opcodes)
+	buf := make([]byte, 0, len(opcodes)*5+1)
+	for _, k := range opcodes {
+		buf = append(buf, byte(k))
+		buf = binary.BigEndian.AppendUint32(buf, modes[uint8(k)])
+	}
+	return string(append(buf, 0))
+}
+
+// requestPty request pseudo terminal with local TERM, termios and size,
+// local terminal is switched to raw mode until restore
+func (sc *SSHClient) requestPty() (restore func(), err error) {
+	w, h, wpx, hpx, err := pty.GetWinSizeEx()
+	if err != nil {
+		w, h, wpx, hpx = 80, 24, 0, 0 // forced without terminal
+	}
+	termName := os.Getenv("TERM")
+	if len(termName) == 0 {
+		termName = "xterm"
+	}
+	modes, err := pty.TerminalModes(os.Stdin)
+	if err != nil {
+		DebugPrint("terminal modes: %v, use defaults", err)
+		modes = legacyTerminalModes
+	}
+	DebugPrint("Request pty: TERM=%s %dx%d (%dx%d px), %d modes", termName, w, h, wpx, hpx, len(modes))
+	req := ptyRequestMsg{
+		Term:     termName,
+		Columns:  uint32(w),
+		Rows:     uint32(h),
+		Width:    uint32(wpx),
+		Height:   uint32(hpx),
+		Modelist: encodeTerminalModes(modes),
+	}
+	ok, err := sc.sess.SendRequest("pty-req", true, ssh.Marshal(&req))
+	if err == nil && !ok {
+		err = errors.New("ssh: pty-req failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sc.makeLocalRaw()
+}
+
+// makeLocalRaw switch local terminal to raw mode, noop when stdin is not a terminal
+func (sc *SSHClient) makeLocalRaw() (restore func(), err error) {
+	if !pty.IsTerminal(os.Stdin) {
+		return func() {}, nil
+	}
+	// only the terminal of stdin, like OpenSSH enter_raw_mode
+	if err := sc.changeLocalTerminalMode(); err != nil {
+		return nil, err
+	}
+	return func() { _ = sc.restoreLocalTerminalMode() }, nil
+}
+
+// Loop run shell, command or subsystem (-s) until it exits or a signal arrives
+func (sc *SSHClient) Loop() error {
+	_ = sc.SendEnv()
 	sc.sess.Stdout = os.Stdout
 	sc.sess.Stderr = os.Stderr
-	sc.sess.Stdin = os.Stdin
+	stdin, err := sc.sess.StdinPipe()
+	if err != nil {
+		return err
+	}
 	sc.sys = &sysInfo{}
-	if sc.mode == TerminalModeForce {
-		x, y, err := pty.GetWinSize()
+	// git escape argv done
+	command := strings.Join(sc.argv, " ")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		sc.wg.Wait()
+	}()
+	tty := sc.wantTTY(len(command) == 0 && !sc.subsystem)
+	esc := &escaper{sc: sc, char: sc.resolveEscapeChar(tty), doneC: make(chan error, 1)}
+	// before the resize watcher, it records window changes. asciicast is a terminal
+	// recording, like asciinema only sessions with a pty are recorded
+	if len(sc.recordFile) != 0 && !tty {
+		_, _ = os.Stderr.WriteString("--record: session has no pty, not recording\n")
+	}
+	if len(sc.recordFile) != 0 && tty {
+		w, h, err := pty.GetWinSize()
 		if err != nil {
-			return err
-		}
-		if termstate, err := term.MakeRaw(int(os.Stdout.Fd())); err == nil {
-			defer term.Restore(int(os.Stdout.Fd()), termstate)
-		}
-		if termstate, err := term.MakeRaw(int(os.Stderr.Fd())); err == nil {
-			defer term.Restore(int(os.Stderr.Fd()), termstate)
+			w, h = 80, 24
 		}
-		modes := ssh.TerminalModes{
-			ssh.ECHO:          0,
-			ssh.IGNCR:         1,
-			ssh.TTY_OP_ISPEED: 115200, // baud in
-			ssh.TTY_OP_OSPEED: 115200, // baud out
+		if err := sc.startRecord(w, h); err != nil {
+			return err
 		}
-		if err := sc.sess.RequestPty("xterm", y, x, modes); err != nil {
+		defer sc.rec.Close()
+		sc.sess.Stdout = &recordWriter{w: os.Stdout, rec: sc.rec, code: "o"}
+		sc.sess.Stderr = &recordWriter{w: os.Stderr, rec: sc.rec, code: "o"}
+	}
+	if tty {
+		restore, err := sc.requestPty()
+		if err != nil {
 			return err
 		}
+		esc.setRestore(restore)
+		defer esc.restoreTerminal()
+		sc.invokeResizeTerminal(ctx)
 	}
-	if err := sc.sess.Shell(); err != nil {
-		return err
+	switch {
+	case sc.subsystem:
+		DebugPrint("Request subsystem: %s", command)
+		err = sc.sess.RequestSubsystem(command)
+	case len(command) == 0:
+		DebugPrint("ssh shell mode. host: %s", sc.host)
+		err = sc.sess.Shell()
+	default:
+		DebugPrint("Exec cmd: %s", command)
+		err = sc.sess.Start(command)
 	}
-	if err := sc.changeLocalTerminalMode(); err != nil {
+	if err != nil {
 		return err
 	}
-	sigC := sc.WatchSignals()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer func() {
-		signal.Stop(sigC)
-		cancel()
-		sc.wg.Wait()
-	}()
-	sc.invokeResizeTerminal(ctx)
-	sessC := make(chan error)
 	go func() {
-		sessC <- sc.sess.Wait()
+		var w io.Writer = stdin
+		if sc.rec != nil && sc.recordInput {
+			w = &recordWriter{w: stdin, rec: sc.rec, code: "i"}
+		}
+		_ = esc.copy(w, os.Stdin)
+		// channel EOF, remote command sees end of its input
+		DebugPrint("stdin EOF, send EOF to remote")
+		_ = stdin.Close()
 	}()
-	select {
-	case <-sigC:
-		return ErrGotSignal
-	case err := <-sessC:
-		return err
-	}
-}
-
-// Loop todo
-func (sc *SSHClient) Loop() error {
-	_ = sc.SendEnv()
-	if len(sc.argv) == 0 {
-		return sc.RunInteractive()
-	}
-	sc.sess.Stdout = os.Stdout
-	sc.sess.Stderr = os.Stderr
-	sc.sess.Stdin = os.Stdin
-	// git escape argv done
-	args := strings.Join(sc.argv, " ")
-	DebugPrint("Exec cmd: %s", args)
 	sigC := sc.WatchSignals()
-	defer func() {
-		signal.Stop(sigC)
-	}()
-	sessC := make(chan error)
+	defer signal.Stop(sigC)
+	sessC := make(chan error, 1)
 	go func() {
-		sessC <- sc.sess.Run(args)
+		sessC <- sc.sess.Wait()
 	}()
-	select {
-	case <-sigC:
-		return ErrGotSignal
-	case err := <-sessC:
-		return err
+	// PTY: the terminal delivers Ctrl-C itself, a local signal drops the session.
+	// Otherwise signals go to the remote process, a second one drops the session
+	// when the remote ignores it.
+	forwarded := false
+	for {
+		select {
+		case sig := <-sigC:
+			if tty || forwarded || !sc.forwardSignal(sig) {
+				return ErrGotSignal
+			}
+			forwarded = true
+		case err := <-sessC:
+			return err
+		case err := <-esc.doneC:
+			return err
+		}
 	}
 }
 
-// DialTunnel todo
-func DialTunnel(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	var bm tunnel.BoringMachine
+// NewBoringMachine proxy dialer with the tunnelssh credential prompts, may be shared by concurrent connections
+func NewBoringMachine() *tunnel.BoringMachine {
+	bm := &tunnel.BoringMachine{}
 	if IsDebugMode {
 		bm.Debug = func(msg string) {
 			_, _ = os.Stderr.WriteString(cli.StrCat("debug3: \x1b[33m", msg, "\x1b[0m\n"))
 		}
 	}
+	bm.AskCredential = askProxyCredential
+	bm.Passphrase = askCredentialPassphrase
 	_ = bm.Initialize()
-	conn, err := bm.DialTimeout(network, addr, config.Timeout)
+	return bm
+}
+
+// DialTunnel todo
+func DialTunnel(ctx context.Context, bm *tunnel.BoringMachine, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := bm.DialContextTimeout(ctx, network, addr, config.Timeout)
 	if err != nil {
+		var authErr *tunnel.ProxyAuthError
+		if errors.As(err, &authErr) {
+			forgetProxyCredential()
+		}
 		return nil, err
 	}
+	// signal interrupts handshake
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
 	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
 	return ssh.NewClient(c, chans, reqs), nil
 }
 
-// Dial todo
-func (sc *SSHClient) Dial() error {
+// network tcp4/tcp6 from -4/-6 or AddressFamily, tcp (Happy Eyeballs) for any
+func (sc *SSHClient) network() string {
+	switch {
+	case sc.v4:
+		return "tcp4"
+	case sc.v6:
+		return "tcp6"
+	}
+	switch strings.ToLower(sc.addressFamily) {
+	case "inet":
+		return "tcp4"
+	case "inet6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// Connect establish ssh connection
+func (sc *SSHClient) Connect() error {
 	if sc.connectTimeout != 0 {
 		sc.config.Timeout = time.Duration(sc.connectTimeout) * time.Second
 	} else {
 		sc.config.Timeout = 5 * time.Second
 	}
 	addr := net.JoinHostPort(sc.host, strconv.Itoa(sc.port))
-	conn, err := DialTunnel("tcp", addr, sc.config)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
+	defer cancel()
+	bm := sc.bm
+	if bm == nil {
+		bm = NewBoringMachine() // proxy settings resolved again on reconnect
+	}
+	conn, err := DialTunnel(ctx, bm, sc.network(), addr, sc.config)
 	if err != nil {
 		return err
 	}
 	sc.ssh = conn
+	sc.startKeepAlive()
+	return nil
+}
+
+// Dial todo
+func (sc *SSHClient) Dial() error {
+	if err := sc.Connect(); err != nil {
+		return err
+	}
 	sess, err := sc.ssh.NewSession()
 	if err != nil {
 		return err
@@ -258,6 +475,9 @@ func (sc *SSHClient) Close() error {
 	if sc.ka != nil {
 		sc.ka.Close()
 	}
+	if sc.p11 != nil && !sc.p11Shared {
+		sc.p11.Close()
+	}
 	if sc.ssh != nil {
 		return sc.ssh.Close()
 	}
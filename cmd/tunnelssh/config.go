@@ -1,18 +1,79 @@
 package main
 
 import (
+	"os"
 	"os/user"
 	"strconv"
 
 	sshconfig "github.com/balibuild/tunnelssh/external/ssh_config"
 )
 
+// configuredValue value of key from ssh_config, empty when only the built-in default applies
+func configuredValue(host, key string) string {
+	if v := sshconfig.Get(host, key); v != sshconfig.Default(key) {
+		return v
+	}
+	return ""
+}
+
 // InitializeHost todo
 func (sc *SSHClient) InitializeHost() {
 	host := sc.host
-	if sc.IdentityFile = sshconfig.Get(host, "IdentityFile"); len(sc.IdentityFile) > 0 {
-		DebugPrint("Host: %s IdentityFile %s", host, sc.IdentityFile)
+	if len(sc.IdentityFile) == 0 {
+		if sc.IdentityFile = sshconfig.Get(host, "IdentityFile"); len(sc.IdentityFile) > 0 {
+			DebugPrint("Host: %s IdentityFile %s", host, sc.IdentityFile)
+		}
+	}
+	if len(sc.skProvider) == 0 {
+		if sc.skProvider = sshconfig.Get(host, "SecurityKeyProvider"); len(sc.skProvider) == 0 {
+			sc.skProvider = os.Getenv("SSH_SK_PROVIDER")
+		}
+	}
+	if len(sc.pkcs11) == 0 {
+		if sc.pkcs11 = sshconfig.Get(host, "PKCS11Provider"); len(sc.pkcs11) > 0 && sc.pkcs11 != "none" {
+			DebugPrint("Host: %s PKCS11Provider %s", host, sc.pkcs11)
+		}
+	}
+	atoi := func(key string, v *int) {
+		if *v != 0 {
+			return
+		}
+		if s := sshconfig.Get(host, key); len(s) > 0 {
+			if i, err := strconv.Atoi(s); err == nil {
+				*v = i
+				DebugPrint("Host: %s %s %d", host, key, i)
+			}
+		}
+	}
+	if len(sc.addressFamily) == 0 {
+		if sc.addressFamily = sshconfig.Get(host, "AddressFamily"); len(sc.addressFamily) > 0 {
+			DebugPrint("Host: %s AddressFamily %s", host, sc.addressFamily)
+		}
+	}
+	configured := func(key string, v *string) {
+		if len(*v) == 0 {
+			*v = configuredValue(host, key)
+		}
+	}
+	configured("RemoteCommand", &sc.remoteCommand)
+	configured("EscapeChar", &sc.escapeChar)
+	if sc.mode == TerminalModeAuto {
+		if v := configuredValue(host, "RequestTTY"); len(v) > 0 {
+			if mode, ok := ParseTerminalMode(v); ok {
+				sc.mode = mode
+				DebugPrint("Host: %s RequestTTY %s", host, v)
+			}
+		}
 	}
+	configured("HostKeyAlgorithms", &sc.hostKeyAlgorithms)
+	configured("Ciphers", &sc.ciphers)
+	configured("KexAlgorithms", &sc.kexAlgorithms)
+	configured("MACs", &sc.macs)
+	configured("PubkeyAcceptedAlgorithms", &sc.pubkeyAlgorithms)
+	configured("PubkeyAcceptedKeyTypes", &sc.pubkeyAlgorithms)
+	atoi("ServerAliveInterval", &sc.serverAliveInterval)
+	atoi("ServerAliveCountMax", &sc.serverAliveCountMax)
+	atoi("ConnectTimeout", &sc.connectTimeout)
 	if hostname := sshconfig.Get(host, "HostName"); len(hostname) > 0 {
 		sc.host = hostname
 		DebugPrint("Host: %s HostName %s", host, hostname)
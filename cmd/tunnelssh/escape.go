@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// OpenSSH style escape sequences, recognized after a newline when a pty is allocated
+
+// escape char
+const (
+	escapeNone    = -1
+	escapeDefault = '~'
+)
+
+// error
+var (
+	ErrEscapeDisconnect = errors.New("disconnected by escape sequence")
+)
+
+// parseEscapeChar EscapeChar: a single character, ^X for a control character or none
+func parseEscapeChar(s string) (int, error) {
+	switch {
+	case strings.EqualFold(s, "none"):
+		return escapeNone, nil
+	case len(s) == 1:
+		return int(s[0]), nil
+	case len(s) == 2 && s[0] == '^':
+		return int(s[1] & 0x1f), nil
+	}
+	return 0, cli.ErrorCat("bad escape character '", s, "'")
+}
+
+// escapeName printable name of escape char
+func escapeName(c int) string {
+	if c < 0x20 {
+		return "^" + string(rune(c+'@'))
+	}
+	return string(rune(c))
+}
+
+type escaper struct {
+	sc      *SSHClient
+	char    int
+	mu      sync.Mutex
+	restore func() // leave raw mode, nil when terminal is not raw
+	stopped bool
+	doneC   chan error // ~. disconnect
+}
+
+// resolveEscapeChar -e, -o EscapeChar or ssh_config, escapes need a pty like OpenSSH
+func (sc *SSHClient) resolveEscapeChar(tty bool) int {
+	if !tty {
+		return escapeNone
+	}
+	if len(sc.escapeChar) == 0 {
+		return escapeDefault
+	}
+	c, err := parseEscapeChar(sc.escapeChar)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, escape disabled\r\n", err)
+		return escapeNone
+	}
+	return c
+}
+
+// setRestore raw mode restore of the session terminal
+func (e *escaper) setRestore(restore func()) {
+	e.mu.Lock()
+	e.restore = restore
+	e.mu.Unlock()
+}
+
+// restoreTerminal leave raw mode once, escapes running later keep the terminal cooked
+func (e *escaper) restoreTerminal() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stopped = true
+	if e.restore != nil {
+		e.restore()
+		e.restore = nil
+	}
+}
+
+// cooked run fn with the local terminal in cooked mode
+func (e *escaper) cooked(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped || e.restore == nil {
+		fn()
+		return
+	}
+	e.restore()
+	e.restore = nil
+	fn()
+	restore, err := e.sc.makeLocalRaw()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raw mode: %v\n", err)
+		return
+	}
+	e.restore = restore
+}
+
+func (e *escaper) printf(format string, a ...interface{}) {
+	// raw mode, no output post-processing
+	msg := strings.ReplaceAll(fmt.Sprintf(format, a...), "\n", "\r\n")
+	_, _ = os.Stderr.WriteString(msg)
+}
+
+// copy r (stdin) to w, handle escapes after a newline
+func (e *escaper) copy(w io.Writer, r io.Reader) error {
+	if e.char == escapeNone {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	br := bufio.NewReader(r)
+	out := make([]byte, 0, 4096)
+	flush := func() error {
+		if len(out) == 0 {
+			return nil
+		}
+		_, err := w.Write(out)
+		out = out[:0]
+		return err
+	}
+	lineStart, pending := true, false
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if pending {
+				out = append(out, byte(e.char)) // no command follows, the escape char is data
+			}
+			_ = flush()
+			return err
+		}
+		switch {
+		case pending:
+			pending = false
+			if int(b) == e.char {
+				out = append(out, b) // typed twice, send it once
+				break
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if e.dispatch(br, b) {
+				lineStart = true // another escape may follow
+				continue
+			}
+			out = append(out, byte(e.char), b)
+		case lineStart && int(b) == e.char:
+			pending = true
+			continue
+		default:
+			out = append(out, b)
+		}
+		lineStart = b == '\r' || b == '\n'
+		if br.Buffered() == 0 || len(out) == cap(out) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatch run escape command b, false when b is sent to the remote with the escape char
+func (e *escaper) dispatch(br *bufio.Reader, b byte) bool {
+	esc := escapeName(e.char)
+	switch b {
+	case '.':
+		e.printf("%s.\n", esc)
+		select {
+		case e.doneC <- ErrEscapeDisconnect:
+		default:
+		}
+	case 'C':
+		e.cooked(func() {
+			e.commandLine(br)
+		})
+	case '#':
+		e.printf("%s#\n", esc)
+		e.listConnections()
+	case '?':
+		e.printf("%s?\n", esc)
+		e.help()
+	case 0x1a: // ^Z
+		e.printf("%s^Z [suspend tunnelssh]\n", esc)
+		e.cooked(func() {
+			if err := suspendProcess(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *escaper) help() {
+	esc := escapeName(e.char)
+	e.printf(`Supported escape sequences:
+ %[1]s.   - terminate connection
+ %[1]sC   - open a command line
+ %[1]s#   - list forwarded connections
+ %[1]s^Z  - suspend tunnelssh
+ %[1]s?   - this message
+ %[1]s%[1]s   - send the escape character by typing it twice
+(Note that escapes are only recognized immediately after newline.)
+`, esc)
+}
+
+func (e *escaper) listConnections() {
+	ft := e.sc.ft
+	if ft == nil {
+		e.printf("No port forwardings.\n")
+		return
+	}
+	ft.mu.Lock()
+	var forwards, conns []string
+	for fw := range ft.listeners {
+		forwards = append(forwards, fw.String())
+	}
+	for _, desc := range ft.conns {
+		conns = append(conns, desc)
+	}
+	ft.mu.Unlock()
+	sort.Strings(forwards)
+	sort.Strings(conns)
+	e.printf("The following port forwardings are active:\n")
+	for _, f := range forwards {
+		e.printf("  %s\n", f)
+	}
+	e.printf("The following connections are open:\n")
+	for i, c := range conns {
+		e.printf("  #%d %s\n", i, c)
+	}
+}
+
+// commandLine ~C: -L/-R/-D add a forward, -KL/-KR/-KD cancel it
+func (e *escaper) commandLine(br *bufio.Reader) {
+	fmt.Fprintf(os.Stderr, "\ntunnelssh> ")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	if err := e.execute(line); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func (e *escaper) execute(line string) error {
+	if line == "?" || line == "help" || line == "-h" {
+		fmt.Fprintf(os.Stderr, `Commands:
+      -L[bind_address:]port:host:hostport    Request local forward
+      -R[bind_address:]port:host:hostport    Request remote forward
+      -D[bind_address:]port                  Request dynamic forward
+      -KL[bind_address:]port                 Cancel local forward
+      -KR[bind_address:]port                 Cancel remote forward
+      -KD[bind_address:]port                 Cancel dynamic forward
+`)
+		return nil
+	}
+	cancel := strings.HasPrefix(line, "-K")
+	if cancel {
+		line = "-" + line[2:]
+	}
+	if len(line) < 2 || line[0] != '-' {
+		return cli.ErrorCat("Invalid command '", line, "', try ?")
+	}
+	kind := line[1]
+	if kind != forwardLocal && kind != forwardRemote && kind != forwardDynamic {
+		return cli.ErrorCat("Invalid command '", line, "', try ?")
+	}
+	spec := strings.TrimSpace(line[2:])
+	if e.sc.ft == nil || e.sc.ssh == nil {
+		return errors.New("connection is not ready")
+	}
+	if cancel {
+		if err := e.sc.cancelForward(kind, spec); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Canceled forwarding.\n")
+		return nil
+	}
+	fw, err := ParseForward(kind, spec)
+	if err != nil {
+		return err
+	}
+	if err := e.sc.startForward(e.sc.ssh, fw); err != nil {
+		return cli.ErrorCat("Port forwarding failed ", fw.String(), ": ", err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Forwarding port.\n")
+	return nil
+}
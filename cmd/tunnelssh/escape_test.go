@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseEscapeChar(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		ok   bool
+	}{
+		{"~", '~', true},
+		{"%", '%', true},
+		{"none", escapeNone, true},
+		{"NONE", escapeNone, true},
+		{"^]", 0x1d, true},
+		{"^A", 0x01, true},
+		{"", 0, false},
+		{"~~", 0, false},
+		{"^", '^', true},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseEscapeChar(tt.s)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseEscapeChar(%q) = %d, %v; want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestEscaperDispatch(t *testing.T) {
+	tests := []struct {
+		b          byte
+		handled    bool
+		disconnect bool
+	}{
+		{'.', true, true},
+		{'#', true, false},
+		{'?', true, false},
+		{'C', true, false},
+		{'&', false, false},
+		{'B', false, false},
+		{'x', false, false},
+	}
+	for _, tt := range tests {
+		e := &escaper{sc: &SSHClient{}, char: '~', doneC: make(chan error, 1)}
+		// ~C reads one command line, the connection is not ready
+		br := bufio.NewReader(strings.NewReader("-L8080:localhost:80\n"))
+		if got := e.dispatch(br, tt.b); got != tt.handled {
+			t.Errorf("dispatch(%q) = %v", tt.b, got)
+		}
+		select {
+		case err := <-e.doneC:
+			if !tt.disconnect || err != ErrEscapeDisconnect {
+				t.Errorf("dispatch(%q) disconnect %v", tt.b, err)
+			}
+		default:
+			if tt.disconnect {
+				t.Errorf("dispatch(%q) did not disconnect", tt.b)
+			}
+		}
+	}
+}
+
+func TestEscaperCopy(t *testing.T) {
+	tests := []struct {
+		char       int
+		in, out    string
+		disconnect bool
+	}{
+		{'~', "ls\r", "ls\r", false},
+		{'~', "~.", "", true},
+		{'~', "ls\r~.", "ls\r", true},
+		{'~', "a~.", "a~.", false},
+		{'~', "~~x", "~x", false},
+		{'~', "~x\r", "~x\r", false},
+		{'~', "~&", "~&", false},
+		{'~', "echo\r~", "echo\r~", false},
+		{'~', "~", "~", false},
+		{'~', "~?~.", "", true},
+		{0x1d, "\x1d.", "", true},
+		{escapeNone, "~.", "~.", false},
+	}
+	for _, tt := range tests {
+		e := &escaper{sc: &SSHClient{}, char: tt.char, doneC: make(chan error, 1)}
+		var remote bytes.Buffer
+		if err := e.copy(&remote, strings.NewReader(tt.in)); err != nil && err != io.EOF {
+			t.Errorf("%q: %v", tt.in, err)
+		}
+		if remote.String() != tt.out {
+			t.Errorf("%q: remote got %q, want %q", tt.in, remote.String(), tt.out)
+		}
+		if disconnect := len(e.doneC) != 0; disconnect != tt.disconnect {
+			t.Errorf("%q: disconnect %v", tt.in, disconnect)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// port forwarding (-L -R -D), stdio forwarding (-W) and reconnect supervisor (--reconnect)
+
+// optReconnect long only flag
+const optReconnect = 1001
+
+// reconnect backoff
+const (
+	reconnectMinDelay           = time.Second
+	reconnectMaxDelay           = time.Minute
+	reconnectServerAliveDefault = 15
+)
+
+// forward kind
+const (
+	forwardLocal   = 'L'
+	forwardRemote  = 'R'
+	forwardDynamic = 'D'
+)
+
+// Forward -L/-R/-D spec
+type Forward struct {
+	Kind     byte
+	BindHost string
+	BindPort int
+	Host     string // empty for -D
+	HostPort int
+}
+
+// splitForwardSpec split by ':' but keep [ipv6] together
+func splitForwardSpec(s string) []string {
+	var parts []string
+	var cur strings.Builder
+	bracket := false
+	for _, c := range s {
+		switch {
+		case c == '[':
+			bracket = true
+		case c == ']':
+			bracket = false
+		case c == ':' && !bracket:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	return append(parts, cur.String())
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 65535 {
+		return 0, cli.ErrorCat("bad port '", s, "'")
+	}
+	return p, nil
+}
+
+// ParseForward parse [bind_address:]port:host:hostport or [bind_address:]port for -D
+func ParseForward(kind byte, spec string) (*Forward, error) {
+	parts := splitForwardSpec(spec)
+	fw := &Forward{Kind: kind}
+	var err error
+	if kind == forwardDynamic {
+		switch len(parts) {
+		case 1:
+		case 2:
+			fw.BindHost = parts[0]
+			parts = parts[1:]
+		default:
+			return nil, cli.ErrorCat("bad dynamic forwarding specification '", spec, "'")
+		}
+		if fw.BindPort, err = parsePort(parts[0]); err != nil {
+			return nil, err
+		}
+		return fw, nil
+	}
+	switch len(parts) {
+	case 3:
+	case 4:
+		fw.BindHost = parts[0]
+		parts = parts[1:]
+	default:
+		return nil, cli.ErrorCat("bad forwarding specification '", spec, "'")
+	}
+	if fw.BindPort, err = parsePort(parts[0]); err != nil {
+		return nil, err
+	}
+	fw.Host = parts[1]
+	if fw.HostPort, err = parsePort(parts[2]); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// parseStdioForward -W host:port, [ipv6]:port
+func parseStdioForward(spec string) (string, error) {
+	parts := splitForwardSpec(spec)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", cli.ErrorCat("bad stdio forwarding specification '", spec, "'")
+	}
+	port, err := parsePort(parts[1])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(parts[0], strconv.Itoa(port)), nil
+}
+
+// bindAddr default loopback like OpenSSH GatewayPorts=no, '*' for all interfaces
+func (fw *Forward) bindAddr() string {
+	host := fw.BindHost
+	switch host {
+	case "":
+		host = "127.0.0.1"
+	case "*":
+		host = ""
+	case "localhost":
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(fw.BindPort))
+}
+
+func (fw *Forward) String() string {
+	if fw.Kind == forwardDynamic {
+		return fmt.Sprintf("-D %s", fw.bindAddr())
+	}
+	return fmt.Sprintf("-%c %s:%s", fw.Kind, fw.bindAddr(), net.JoinHostPort(fw.Host, strconv.Itoa(fw.HostPort)))
+}
+
+// listen open listener: local for -L/-D, on server for -R
+func (fw *Forward) listen(conn *ssh.Client) (net.Listener, error) {
+	if fw.Kind == forwardRemote {
+		return conn.Listen("tcp", fw.bindAddr())
+	}
+	return net.Listen("tcp", fw.bindAddr())
+}
+
+func (fw *Forward) handle(conn *ssh.Client, c net.Conn) {
+	defer c.Close()
+	target := net.JoinHostPort(fw.Host, strconv.Itoa(fw.HostPort))
+	var reply func(ok bool) error
+	if fw.Kind == forwardDynamic {
+		var err error
+		if target, reply, err = socksHandshake(c); err != nil {
+			DebugPrint("%s: socks: %v", fw, err)
+			return
+		}
+	}
+	var peer net.Conn
+	var err error
+	if fw.Kind == forwardRemote {
+		peer, err = net.DialTimeout("tcp", target, 10*time.Second)
+	} else {
+		peer, err = conn.Dial("tcp", target)
+	}
+	if reply != nil {
+		_ = reply(err == nil)
+	}
+	if err != nil {
+		DebugPrint("%s: connect to %s failed: %v", fw, target, err)
+		return
+	}
+	defer peer.Close()
+	DebugPrint("%s: %s -> %s", fw, c.RemoteAddr(), target)
+	pipeConn(c, peer)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeConn copy both directions until both sides are done
+func pipeConn(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+			return
+		}
+		_ = dst.Close()
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+// socksHandshake minimal SOCKS4/4a/5 server (no auth, CONNECT only)
+func socksHandshake(c net.Conn) (string, func(ok bool) error, error) {
+	br := bufio.NewReader(c)
+	ver, err := br.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	switch ver {
+	case 4:
+		var hdr [7]byte // cmd port ip
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return "", nil, err
+		}
+		if _, err := br.ReadString(0); err != nil { // userid
+			return "", nil, err
+		}
+		host := net.IP(hdr[3:7]).String()
+		if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 { // 4a
+			name, err := br.ReadString(0)
+			if err != nil {
+				return "", nil, err
+			}
+			host = strings.TrimSuffix(name, "\x00")
+		}
+		reply := func(ok bool) error {
+			code := byte(0x5b)
+			if ok {
+				code = 0x5a
+			}
+			_, err := c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		if hdr[0] != 1 {
+			_ = reply(false)
+			return "", nil, errors.New("unsupported socks4 command")
+		}
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3])))), reply, nil
+	case 5:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		methods := make([]byte, n)
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return "", nil, err
+		}
+		if bytes.IndexByte(methods, 0) == -1 {
+			// only "no authentication" is supported
+			_, _ = c.Write([]byte{5, 0xff})
+			return "", nil, errors.New("no acceptable socks5 authentication method")
+		}
+		if _, err := c.Write([]byte{5, 0}); err != nil {
+			return "", nil, err
+		}
+		var hdr [4]byte // ver cmd rsv atyp
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return "", nil, err
+		}
+		var host string
+		switch hdr[3] {
+		case 1, 4:
+			ip := make([]byte, 4)
+			if hdr[3] == 4 {
+				ip = make([]byte, 16)
+			}
+			if _, err := io.ReadFull(br, ip); err != nil {
+				return "", nil, err
+			}
+			host = net.IP(ip).String()
+		case 3:
+			l, err := br.ReadByte()
+			if err != nil {
+				return "", nil, err
+			}
+			name := make([]byte, l)
+			if _, err := io.ReadFull(br, name); err != nil {
+				return "", nil, err
+			}
+			host = string(name)
+		default:
+			return "", nil, errors.New("unsupported socks5 address type")
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(br, port[:]); err != nil {
+			return "", nil, err
+		}
+		reply := func(ok bool) error {
+			code := byte(1)
+			if ok {
+				code = 0
+			}
+			_, err := c.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		if hdr[1] != 1 {
+			_, _ = c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+			return "", nil, errors.New("unsupported socks5 command")
+		}
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), reply, nil
+	}
+	return "", nil, cli.ErrorCat("unsupported socks version ", strconv.Itoa(int(ver)))
+}
+
+// forwardTable listeners and open connections of forwards, ~C adds and cancels at runtime
+type forwardTable struct {
+	mu        sync.Mutex
+	listeners map[*Forward]net.Listener
+	conns     map[net.Conn]string
+}
+
+func (ft *forwardTable) track(c net.Conn, desc string) (untrack func()) {
+	ft.mu.Lock()
+	ft.conns[c] = desc
+	ft.mu.Unlock()
+	return func() {
+		ft.mu.Lock()
+		delete(ft.conns, c)
+		ft.mu.Unlock()
+	}
+}
+
+// startForward listen and serve fw on connection
+func (sc *SSHClient) startForward(conn *ssh.Client, fw *Forward) error {
+	l, err := fw.listen(conn)
+	if err != nil {
+		return err
+	}
+	ft := sc.ft
+	ft.mu.Lock()
+	ft.listeners[fw] = l
+	ft.mu.Unlock()
+	sc.logState("forwarding %s", fw)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ft.track(c, cli.StrCat(fw.String(), " from ", c.RemoteAddr().String()))()
+				fw.handle(conn, c)
+			}()
+		}
+	}()
+	return nil
+}
+
+// cancelForward close listener of the forward matching kind and [bind_address:]port
+func (sc *SSHClient) cancelForward(kind byte, spec string) error {
+	parts := splitForwardSpec(spec)
+	var bindHost string
+	switch len(parts) {
+	case 1:
+	case 2:
+		bindHost = parts[0]
+	default:
+		return cli.ErrorCat("bad forwarding close specification '", spec, "'")
+	}
+	port, err := parsePort(parts[len(parts)-1])
+	if err != nil {
+		return err
+	}
+	want := &Forward{BindHost: bindHost, BindPort: port}
+	sc.ft.mu.Lock()
+	defer sc.ft.mu.Unlock()
+	for fw, l := range sc.ft.listeners {
+		if fw.Kind != kind || fw.BindPort != port || (len(bindHost) != 0 && fw.bindAddr() != want.bindAddr()) {
+			continue
+		}
+		delete(sc.ft.listeners, fw)
+		return l.Close()
+	}
+	return cli.ErrorCat("unknown port forwarding -", string(kind), " ", spec)
+}
+
+// openForwards start all forwards on connection, failures are warnings like OpenSSH
+func (sc *SSHClient) openForwards(conn *ssh.Client) int {
+	sc.ft = &forwardTable{listeners: make(map[*Forward]net.Listener), conns: make(map[net.Conn]string)}
+	opened := 0
+	for _, fw := range sc.forwards {
+		if err := sc.startForward(conn, fw); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: port forwarding failed %s: %v\n", fw, err)
+			continue
+		}
+		opened++
+	}
+	return opened
+}
+
+// closeForwards close all listeners, including forwards added by ~C
+func (sc *SSHClient) closeForwards() {
+	if sc.ft == nil {
+		return
+	}
+	sc.ft.mu.Lock()
+	defer sc.ft.mu.Unlock()
+	for fw, l := range sc.ft.listeners {
+		_ = l.Close()
+		delete(sc.ft.listeners, fw)
+	}
+}
+
+// logState state transitions, always shown in reconnect mode
+func (sc *SSHClient) logState(format string, a ...interface{}) {
+	if !sc.reconnect {
+		DebugPrint(format, a...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s tunnelssh: %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, a...))
+}
+
+// serveForwards run forwards until connection closed or signal
+func (sc *SSHClient) serveForwards(sigC chan os.Signal) error {
+	opened := sc.openForwards(sc.ssh)
+	defer sc.closeForwards()
+	if opened == 0 && len(sc.forwards) != 0 && !sc.reconnect {
+		return errors.New("all port forwardings failed")
+	}
+	waitC := make(chan error, 1)
+	go func() {
+		waitC <- sc.ssh.Wait()
+	}()
+	select {
+	case <-sigC:
+		return ErrGotSignal
+	case err := <-waitC:
+		if kerr := sc.keepAliveErr(); kerr != nil {
+			return kerr
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		return err
+	}
+}
+
+// RunForwarding -N mode, with --reconnect the connection is re-established with
+// exponential backoff and all forwards are opened again
+func (sc *SSHClient) RunForwarding() error {
+	sigC := sc.WatchSignals()
+	defer signal.Stop(sigC)
+	if !sc.reconnect {
+		if err := sc.Connect(); err != nil {
+			return err
+		}
+		return sc.serveForwards(sigC)
+	}
+	if sc.serverAliveInterval <= 0 {
+		sc.serverAliveInterval = reconnectServerAliveDefault
+	}
+	delay := reconnectMinDelay
+	for {
+		sc.logState("connecting to %s:%d", sc.host, sc.port)
+		err := sc.Connect()
+		if err == nil {
+			sc.logState("connected to %s:%d", sc.host, sc.port)
+			delay = reconnectMinDelay
+			err = sc.serveForwards(sigC)
+			_ = sc.ssh.Close()
+			sc.ssh = nil
+			if err == ErrGotSignal {
+				sc.logState("received signal, exit")
+				return err
+			}
+			sc.logState("connection lost: %v", err)
+		} else {
+			sc.logState("connect failed: %v", err)
+		}
+		sc.logState("reconnecting in %s", delay)
+		select {
+		case <-sigC:
+			sc.logState("received signal, exit")
+			return ErrGotSignal
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// RunStdioForward -W mode, stdin/stdout piped to a direct-tcpip channel like netcat,
+// so tunnelssh can be used as ProxyCommand
+func (sc *SSHClient) RunStdioForward() error {
+	sigC := sc.WatchSignals()
+	defer signal.Stop(sigC)
+	if err := sc.Connect(); err != nil {
+		return err
+	}
+	conn, err := sc.ssh.Dial("tcp", sc.stdioForward)
+	if err != nil {
+		return cli.ErrorCat("stdio forwarding to ", sc.stdioForward, " failed: ", err.Error())
+	}
+	defer conn.Close()
+	DebugPrint("stdio forwarding to %s", sc.stdioForward)
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			DebugPrint("stdin: %v", err)
+		}
+		// stdin closed, half close so the target sees EOF
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+	copyC := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		copyC <- err
+	}()
+	waitC := make(chan error, 1)
+	go func() {
+		waitC <- sc.ssh.Wait()
+	}()
+	select {
+	case <-sigC:
+		return ErrGotSignal
+	case err := <-copyC:
+		return err
+	case err := <-waitC:
+		if kerr := sc.keepAliveErr(); kerr != nil {
+			return kerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// socksClient run socksHandshake against request, return the target and the bytes the server wrote
+func socksClient(t *testing.T, request []byte, replyLen int) (string, []byte, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	type result struct {
+		target string
+		err    error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		target, _, err := socksHandshake(server)
+		resC <- result{target, err}
+		server.Close()
+	}()
+	go func() {
+		_, _ = client.Write(request)
+	}()
+	reply := make([]byte, replyLen)
+	n, _ := io.ReadFull(client, reply)
+	go func() {
+		_, _ = io.Copy(io.Discard, client) // rest of a failure reply
+	}()
+	res := <-resC
+	return res.target, reply[:n], res.err
+}
+
+func TestSocksHandshake(t *testing.T) {
+	connect := []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 22}
+	tests := []struct {
+		name    string
+		request []byte
+		reply   []byte
+		target  string
+	}{
+		{"socks5 no auth", append([]byte{5, 1, 0}, connect...), []byte{5, 0}, "example.com:22"},
+		{"socks5 no auth among others", append([]byte{5, 2, 2, 0}, connect...), []byte{5, 0}, "example.com:22"},
+		{"socks5 password only", []byte{5, 1, 2}, []byte{5, 0xff}, ""},
+		{"socks5 ipv4", []byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80}, []byte{5, 0}, "192.0.2.1:80"},
+		{"socks5 bind", []byte{5, 1, 0, 5, 2, 0, 1, 192, 0, 2, 1, 0, 80}, []byte{5, 0, 5, 7}, ""},
+		{"socks4a", []byte{4, 1, 0, 22, 0, 0, 0, 1, 'u', 0, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0}, nil, "example.com:22"},
+	}
+	for _, tt := range tests {
+		target, reply, err := socksClient(t, tt.request, len(tt.reply))
+		if target != tt.target || (err == nil) != (len(tt.target) != 0) {
+			t.Errorf("%s: target %q, err %v", tt.name, target, err)
+		}
+		if !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%s: reply %v, want %v", tt.name, reply, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultHostKeyAlgorithms preference when known_hosts has no key of the host
+var defaultHostKeyAlgorithms = []string{
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA,
+}
+
+// hostKeyAlgoKeyType key type in known_hosts of host key algorithm
+func hostKeyAlgoKeyType(algo string) string {
+	switch algo {
+	case ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+		return ssh.KeyAlgoRSA
+	}
+	return algo
+}
+
+// probeKey never matches, lookup makes knownhosts report all keys of a host
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "tunnelssh-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("tunnelssh-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("probe key")
+}
+
+// knownHostKeyTypes key types of address (host:port) in known_hosts files, in file order
+func knownHostKeyTypes(address string, files ...string) []string {
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		DebugPrint("load known_hosts: %v", err)
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, &net.TCPAddr{IP: net.IPv4zero}, probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	want := keyErr.Want
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].Filename != want[j].Filename {
+			return want[i].Filename < want[j].Filename
+		}
+		return want[i].Line < want[j].Line
+	})
+	types := make([]string, 0, len(want))
+	for _, k := range want {
+		types = append(types, k.Key.Type())
+	}
+	return types
+}
+
+// orderHostKeyAlgorithms like OpenSSH: algorithms of keys already known for the host first,
+// each group keeps the order of algos
+func orderHostKeyAlgorithms(algos, known []string) []string {
+	if len(known) == 0 {
+		return algos
+	}
+	isKnown := func(algo string) bool {
+		kt := hostKeyAlgoKeyType(algo)
+		for _, k := range known {
+			if k == kt {
+				return true
+			}
+		}
+		return false
+	}
+	ordered := make([]string, 0, len(algos))
+	for _, a := range algos {
+		if isKnown(a) {
+			ordered = append(ordered, a)
+		}
+	}
+	for _, a := range algos {
+		if !isKnown(a) {
+			ordered = append(ordered, a)
+		}
+	}
+	return ordered
+}
+
+// resolveHostKeyAlgorithms default order from known_hosts, HostKeyAlgorithms from -o or ssh_config applied on it
+func (sc *SSHClient) resolveHostKeyAlgorithms() error {
+	address := net.JoinHostPort(sc.host, strconv.Itoa(sc.port))
+	known := knownHostKeyTypes(address, defaultKnownhosts)
+	defaults := orderHostKeyAlgorithms(defaultHostKeyAlgorithms, known)
+	if len(known) != 0 {
+		DebugPrint("Host: %s known host key types %s, prefer %s", address, strings.Join(known, ","), defaults[0])
+	}
+	algos, err := applyAlgorithms("HostKeyAlgorithms", sc.hostKeyAlgorithms, defaults, supportedHostKeyAlgorithms)
+	if err != nil {
+		return err
+	}
+	sc.config.HostKeyAlgorithms = algos
+	if len(sc.hostKeyAlgorithms) != 0 {
+		DebugPrint("Host: %s HostKeyAlgorithms %s", sc.host, strings.Join(algos, ","))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T, kind string) ssh.PublicKey {
+	t.Helper()
+	var pub interface{}
+	switch kind {
+	case "ed25519":
+		p, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub = p
+	default:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub = k.Public()
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useKnownHosts point defaultKnownhosts to a temporary file with lines
+func useKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "known_hosts")
+	if len(lines) != 0 {
+		if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := defaultKnownhosts
+	defaultKnownhosts = name
+	t.Cleanup(func() { defaultKnownhosts = saved })
+	return name
+}
+
+// answerHostKey replace the host key prompt, count the questions
+func answerHostKey(t *testing.T, answer bool) *int {
+	t.Helper()
+	asked := new(int)
+	saved := askHostKey
+	askHostKey = func(string, net.Addr, ssh.PublicKey) (bool, error) {
+		*asked++
+		return answer, nil
+	}
+	t.Cleanup(func() { askHostKey = saved })
+	return asked
+}
+
+// hashedLine known_hosts line with hashed host name, like HashKnownHosts yes
+func hashedLine(address string, key ssh.PublicKey) string {
+	return knownhosts.HashHostname(knownhosts.Normalize(address)) + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestKnownHostKeyTypes(t *testing.T) {
+	ed := newHostKey(t, "ed25519")
+	ec := newHostKey(t, "ecdsa")
+	name := useKnownHosts(t,
+		knownhosts.Line([]string{"other.example.com"}, ec),
+		hashedLine("example.com:2222", ed),
+	)
+	if got := knownHostKeyTypes("example.com:2222", name); !reflect.DeepEqual(got, []string{ssh.KeyAlgoED25519}) {
+		t.Fatalf("known types %v", got)
+	}
+	if got := knownHostKeyTypes("example.com:22", name); len(got) != 0 {
+		t.Fatalf("other port matched %v", got)
+	}
+	if got := knownHostKeyTypes("example.com:2222", filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Fatalf("missing file %v", got)
+	}
+	algos := orderHostKeyAlgorithms(defaultHostKeyAlgorithms, []string{ssh.KeyAlgoED25519})
+	if algos[0] != ssh.KeyAlgoED25519 || len(algos) != len(defaultHostKeyAlgorithms) {
+		t.Fatalf("order %v", algos)
+	}
+	algos = orderHostKeyAlgorithms(defaultHostKeyAlgorithms, []string{ssh.KeyAlgoRSA})
+	if !reflect.DeepEqual(algos[:3], []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}) {
+		t.Fatalf("rsa order %v", algos)
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	ed := newHostKey(t, "ed25519")
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	sc := &SSHClient{}
+
+	t.Run("hashed entry matches", func(t *testing.T) {
+		useKnownHosts(t, hashedLine("example.com:2222", ed))
+		asked := answerHostKey(t, false)
+		if err := sc.HostKeyCallback("example.com:2222", remote, ed); err != nil {
+			t.Fatal(err)
+		}
+		if *asked != 0 {
+			t.Fatal("known key asked")
+		}
+	})
+
+	t.Run("changed key rejected", func(t *testing.T) {
+		useKnownHosts(t, knownhosts.Line([]string{"example.com:2222"}, ed))
+		asked := answerHostKey(t, true)
+		err := sc.HostKeyCallback("example.com:2222", remote, newHostKey(t, "ed25519"))
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+			t.Fatalf("changed key: %v", err)
+		}
+		if *asked != 0 {
+			t.Fatal("changed key asked")
+		}
+	})
+
+	t.Run("new key added", func(t *testing.T) {
+		name := useKnownHosts(t)
+		asked := answerHostKey(t, true)
+		if err := sc.HostKeyCallback("example.com:2222", remote, ed); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(buf), "[example.com]:2222,[192.0.2.1]:2222 ssh-ed25519 ") {
+			t.Fatalf("known_hosts %q", buf)
+		}
+		// now known, no question
+		if err := sc.HostKeyCallback("example.com:2222", remote, ed); err != nil || *asked != 1 {
+			t.Fatalf("second connect: %v, asked %d", err, *asked)
+		}
+	})
+
+	t.Run("new key refused", func(t *testing.T) {
+		name := useKnownHosts(t)
+		answerHostKey(t, false)
+		if err := sc.HostKeyCallback("example.com:2222", remote, ed); err == nil {
+			t.Fatal("refused key accepted")
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("known_hosts written: %v", err)
+		}
+	})
+
+	t.Run("other key type asks", func(t *testing.T) {
+		name := useKnownHosts(t, knownhosts.Line([]string{"example.com:2222"}, newHostKey(t, "ecdsa")))
+		asked := answerHostKey(t, true)
+		if err := sc.HostKeyCallback("example.com:2222", remote, ed); err != nil {
+			t.Fatal(err)
+		}
+		if *asked != 1 {
+			t.Fatal("key of another type not asked")
+		}
+		if got := knownHostKeyTypes("example.com:2222", name); !reflect.DeepEqual(got, []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519}) {
+			t.Fatalf("known types %v", got)
+		}
+	})
+}
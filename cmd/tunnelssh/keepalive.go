@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// keepalive like OpenSSH ServerAliveInterval/ServerAliveCountMax: a
+// keepalive@openssh.com global request every interval, connection is torn down when
+// countMax requests are unanswered. Any reply (even failure) proves the server is alive.
+
+const (
+	defaultServerAliveCountMax = 3
+)
+
+type keepAlive struct {
+	conn     *ssh.Client
+	host     string
+	interval time.Duration
+	countMax int
+	mu       sync.Mutex
+	err      error
+}
+
+func (k *keepAlive) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+func (k *keepAlive) loop() {
+	closed := make(chan struct{})
+	go func() {
+		_ = k.conn.Wait()
+		close(closed)
+	}()
+	replies := make(chan struct{}, 1)
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-replies:
+			missed = 0
+		case <-ticker.C:
+			if missed >= k.countMax {
+				k.mu.Lock()
+				k.err = cli.ErrorCat("Timeout, server ", k.host, " not responding.")
+				k.mu.Unlock()
+				DebugPrint("%d keepalive requests unanswered, close connection", missed)
+				_ = k.conn.Close()
+				return
+			}
+			missed++
+			go func() {
+				// blocks until reply or connection closed
+				if _, _, err := k.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					select {
+					case replies <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+}
+
+// startKeepAlive start keepalive loop when ServerAliveInterval is set
+func (sc *SSHClient) startKeepAlive() {
+	if sc.serverAliveInterval <= 0 || sc.ssh == nil {
+		return
+	}
+	countMax := sc.serverAliveCountMax
+	if countMax <= 0 {
+		countMax = defaultServerAliveCountMax
+	}
+	sc.keepalive = &keepAlive{
+		conn:     sc.ssh,
+		host:     sc.host,
+		interval: time.Duration(sc.serverAliveInterval) * time.Second,
+		countMax: countMax,
+	}
+	DebugPrint("ServerAliveInterval %d ServerAliveCountMax %d", sc.serverAliveInterval, countMax)
+	go sc.keepalive.loop()
+}
+
+// keepAliveErr connection was torn down by keepalive
+func (sc *SSHClient) keepAliveErr() error {
+	if sc.keepalive == nil {
+		return nil
+	}
+	return sc.keepalive.Err()
+}
@@ -39,6 +39,9 @@ func keyTypeName(key ssh.PublicKey) string {
 	return kt
 }
 
+// askHostKey ask user to accept an unknown host key
+var askHostKey = askAddingUnknownHostKey
+
 func askAddingUnknownHostKey(address string, remote net.Addr, key ssh.PublicKey) (bool, error) {
 	stopC := make(chan struct{})
 	defer func() {
@@ -88,7 +91,8 @@ func askAddingUnknownHostKey(address string, remote net.Addr, key ssh.PublicKey)
 
 // KeyAgent todo
 type KeyAgent struct {
-	conn net.Conn
+	conn   net.Conn
+	client agent.ExtendedAgent
 }
 
 // Close todo
@@ -99,13 +103,30 @@ func (ka *KeyAgent) Close() error {
 	return nil
 }
 
-// UseAgent todo
-func (ka *KeyAgent) UseAgent() ssh.AuthMethod {
-	return ssh.PublicKeysCallback(agent.NewClient(ka.conn).Signers)
+// Client return agent client
+func (ka *KeyAgent) Client() agent.ExtendedAgent {
+	if ka.client == nil {
+		ka.client = agent.NewClient(ka.conn)
+	}
+	return ka.client
+}
+
+// Signers agent keys
+func (ka *KeyAgent) Signers() ([]ssh.Signer, error) {
+	if ka.conn == nil {
+		return nil, nil
+	}
+	return ka.Client().Signers()
 }
 
 func unfoldKeyError(hostname string, key ssh.PublicKey, ke *knownhosts.KeyError) {
 	k0 := ke.Want[0]
+	for _, k := range ke.Want {
+		if k.Key.Type() == key.Type() {
+			k0 = k
+			break
+		}
+	}
 	hostKeyType := keyTypeName(key)
 	localKeyType := keyTypeName(k0.Key)
 	fmt.Fprintf(os.Stderr, `@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
@@ -149,15 +170,21 @@ func (sc *SSHClient) HostKeyCallback(hostname string, remote net.Addr, key ssh.P
 		if !ok {
 			return err
 		}
+		for _, k := range keyErr.Want {
+			if k.Key.Type() == key.Type() {
+				unfoldKeyError(hostname, key, keyErr)
+				return err
+			}
+		}
 		if len(keyErr.Want) > 0 {
-			unfoldKeyError(hostname, key, keyErr)
-			return err
+			// known under other key types only, not a changed key
+			DebugPrint("Host %s is known by %s key, server sent %s key", hostname, keyTypeName(keyErr.Want[0].Key), keyTypeName(key))
 		}
 	} else if !os.IsNotExist(err) {
 		// if not exists
 		return err
 	}
-	if answer, err := askAddingUnknownHostKey(hostname, remote, key); err != nil || !answer {
+	if answer, err := askHostKey(hostname, remote, key); err != nil || !answer {
 		msg := "host key verification failed"
 		if err != nil {
 			msg = cli.StrCat(msg, ": ", err.Error())
@@ -198,8 +225,16 @@ func (sc *SSHClient) openPrivateKey(kf string) (ssh.Signer, error) {
 	}
 	sig, err := ssh.ParsePrivateKey(buf)
 	if err != nil {
-		DebugPrint("ParsePrivateKey: %v", err)
-		return nil, err
+		skey, skerr := ParseSecurityKey(buf)
+		if skerr != nil {
+			DebugPrint("ParsePrivateKey: %v", err)
+			return nil, err
+		}
+		// sc.sk is created by Prepare
+		if sc.sk == nil {
+			return nil, cli.ErrorCat("security key ", kf, ": no security key provider")
+		}
+		sig = sc.sk.Signer(skey)
 	}
 	key := sig.PublicKey()
 	DebugPrint("Offering public key: %s %s", kf, ssh.FingerprintSHA256(key))
@@ -234,7 +269,7 @@ func (sc *SSHClient) PublicKeys() ([]ssh.Signer, error) {
 	}
 	// We drop id_dsa key support
 	// http://www.openssh.com/txt/release-6.5
-	keys := []string{"id_ed25519", "id_ecdsa", "id_rsa"} // keys
+	keys := []string{"id_ed25519", "id_ecdsa", "id_ed25519_sk", "id_ecdsa_sk", "id_rsa"} // keys
 	signers := make([]ssh.Signer, 0, len(keys))
 	for _, k := range keys {
 		sig, err := sc.SearchKey(k)
@@ -244,3 +279,26 @@ func (sc *SSHClient) PublicKeys() ([]ssh.Signer, error) {
 	}
 	return signers, nil
 }
+
+// AuthSigners identity file keys, PKCS#11 token keys and agent keys share one publickey method
+func (sc *SSHClient) AuthSigners() ([]ssh.Signer, error) {
+	signers, err := sc.PublicKeys()
+	if err != nil {
+		DebugPrint("PublicKeys: %v", err)
+	}
+	if sc.p11 != nil {
+		ps, err := sc.p11.Signers()
+		if err != nil {
+			DebugPrint("PKCS#11 provider %s: %v", sc.p11.Module, err)
+		}
+		signers = append(signers, ps...)
+	}
+	if sc.ka != nil {
+		as, err := sc.ka.Signers()
+		if err != nil {
+			DebugPrint("agent: %v", err)
+		}
+		signers = append(signers, as...)
+	}
+	return sc.acceptedSigners(signers), nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -60,18 +61,36 @@ func version() {
 func usage() {
 	fmt.Fprintf(os.Stdout, `tunnelssh - A witty ssh client that automatically accesses a remote server through a proxy
 usage: %s <option> args ...
+       %s sftp <option> [user@]host[:path]
+       %s scp <option> source ... target
+       %s replay <option> file.cast
+       %s multi <option> -- command ...
   -h|--help        Show usage text and quit
   -v|--version     Show version number and quit
   -V|--verbose     Make the operation more talkative
+  -Q|--query       Query supported algorithms: cipher, kex, mac, key, key-sig, HostKeyAlgorithms, PubkeyAcceptedAlgorithms
   -p|--port        Port to connect to on the remote host.
-  -o|--option      Partially compatible with SSH: SetEnv, ServerAliveInterval, ConnectTimeout
+  -o|--option      Partially compatible with SSH: SetEnv, ServerAliveInterval, ServerAliveCountMax, ConnectTimeout, AddressFamily, SecurityKeyProvider, RequestTTY, RemoteCommand, EscapeChar,
+                   Ciphers, KexAlgorithms, MACs, HostKeyAlgorithms, PubkeyAcceptedAlgorithms (+, -, ^ supported)
+  -i|--identity    Selects a file from which the identity (private key) is read
   -k|--insecure    Ignore the check of the server public key. Only for testing
+  -I|--pkcs11      PKCS#11 shared library to use for communicating with a token
+  -L               [bind_address:]port:host:hostport Local port forwarding
+  -R               [bind_address:]port:host:hostport Remote port forwarding
+  -D               [bind_address:]port Dynamic (SOCKS4/5) port forwarding
+  -N               Do not execute a remote command, useful for just forwarding ports
+  -W               host:port Forward stdin and stdout to host:port over the connection, for ProxyCommand
+  --reconnect      With -N, reconnect with exponential backoff when the connection is lost
+  -e               Escape character for sessions with a pty (default '~'), none disables escapes
+  --record         Record the pty session to file in asciicast v2 format, play back with replay
+  --record-input   With --record, record the input too (passwords typed are recorded!)
+  -s               Invoke the command as subsystem, for example sftp or netconf
   -T               Disable pseudo-tty allocation.
-  -t               Force pseudo-tty allocation.
+  -t               Request pseudo-tty allocation when stdin is a terminal, -tt force it.
   -4               Forces ssh to use IPv4 addresses only.
   -6               Forces ssh to use IPv6 addresses only.
 
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 // https://github.com/git/git/blob/e870325ee8575d5c3d7afe0ba2c9be072c692b65/connect.c#L1113
@@ -95,10 +114,74 @@ func (sc *SSHClient) ParseOption(option string) bool {
 		}
 		return true
 	}
+	if strings.HasPrefix(option, "SecurityKeyProvider=") {
+		sc.skProvider = strings.TrimPrefix(option, "SecurityKeyProvider=")
+		return true
+	}
+	if strings.HasPrefix(option, "PKCS11Provider=") {
+		sc.pkcs11 = strings.TrimPrefix(option, "PKCS11Provider=")
+		return true
+	}
+	if strings.HasPrefix(option, "ServerAliveCountMax=") {
+		sac := strings.TrimPrefix(option, "ServerAliveCountMax=")
+		if i, err := strconv.Atoi(sac); err == nil {
+			sc.serverAliveCountMax = i
+		}
+		return true
+	}
+	if strings.HasPrefix(option, "AddressFamily=") {
+		af := strings.ToLower(strings.TrimPrefix(option, "AddressFamily="))
+		if af != "any" && af != "inet" && af != "inet6" {
+			return false
+		}
+		if len(sc.addressFamily) == 0 {
+			sc.addressFamily = af
+		}
+		return true
+	}
+	if strings.HasPrefix(option, "RequestTTY=") {
+		mode, ok := ParseTerminalMode(strings.TrimPrefix(option, "RequestTTY="))
+		if !ok {
+			return false
+		}
+		sc.mode = mode
+		return true
+	}
+	if strings.HasPrefix(option, "EscapeChar=") {
+		ec := strings.TrimPrefix(option, "EscapeChar=")
+		if _, err := parseEscapeChar(ec); err != nil {
+			return false
+		}
+		if len(sc.escapeChar) == 0 {
+			sc.escapeChar = ec
+		}
+		return true
+	}
+	if strings.HasPrefix(option, "RemoteCommand=") {
+		sc.remoteCommand = strings.TrimPrefix(option, "RemoteCommand=")
+		return true
+	}
+	algorithms := []struct {
+		key string
+		v   *string
+	}{
+		{"HostKeyAlgorithms=", &sc.hostKeyAlgorithms},
+		{"Ciphers=", &sc.ciphers},
+		{"KexAlgorithms=", &sc.kexAlgorithms},
+		{"MACs=", &sc.macs},
+		{"PubkeyAcceptedAlgorithms=", &sc.pubkeyAlgorithms},
+		{"PubkeyAcceptedKeyTypes=", &sc.pubkeyAlgorithms},
+	}
+	for _, a := range algorithms {
+		if strings.HasPrefix(option, a.key) {
+			*a.v = strings.TrimPrefix(option, a.key)
+			return true
+		}
+	}
 	if strings.HasPrefix(option, "ConnectTimeout=") {
 		cti := strings.TrimPrefix(option, "ConnectTimeout=")
 		if i, err := strconv.Atoi(cti); err == nil {
-			sc.serverAliveInterval = i
+			sc.connectTimeout = i
 		}
 		return true
 	}
@@ -116,6 +199,11 @@ func (sc *SSHClient) Invoke(val int, oa, raw string) error {
 		os.Exit(0)
 	case 'V':
 		IsDebugMode = true
+	case 'Q':
+		if err := queryAlgorithms(oa); err != nil {
+			return err
+		}
+		os.Exit(0)
 	case 'p':
 		p, err := strconv.Atoi(oa)
 		if err != nil {
@@ -137,7 +225,18 @@ func (sc *SSHClient) Invoke(val int, oa, raw string) error {
 			DebugLevel = 3
 		}
 	case 't':
-		sc.mode = TerminalModeForce
+		// -t yes, -tt force like OpenSSH
+		sc.mode = TerminalModeYes
+		if oa == "t" {
+			sc.mode = TerminalModeForce
+		}
+	case 's':
+		sc.subsystem = true
+	case 'e':
+		if _, err := parseEscapeChar(oa); err != nil {
+			return err
+		}
+		sc.escapeChar = oa
 	case '4':
 		if sc.v6 {
 			return errors.New("-4 (IPv4 only) /-6 (IPv6 only) cannot be set at the same time")
@@ -150,6 +249,30 @@ func (sc *SSHClient) Invoke(val int, oa, raw string) error {
 		sc.v6 = true
 	case 'k':
 		sc.insecure = true
+	case 'I':
+		sc.pkcs11 = oa
+	case 'i':
+		sc.IdentityFile = oa
+	case 'L', 'R', 'D':
+		fw, err := ParseForward(byte(val), oa)
+		if err != nil {
+			return err
+		}
+		sc.forwards = append(sc.forwards, fw)
+	case 'N':
+		sc.noCommand = true
+	case 'W':
+		addr, err := parseStdioForward(oa)
+		if err != nil {
+			return err
+		}
+		sc.stdioForward = addr
+	case optReconnect:
+		sc.reconnect = true
+	case optRecord:
+		sc.recordFile = oa
+	case optRecordInput:
+		sc.recordInput = true
 	default:
 	}
 	return nil
@@ -168,84 +291,193 @@ func (sc *SSHClient) SplitHost(sshaddr string) error {
 	return nil
 }
 
-// ParseArgv todo
-func (sc *SSHClient) ParseArgv() error {
+// NewSSHClient create client with default config
+func NewSSHClient() *SSHClient {
+	sc := &SSHClient{home: tunnel.HomePath(), env: make(map[string]string)}
 	// not support dsa
 	//HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	sc.config = &ssh.ClientConfig{
-		HostKeyAlgorithms: []string{
-			ssh.KeyAlgoECDSA256,
-			ssh.KeyAlgoSKECDSA256,
-			ssh.KeyAlgoECDSA384,
-			ssh.KeyAlgoECDSA521,
-			ssh.KeyAlgoED25519,
-			ssh.KeyAlgoSKED25519,
-			ssh.KeyAlgoRSA,
-		},
-		HostKeyCallback: sc.HostKeyCallback,
+		HostKeyAlgorithms: defaultHostKeyAlgorithms,
+		HostKeyCallback:   sc.HostKeyCallback,
 		Auth: []ssh.AuthMethod{
 			ssh.RetryableAuthMethod(ssh.PasswordCallback(sc.AskPassword), 3),
-			ssh.PublicKeysCallback(sc.PublicKeys),
+			ssh.PublicKeysCallback(sc.AuthSigners),
 		},
 	}
-	sc.env = make(map[string]string)
+	return sc
+}
+
+// Prepare resolve host config, agent and key providers
+func (sc *SSHClient) Prepare(sshaddr string) error {
+	if err := sc.SplitHost(sshaddr); err != nil {
+		return cli.ErrorCat("SplitHost: ", err.Error())
+	}
+	sc.InitializeHost()
+	if sc.port == 0 {
+		sc.port = 22
+	}
+	if err := sc.resolveHostKeyAlgorithms(); err != nil {
+		return err
+	}
+	if err := sc.resolveAlgorithms(); err != nil {
+		return err
+	}
+	if err := CheckSecurityKeyProvider(sc.skProvider); err != nil {
+		return err
+	}
+	sc.ka = &KeyAgent{}
+	sc.sk = NewSecurityKeyProvider(sc.skProvider)
+	if sc.ka.MakeAgent() == nil {
+		sc.sk.Register(&agentSecurityKey{client: sc.ka.Client()})
+	}
+	if len(sc.pkcs11) != 0 && sc.pkcs11 != "none" {
+		sc.p11 = &PKCS11Provider{Module: sc.pkcs11, AskPIN: sc.AskPIN}
+	}
+	if sc.insecure {
+		sc.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	return nil
+}
+
+// applyDebugMode pass -V to tunnel, call before any connection is started
+func applyDebugMode() {
+	tunnel.IsDebugMode = IsDebugMode
+	tunnel.DebugLevel = DebugLevel
+}
+
+// ParseArgv todo
+func (sc *SSHClient) ParseArgv() error {
 	var ae cli.ParseArgs
 	ae.Add("help", cli.NOARG, 'h')
 	ae.Add("version", cli.NOARG, 'v')
 	ae.Add("verbose", cli.NOARG, 'V')
+	ae.Add("query", cli.REQUIRED, 'Q')
 	ae.Add("port", cli.REQUIRED, 'p')
 	ae.Add("option", cli.REQUIRED, 'o')
+	ae.Add("identity", cli.REQUIRED, 'i')
 	ae.Add("no-tty", cli.OPTIONAL, 'T') // default no tty
 	ae.Add("force-tty", cli.OPTIONAL, 't')
+	ae.Add("subsystem", cli.NOARG, 's')
+	ae.Add("escape", cli.REQUIRED, 'e')
 	ae.Add("insecure", cli.NOARG, 'k')
+	ae.Add("pkcs11", cli.REQUIRED, 'I')
 	ae.Add("ipv4", cli.NOARG, '4')
 	ae.Add("ipv6", cli.NOARG, '6')
+	ae.Add("local-forward", cli.REQUIRED, 'L')
+	ae.Add("remote-forward", cli.REQUIRED, 'R')
+	ae.Add("dynamic-forward", cli.REQUIRED, 'D')
+	ae.Add("no-command", cli.NOARG, 'N')
+	ae.Add("stdio-forward", cli.REQUIRED, 'W')
+	ae.Add("reconnect", cli.NOARG, optReconnect)
+	ae.Add("record", cli.REQUIRED, optRecord)
+	ae.Add("record-input", cli.NOARG, optRecordInput)
 	if cli.IsTrue(os.Getenv("TUNNEL_DEBUG")) {
 		IsDebugMode = true
 	}
 	if err := ae.Execute(os.Args, sc); err != nil {
 		return err
 	}
+	applyDebugMode()
 	if len(ae.Unresolved()) == 0 {
 		usage()
 		os.Exit(1)
 	}
-
-	if err := sc.SplitHost(ae.Unresolved()[0]); err != nil {
-		return cli.ErrorCat("SplitHost: ", err.Error())
-	}
 	sc.argv = ae.Unresolved()[1:]
-	sc.InitializeHost()
-	if sc.port == 0 {
-		sc.port = 22
+	if sc.reconnect && !sc.noCommand {
+		return errors.New("--reconnect requires -N")
 	}
-	sc.ka = &KeyAgent{}
-	if sc.ka.MakeAgent() == nil {
-		sc.config.Auth = append(sc.config.Auth, sc.ka.UseAgent())
+	if sc.noCommand && len(sc.argv) != 0 {
+		return errors.New("cannot execute command with -N")
 	}
-	if sc.insecure {
-		sc.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	if sc.subsystem && len(sc.argv) == 0 && len(sc.remoteCommand) == 0 {
+		return errors.New("-s requires a subsystem name")
+	}
+	if len(sc.recordFile) != 0 && (sc.noCommand || len(sc.stdioForward) != 0) {
+		return errors.New("--record cannot be combined with -N or -W")
+	}
+	if len(sc.stdioForward) != 0 {
+		if len(sc.argv) != 0 || sc.reconnect {
+			return errors.New("-W cannot be combined with a command or --reconnect")
+		}
+		// like OpenSSH, -W clears all other forwardings
+		sc.forwards = nil
+	}
+	if err := sc.Prepare(ae.Unresolved()[0]); err != nil {
+		return err
+	}
+	if len(sc.remoteCommand) != 0 && !sc.noCommand && len(sc.stdioForward) == 0 {
+		if len(sc.argv) != 0 {
+			return errors.New("cannot execute command-line and remote command")
+		}
+		sc.argv = []string{sc.remoteCommand}
 	}
-	tunnel.IsDebugMode = IsDebugMode
-	tunnel.DebugLevel = DebugLevel
 	return nil
 }
 
 func main() {
-	sc := &SSHClient{home: tunnel.HomePath()}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sftp":
+			os.Exit(sftpMain(os.Args[1:]))
+		case "scp":
+			os.Exit(scpMain(os.Args[1:]))
+		case "replay":
+			os.Exit(replayMain(os.Args[1:]))
+		case "multi":
+			os.Exit(multiMain(os.Args[1:]))
+		}
+	}
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == "tunnelscp" {
+		os.Exit(scpMain(os.Args))
+	}
+	sc := NewSSHClient()
 	if err := sc.ParseArgv(); err != nil {
 		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
 		os.Exit(1)
 	}
+	if len(sc.stdioForward) != 0 {
+		err := sc.RunStdioForward()
+		sc.Close()
+		if err != nil && err != ErrGotSignal {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", sc.host, err)
+			os.Exit(255)
+		}
+		os.Exit(0)
+	}
+	if sc.noCommand {
+		err := sc.RunForwarding()
+		sc.Close()
+		if err != nil && err != ErrGotSignal {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", sc.host, err)
+			os.Exit(255)
+		}
+		os.Exit(0)
+	}
 	if err := sc.Dial(); err != nil {
 		fmt.Fprintf(os.Stderr, "Dial %s: %s\n", sc.host, err)
 		os.Exit(1)
 	}
 	defer sc.Close()
+	sc.openForwards(sc.ssh)
+	defer sc.closeForwards()
 	if err := sc.Loop(); err != nil {
+		if kerr := sc.keepAliveErr(); kerr != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", kerr)
+			os.Exit(255)
+		}
+		if err == ErrEscapeDisconnect {
+			fmt.Fprintf(os.Stderr, "Connection to %s closed.\n", sc.host)
+			os.Exit(255)
+		}
 		sc.onFinal(err)
 		switch err := err.(type) {
 		case *ssh.ExitError:
+			// x/crypto/ssh maps exit-signal to status 128+n like a shell
+			if len(err.Signal()) != 0 && len(err.Msg()) != 0 {
+				fmt.Fprintf(os.Stderr, "%s: remote command killed by signal %s: %s\n", sc.host, err.Signal(), err.Msg())
+			} else if len(err.Signal()) != 0 {
+				fmt.Fprintf(os.Stderr, "%s: remote command killed by signal %s\n", sc.host, err.Signal())
+			}
 			os.Exit(err.ExitStatus())
 		default:
 		}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+// multi mode: run one command on many hosts concurrently over one shared BoringMachine
+
+const defaultParallel = 8
+
+type multiOption struct {
+	hostFiles []string
+	parallel  int
+	outputDir string
+	options   []string // -o, applied to every host
+	identity  string
+	insecure  bool
+	v4        bool
+	v6        bool
+	p11Mu     sync.Mutex
+	p11       map[string]*PKCS11Provider // one helper and one PIN prompt per module for all hosts
+}
+
+type multiResult struct {
+	host     string
+	status   int
+	duration time.Duration
+	err      error
+}
+
+func multiUsage() {
+	fmt.Fprintf(os.Stdout, `tunnelssh multi - run a command on many hosts in parallel
+usage: %s multi <option> -- command ...
+  -h|--help        Show usage text and quit
+  -V|--verbose     Make the operation more talkative
+  -H|--hosts       File with one [user@]host[:port] per line, '#' starts a comment, repeatable
+  -p|--parallel    Number of hosts connected at the same time (default %d)
+  -O|--output-dir  Write output to <dir>/<host>.out and <host>.err instead of host prefixed lines
+  -o|--option      Partially compatible with SSH, applied to every host
+  -i|--identity    Selects a file from which the identity (private key) is read
+  -k|--insecure    Ignore the check of the server public key. Only for testing
+  -4               Forces ssh to use IPv4 addresses only.
+  -6               Forces ssh to use IPv6 addresses only.
+The command is joined with spaces and run by the remote shell like ssh: -- sh -c "'a b'" keeps 'a b' whole.
+User, Port and IdentityFile of each host come from ssh_config. Only public key authentication is used.
+Exit status: 0 all hosts succeeded, 1 a command failed, 255 a host could not be reached.
+
+`, os.Args[0], defaultParallel)
+}
+
+// Invoke multi args
+func (mo *multiOption) Invoke(val int, oa, raw string) error {
+	switch val {
+	case 'h':
+		multiUsage()
+		os.Exit(0)
+	case 'V':
+		IsDebugMode = true
+	case 'H':
+		mo.hostFiles = append(mo.hostFiles, oa)
+	case 'p':
+		n, err := strconv.Atoi(oa)
+		if err != nil || n <= 0 {
+			return cli.ErrorCat("invalid parallel: ", oa)
+		}
+		mo.parallel = n
+	case 'O':
+		mo.outputDir = oa
+	case 'o':
+		mo.options = append(mo.options, oa)
+	case 'i':
+		mo.identity = oa
+	case 'k':
+		mo.insecure = true
+	case '4':
+		mo.v4 = true
+	case '6':
+		mo.v6 = true
+	}
+	return nil
+}
+
+// readHostFile [user@]host[:port] per line
+func readHostFile(name string) ([]string, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var hosts []string
+	br := bufio.NewScanner(fd)
+	for br.Scan() {
+		line := br.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, br.Err()
+}
+
+// splitHostSpec [user@]host[:port], brackets of [ipv6] are removed like splitRemote,
+// a bare ipv6 address without brackets has no port
+func splitHostSpec(spec string) (address, port string) {
+	start := strings.IndexByte(spec, '@') + 1
+	if start < len(spec) && spec[start] == '[' {
+		if end := strings.IndexByte(spec[start:], ']'); end != -1 {
+			hostEnd := start + end + 1
+			address = spec[:start] + spec[start+1:hostEnd-1]
+			if hostEnd < len(spec) && spec[hostEnd] == ':' {
+				return address, spec[hostEnd+1:]
+			}
+			return address, ""
+		}
+	}
+	if strings.Count(spec[start:], ":") == 1 {
+		pos := strings.IndexByte(spec[start:], ':')
+		return spec[:start+pos], spec[start+pos+1:]
+	}
+	return spec, ""
+}
+
+// prefixWriter write complete lines with host prefix, lines of all hosts share out
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		pw.writeLine(pw.buf[:i+1])
+		pw.buf = pw.buf[i+1:]
+	}
+}
+
+func (pw *prefixWriter) writeLine(line []byte) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	_, _ = io.WriteString(pw.out, pw.prefix)
+	_, _ = pw.out.Write(line)
+}
+
+// Flush last line without newline
+func (pw *prefixWriter) Flush() {
+	if len(pw.buf) != 0 {
+		pw.writeLine(append(pw.buf, '\n'))
+		pw.buf = nil
+	}
+}
+
+// promptMu prompts of concurrent connections would interleave, one at a time
+var promptMu sync.Mutex
+
+// newHostClient SSHClient of host with the shared options, User, Port and IdentityFile from ssh_config
+func (mo *multiOption) newHostClient(spec string, bm *tunnel.BoringMachine) (*SSHClient, error) {
+	sc := NewSSHClient()
+	for _, o := range mo.options {
+		if !sc.ParseOption(o) {
+			return nil, cli.ErrorCat("option not support '", o, "'")
+		}
+	}
+	sc.IdentityFile, sc.insecure, sc.v4, sc.v6 = mo.identity, mo.insecure, mo.v4, mo.v6
+	address, port := splitHostSpec(spec)
+	if len(port) != 0 {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, cli.ErrorCat("invaild port number: ", port)
+		}
+		sc.port = p
+	}
+	// no password prompt, key passphrases and host keys are asked one host at a time
+	sc.config.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		return sc.AuthSigners()
+	})}
+	sc.config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		return sc.HostKeyCallback(hostname, remote, key)
+	}
+	if err := sc.Prepare(address); err != nil {
+		return nil, err
+	}
+	if sc.p11 != nil {
+		sc.p11, sc.p11Shared = mo.sharedPKCS11(sc.p11), true
+	}
+	sc.bm = bm
+	return sc, nil
+}
+
+// sharedPKCS11 provider of the same module loaded by another host
+func (mo *multiOption) sharedPKCS11(p *PKCS11Provider) *PKCS11Provider {
+	mo.p11Mu.Lock()
+	defer mo.p11Mu.Unlock()
+	if shared, ok := mo.p11[p.Module]; ok {
+		return shared
+	}
+	if mo.p11 == nil {
+		mo.p11 = make(map[string]*PKCS11Provider)
+	}
+	mo.p11[p.Module] = p
+	return p
+}
+
+// closePKCS11 stop helpers after all hosts are done
+func (mo *multiOption) closePKCS11() {
+	for _, p := range mo.p11 {
+		_ = p.Close()
+	}
+}
+
+// hostFileName host spec as file name
+func hostFileName(spec string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, spec)
+}
+
+// run command on host, status is 255 when the host cannot be reached
+func (mo *multiOption) run(ctx context.Context, spec, command string, bm *tunnel.BoringMachine, outMu *sync.Mutex) *multiResult {
+	r := &multiResult{host: spec, status: 255}
+	start := time.Now()
+	defer func() {
+		r.duration = time.Since(start)
+	}()
+	sc, err := mo.newHostClient(spec, bm)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	// interrupt closes the connection to abort Dial or Run, the deferred close runs after stop()
+	var closeOnce sync.Once
+	closeClient := func() {
+		closeOnce.Do(func() { _ = sc.Close() })
+	}
+	stop := context.AfterFunc(ctx, closeClient)
+	defer func() {
+		stop()
+		closeClient()
+	}()
+	if err := sc.Dial(); err != nil {
+		r.err = err
+		return r
+	}
+	var stdout, stderr io.Writer
+	if len(mo.outputDir) != 0 {
+		name := filepath.Join(mo.outputDir, hostFileName(spec))
+		fo, err := os.Create(name + ".out")
+		if err != nil {
+			r.err = err
+			return r
+		}
+		defer fo.Close()
+		fe, err := os.Create(name + ".err")
+		if err != nil {
+			r.err = err
+			return r
+		}
+		defer fe.Close()
+		stdout, stderr = fo, fe
+	} else {
+		po := &prefixWriter{mu: outMu, out: os.Stdout, prefix: cli.StrCat(spec, ": ")}
+		pe := &prefixWriter{mu: outMu, out: os.Stderr, prefix: cli.StrCat(spec, ": ")}
+		defer po.Flush()
+		defer pe.Flush()
+		stdout, stderr = po, pe
+	}
+	sc.sess.Stdout, sc.sess.Stderr = stdout, stderr
+	if err := sc.SendEnv(); err != nil {
+		DebugPrint("%s: SendEnv: %v", spec, err)
+	}
+	err = sc.sess.Run(command)
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		r.status = 0
+	case errors.As(err, &exitErr):
+		r.status = exitErr.ExitStatus()
+		if len(exitErr.Signal()) != 0 {
+			r.err = cli.ErrorCat("killed by signal ", exitErr.Signal())
+		}
+	case ctx.Err() != nil:
+		r.err = errors.New("interrupted")
+	default:
+		// connection lost or no exit status sent, like OpenSSH
+		r.err = err
+	}
+	return r
+}
+
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 2, 64) + "s"
+}
+
+// summary table of all hosts on stderr
+func summary(results []*multiResult) {
+	width := len("HOST")
+	for _, r := range results {
+		if len(r.host) > width {
+			width = len(r.host)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n%-*s  %4s  %8s  %s\n", width, "HOST", "EXIT", "TIME", "ERROR")
+	for _, r := range results {
+		var msg string
+		if r.err != nil {
+			msg = r.err.Error()
+		}
+		line := fmt.Sprintf("%-*s  %4d  %8s  %s", width, r.host, r.status, formatDuration(r.duration), msg)
+		fmt.Fprintln(os.Stderr, strings.TrimRight(line, " "))
+	}
+}
+
+func multiMain(args []string) int {
+	mo := &multiOption{parallel: defaultParallel}
+	ae := cli.ParseArgs{SubcmdMode: true}
+	ae.Add("help", cli.NOARG, 'h')
+	ae.Add("verbose", cli.NOARG, 'V')
+	ae.Add("hosts", cli.REQUIRED, 'H')
+	ae.Add("parallel", cli.REQUIRED, 'p')
+	ae.Add("output-dir", cli.REQUIRED, 'O')
+	ae.Add("option", cli.REQUIRED, 'o')
+	ae.Add("identity", cli.REQUIRED, 'i')
+	ae.Add("insecure", cli.NOARG, 'k')
+	ae.Add("ipv4", cli.NOARG, '4')
+	ae.Add("ipv6", cli.NOARG, '6')
+	if cli.IsTrue(os.Getenv("TUNNEL_DEBUG")) {
+		IsDebugMode = true
+	}
+	if err := ae.Execute(args, mo); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		return 1
+	}
+	// set once here, workers only read them
+	applyDebugMode()
+	if mo.v4 && mo.v6 {
+		fmt.Fprintf(os.Stderr, "ParseArgv: -4 (IPv4 only) /-6 (IPv6 only) cannot be set at the same time\n")
+		return 1
+	}
+	if len(mo.hostFiles) == 0 || len(ae.Unresolved()) == 0 {
+		multiUsage()
+		return 1
+	}
+	var hosts []string
+	for _, name := range mo.hostFiles {
+		h, err := readHostFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multi: %s\n", err)
+			return 1
+		}
+		hosts = append(hosts, h...)
+	}
+	if len(hosts) == 0 {
+		fmt.Fprintf(os.Stderr, "multi: no hosts\n")
+		return 1
+	}
+	if len(mo.outputDir) != 0 {
+		if err := os.MkdirAll(mo.outputDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "multi: %s\n", err)
+			return 1
+		}
+	}
+	// like ssh: arguments are joined with spaces and run by the remote shell, quote once more to keep an argument whole
+	command := strings.Join(ae.Unresolved(), " ")
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+	defer cancel()
+	bm := NewBoringMachine()
+	// hosts behind the same proxy hit 407 at the same time, ask one at a time
+	askCredential, passphrase := bm.AskCredential, bm.Passphrase
+	bm.AskCredential = func(ctx *tunnel.ProxyAuthContext, user string) (string, string, error) {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		return askCredential(ctx, user)
+	}
+	bm.Passphrase = func(path string) (string, error) {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		return passphrase(path)
+	}
+	results := make([]*multiResult, len(hosts))
+	var outMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, mo.parallel)
+	for i, spec := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = &multiResult{host: spec, status: 255, err: errors.New("interrupted")}
+				return
+			}
+			defer func() { <-sem }()
+			results[i] = mo.run(ctx, spec, command, bm, &outMu)
+		}()
+	}
+	wg.Wait()
+	mo.closePKCS11()
+	summary(results)
+	status := 0
+	for _, r := range results {
+		switch {
+		case r.status == 255 && r.err != nil:
+			status = 255
+		case r.status != 0 && status == 0:
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSplitHostSpec(t *testing.T) {
+	tests := []struct {
+		spec, address, port string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com:2222", "example.com", "2222"},
+		{"alice@example.com:2222", "alice@example.com", "2222"},
+		{"[::1]", "::1", ""},
+		{"[::1]:2222", "::1", "2222"},
+		{"alice@[fe80::1]", "alice@fe80::1", ""},
+		{"alice@[fe80::1]:22", "alice@fe80::1", "22"},
+		{"fe80::1", "fe80::1", ""},
+	}
+	for _, tt := range tests {
+		address, port := splitHostSpec(tt.spec)
+		if address != tt.address || port != tt.port {
+			t.Errorf("splitHostSpec(%q) = %q, %q; want %q, %q", tt.spec, address, port, tt.address, tt.port)
+		}
+	}
+}
+
+func TestSharedPKCS11(t *testing.T) {
+	t.Setenv(pkcs11HelperEnvironmentName, filepath.Join(t.TempDir(), "no-such-helper"))
+	mo := &multiOption{}
+	providers := make([]*PKCS11Provider, 8)
+	var wg sync.WaitGroup
+	for i := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := mo.sharedPKCS11(&PKCS11Provider{Module: "/usr/lib/fake-pkcs11.so"})
+			// hosts load the shared provider concurrently, the helper is started once
+			if _, err := p.Signers(); err == nil {
+				t.Error("Signers without helper succeeded")
+			}
+			providers[i] = p
+		}()
+	}
+	wg.Wait()
+	for _, p := range providers[1:] {
+		if p != providers[0] {
+			t.Fatal("hosts got different providers for the same module")
+		}
+	}
+	if p := mo.sharedPKCS11(&PKCS11Provider{Module: "/usr/lib/other-pkcs11.so"}); p == providers[0] {
+		t.Fatal("different modules share a provider")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS#11 token support.
+// We don't link the PKCS#11 module into tunnelssh (that requires cgo), the module is
+// loaded by OpenSSH's ssh-pkcs11-helper, we speak the helper protocol over its stdin/stdout.
+// https://github.com/openssh/openssh-portable/blob/master/ssh-pkcs11-client.c
+
+// helper protocol messages
+const (
+	pkcs11AgentFailure          = 5
+	pkcs11IdentitiesAnswer      = 12
+	pkcs11SignRequest           = 13
+	pkcs11SignResponse          = 14
+	pkcs11AddSmartcardKey       = 20
+	pkcs11MaxMessageLength      = 256 * 1024
+	pkcs11HelperEnvironmentName = "SSH_PKCS11_HELPER"
+)
+
+// DigestInfo prefix for PKCS#1 v1.5 signature, the helper signs raw data
+var pkcs11DigestInfo = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// error
+var (
+	ErrPKCS11HelperNotFound = errors.New("ssh-pkcs11-helper not found")
+)
+
+func lookupPKCS11Helper() (string, error) {
+	if helper := os.Getenv(pkcs11HelperEnvironmentName); len(helper) != 0 {
+		return helper, nil
+	}
+	if helper, err := exec.LookPath("ssh-pkcs11-helper"); err == nil {
+		return helper, nil
+	}
+	for _, d := range []string{"/usr/lib/openssh", "/usr/libexec/openssh", "/usr/libexec", "/usr/lib/ssh", "/usr/local/libexec"} {
+		helper := filepath.Join(d, "ssh-pkcs11-helper")
+		if _, err := os.Stat(helper); err == nil {
+			return helper, nil
+		}
+	}
+	return "", ErrPKCS11HelperNotFound
+}
+
+// PKCS11Provider keys on PKCS#11 token
+type PKCS11Provider struct {
+	Module  string
+	AskPIN  func(prompt string) (string, error)
+	cmd     *exec.Cmd
+	w       io.WriteCloser
+	r       *bufio.Reader
+	mu      sync.Mutex
+	signers []ssh.Signer
+	once    sync.Once // multi mode shares one provider between hosts
+	loadErr error
+}
+
+func (p *PKCS11Provider) send(msg []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(msg)))
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(msg)
+	return err
+}
+
+func (p *PKCS11Provider) recv() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	if l == 0 || l > pkcs11MaxMessageLength {
+		return nil, cli.ErrorCat("invalid ssh-pkcs11-helper message length")
+	}
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(p.r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (p *PKCS11Provider) converse(msg []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.send(msg); err != nil {
+		return nil, err
+	}
+	return p.recv()
+}
+
+func (p *PKCS11Provider) start() error {
+	helper, err := lookupPKCS11Helper()
+	if err != nil {
+		return err
+	}
+	DebugPrint("Use PKCS#11 helper %s", helper)
+	p.cmd = exec.Command(helper)
+	p.cmd.Stderr = os.Stderr
+	if p.w, err = p.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	p.r = bufio.NewReader(out)
+	return p.cmd.Start()
+}
+
+// Load start helper and enumerate keys on the token
+func (p *PKCS11Provider) Load() error {
+	if err := p.start(); err != nil {
+		return err
+	}
+	return p.load()
+}
+
+// load add the token to the running helper
+func (p *PKCS11Provider) load() error {
+	var pin string
+	if p.AskPIN != nil {
+		var err error
+		if pin, err = p.AskPIN(cli.StrCat("Enter PIN for '", p.Module, "'")); err != nil {
+			return err
+		}
+	}
+	resp, err := p.converse(ssh.Marshal(struct {
+		Type   byte
+		Module string
+		PIN    string
+	}{pkcs11AddSmartcardKey, p.Module, pin}))
+	if err != nil {
+		return err
+	}
+	switch resp[0] {
+	case pkcs11IdentitiesAnswer:
+	case pkcs11AgentFailure:
+		return cli.ErrorCat("PKCS#11 provider ", p.Module, ": cannot load keys (wrong PIN?)")
+	default:
+		return cli.ErrorCat("PKCS#11 provider ", p.Module, ": unexpected helper response")
+	}
+	var answer struct {
+		NumKeys uint32
+		Keys    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(resp[1:], &answer); err != nil {
+		return err
+	}
+	rest := answer.Keys
+	for i := uint32(0); i < answer.NumKeys; i++ {
+		var k struct {
+			Blob  []byte
+			Label string
+			Rest  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &k); err != nil {
+			return err
+		}
+		rest = k.Rest
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			DebugPrint("PKCS#11 key %s: %v", k.Label, err)
+			continue
+		}
+		cpk, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			continue
+		}
+		sig, err := ssh.NewSignerFromSigner(&pkcs11Key{p: p, pub: pub, cpk: cpk.CryptoPublicKey()})
+		if err != nil {
+			DebugPrint("PKCS#11 key %s: %v", k.Label, err)
+			continue
+		}
+		DebugPrint("Offering PKCS#11 key: %s %s", k.Label, ssh.FingerprintSHA256(pub))
+		p.signers = append(p.signers, sig)
+	}
+	return nil
+}
+
+// Signers return token keys, load at first use
+func (p *PKCS11Provider) Signers() ([]ssh.Signer, error) {
+	p.once.Do(func() {
+		p.loadErr = p.Load()
+	})
+	if p.loadErr != nil {
+		return nil, p.loadErr
+	}
+	return p.signers, nil
+}
+
+// Close stop helper
+func (p *PKCS11Provider) Close() error {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+	_ = p.w.Close()
+	return p.cmd.Wait()
+}
+
+// pkcs11Key crypto.Signer backed by the token
+type pkcs11Key struct {
+	p   *PKCS11Provider
+	pub ssh.PublicKey
+	cpk crypto.PublicKey
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.cpk
+}
+
+func (k *pkcs11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	data := digest
+	if k.pub.Type() == ssh.KeyAlgoRSA {
+		prefix, ok := pkcs11DigestInfo[opts.HashFunc()]
+		if !ok {
+			return nil, cli.ErrorCat("PKCS#11: unsupported hash for RSA signature")
+		}
+		data = append(append([]byte{}, prefix...), digest...)
+	}
+	resp, err := k.p.converse(ssh.Marshal(struct {
+		Type  byte
+		Blob  []byte
+		Data  []byte
+		Flags uint32
+	}{pkcs11SignRequest, k.pub.Marshal(), data, 0}))
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pkcs11SignResponse {
+		return nil, cli.ErrorCat("PKCS#11: token refused to sign")
+	}
+	var sig struct {
+		Signature []byte
+	}
+	if err := ssh.Unmarshal(resp[1:], &sig); err != nil {
+		return nil, err
+	}
+	return sig.Signature, nil
+}
+
+// AskPIN read token PIN
+func (sc *SSHClient) AskPIN(prompt string) (string, error) {
+	if pty.IsTerminal(os.Stdin) {
+		return pty.ReadPassword(prompt)
+	}
+	return readAskPass(prompt, "PIN", true)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakePKCS11Helper ssh-pkcs11-helper on a pipe, signs like the helper: raw PKCS#1 v1.5 for RSA, DER for ECDSA
+type fakePKCS11Helper struct {
+	t       *testing.T
+	pin     string
+	keys    map[string]crypto.Signer // by public key blob
+	order   []ssh.PublicKey
+	refuse  bool
+	r       *bufio.Reader
+	w       io.WriteCloser
+	signed  [][]byte // data of sign requests
+	badFlag bool
+}
+
+func newFakePKCS11Helper(t *testing.T, pin string, keys ...crypto.Signer) (*fakePKCS11Helper, *PKCS11Provider) {
+	t.Helper()
+	h := &fakePKCS11Helper{t: t, pin: pin, keys: make(map[string]crypto.Signer)}
+	for _, k := range keys {
+		pub, err := ssh.NewPublicKey(k.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.keys[string(pub.Marshal())] = k
+		h.order = append(h.order, pub)
+	}
+	toHelper, toHelperW := io.Pipe()
+	fromHelper, fromHelperW := io.Pipe()
+	h.r, h.w = bufio.NewReader(toHelper), fromHelperW
+	p := &PKCS11Provider{
+		Module: "/usr/lib/fake-pkcs11.so",
+		AskPIN: func(prompt string) (string, error) { return pin, nil },
+		w:      toHelperW,
+		r:      bufio.NewReader(fromHelper),
+	}
+	go h.serve()
+	t.Cleanup(func() {
+		toHelperW.Close()
+		fromHelperW.Close()
+	})
+	return h, p
+}
+
+func (h *fakePKCS11Helper) reply(msg []byte) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(msg)))
+	_, _ = h.w.Write(append(hdr[:], msg...))
+}
+
+func (h *fakePKCS11Helper) serve() {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(h.r, hdr[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(h.r, msg); err != nil {
+			return
+		}
+		switch msg[0] {
+		case pkcs11AddSmartcardKey:
+			var req struct {
+				Type   byte
+				Module string
+				PIN    string
+			}
+			if err := ssh.Unmarshal(msg, &req); err != nil || req.PIN != h.pin {
+				h.reply([]byte{pkcs11AgentFailure})
+				continue
+			}
+			resp := []byte{pkcs11IdentitiesAnswer}
+			resp = binary.BigEndian.AppendUint32(resp, uint32(len(h.order)))
+			for i, pub := range h.order {
+				resp = append(resp, ssh.Marshal(struct {
+					Blob  []byte
+					Label string
+				}{pub.Marshal(), "key" + strconv.Itoa(i)})...)
+			}
+			h.reply(resp)
+		case pkcs11SignRequest:
+			var req struct {
+				Type  byte
+				Blob  []byte
+				Data  []byte
+				Flags uint32
+			}
+			if err := ssh.Unmarshal(msg, &req); err != nil {
+				h.reply([]byte{pkcs11AgentFailure})
+				continue
+			}
+			h.signed = append(h.signed, req.Data)
+			if req.Flags != 0 {
+				h.badFlag = true
+			}
+			k, ok := h.keys[string(req.Blob)]
+			if !ok || h.refuse {
+				h.reply([]byte{pkcs11AgentFailure})
+				continue
+			}
+			var sig []byte
+			var err error
+			switch k := k.(type) {
+			case *rsa.PrivateKey:
+				sig, err = rsa.SignPKCS1v15(nil, k, crypto.Hash(0), req.Data)
+			case *ecdsa.PrivateKey:
+				sig, err = ecdsa.SignASN1(rand.Reader, k, req.Data)
+			}
+			if err != nil {
+				h.reply([]byte{pkcs11AgentFailure})
+				continue
+			}
+			h.reply(append([]byte{pkcs11SignResponse}, ssh.Marshal(struct{ Signature []byte }{sig})...))
+		default:
+			h.reply([]byte{pkcs11AgentFailure})
+		}
+	}
+}
+
+func TestPKCS11DigestInfo(t *testing.T) {
+	for hash, fn := range map[crypto.Hash]func([]byte) []byte{
+		crypto.SHA1:   func(b []byte) []byte { d := sha1.Sum(b); return d[:] },
+		crypto.SHA256: func(b []byte) []byte { d := sha256.Sum256(b); return d[:] },
+		crypto.SHA512: func(b []byte) []byte { d := sha512.Sum512(b); return d[:] },
+	} {
+		prefix := pkcs11DigestInfo[hash]
+		// DigestInfo ends with the OCTET STRING header of the digest, the SEQUENCE covers prefix and digest
+		digest := fn([]byte("data"))
+		if prefix[0] != 0x30 || int(prefix[1]) != len(prefix)-2+len(digest) {
+			t.Fatalf("%v: bad SEQUENCE length", hash)
+		}
+		if prefix[len(prefix)-2] != 0x04 || int(prefix[len(prefix)-1]) != len(digest) {
+			t.Fatalf("%v: bad digest OCTET STRING", hash)
+		}
+	}
+}
+
+func TestPKCS11SignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, p := newFakePKCS11Helper(t, "1234", key)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.signers) != 1 {
+		t.Fatalf("got %d signers", len(p.signers))
+	}
+	as, ok := p.signers[0].(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatal("RSA signer without algorithm selection")
+	}
+	data := []byte("session id and userauth request")
+	for _, c := range []struct {
+		algo string
+		hash crypto.Hash
+	}{
+		{ssh.KeyAlgoRSA, crypto.SHA1},
+		{ssh.KeyAlgoRSASHA256, crypto.SHA256},
+		{ssh.KeyAlgoRSASHA512, crypto.SHA512},
+	} {
+		sig, err := as.SignWithAlgorithm(rand.Reader, data, c.algo)
+		if err != nil {
+			t.Fatalf("%s: %v", c.algo, err)
+		}
+		if err := as.PublicKey().Verify(data, sig); err != nil {
+			t.Fatalf("%s: verify: %v", c.algo, err)
+		}
+		// the helper gets DigestInfo of the hash named by the algorithm
+		hh := c.hash.New()
+		hh.Write(data)
+		want := append(append([]byte{}, pkcs11DigestInfo[c.hash]...), hh.Sum(nil)...)
+		if got := h.signed[len(h.signed)-1]; !bytes.Equal(got, want) {
+			t.Fatalf("%s: helper got %x want %x", c.algo, got, want)
+		}
+	}
+	if h.badFlag {
+		t.Fatal("sign request with non-zero flags")
+	}
+}
+
+func TestPKCS11SignECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, p := newFakePKCS11Helper(t, "", key)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.signers) != 1 {
+		t.Fatalf("got %d signers", len(p.signers))
+	}
+	data := []byte("session id and userauth request")
+	sig, err := p.signers[0].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.signers[0].PublicKey().Verify(data, sig); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	// ECDSA signs the bare digest
+	digest := sha256.Sum256(data)
+	if got := h.signed[0]; !bytes.Equal(got, digest[:]) {
+		t.Fatalf("helper got %x", got)
+	}
+	if h.badFlag {
+		t.Fatal("sign request with non-zero flags")
+	}
+}
+
+func TestPKCS11WrongPIN(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p := newFakePKCS11Helper(t, "1234", key)
+	p.AskPIN = func(prompt string) (string, error) { return "0000", nil }
+	err = p.load()
+	if err == nil || !strings.Contains(err.Error(), "wrong PIN") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestPKCS11SignRefused(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, p := newFakePKCS11Helper(t, "", key)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	h.refuse = true
+	if _, err := p.signers[0].Sign(rand.Reader, []byte("data")); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("got %v", err)
+	}
+}
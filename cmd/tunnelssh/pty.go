@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 // tunnelssh PTY code
 
 // https://github.com/google/goexpect/blob/master/expect.go
@@ -8,9 +10,25 @@ package main
 // TerminalMode mode
 type TerminalMode int
 
-// Mode
+// Mode RequestTTY auto, no, force, yes
 const (
 	TerminalModeAuto TerminalMode = iota
 	TerminalModeNone
 	TerminalModeForce
+	TerminalModeYes
 )
+
+// ParseTerminalMode RequestTTY value
+func ParseTerminalMode(s string) (TerminalMode, bool) {
+	switch strings.ToLower(s) {
+	case "auto":
+		return TerminalModeAuto, true
+	case "no", "false":
+		return TerminalModeNone, true
+	case "yes", "true":
+		return TerminalModeYes, true
+	case "force":
+		return TerminalModeForce, true
+	}
+	return TerminalModeAuto, false
+}
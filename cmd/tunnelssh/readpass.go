@@ -6,12 +6,15 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/balibuild/tunnelssh/cli"
 	"github.com/balibuild/tunnelssh/pty"
+	"github.com/balibuild/tunnelssh/tunnel"
 )
 
 // GIT_ASKPASS
@@ -91,3 +94,64 @@ func (sc *SSHClient) AskPassword() (string, error) {
 	prompt := cli.StrCat("Enter your credentials for ", sc.config.User, "@", sc.host)
 	return readAskPass(prompt, sc.config.User, true)
 }
+
+// proxy credential asked once per process, reused when reconnecting
+var proxyCredential struct {
+	sync.Mutex
+	user     string
+	password string
+}
+
+// askProxyCredential tunnel.ProxyCredentialFunc, terminal or askpass
+func askProxyCredential(ctx *tunnel.ProxyAuthContext, name string) (string, string, error) {
+	proxyCredential.Lock()
+	defer proxyCredential.Unlock()
+	if len(proxyCredential.user) != 0 && (len(name) == 0 || name == proxyCredential.user) {
+		return proxyCredential.user, proxyCredential.password, nil
+	}
+	var password string
+	var err error
+	if pty.IsTerminal(os.Stdin) {
+		if len(name) == 0 {
+			fmt.Fprintf(os.Stderr, "User for proxy %s: ", ctx.Proxy)
+			b, err := pty.ReadInputEx(os.Stdin)
+			if err != nil {
+				return "", "", err
+			}
+			name = strings.TrimSpace(string(b))
+		}
+		password, err = pty.ReadPassword(cli.StrCat("Password for proxy ", name, "@", ctx.Proxy))
+		fmt.Fprintln(os.Stderr)
+	} else {
+		if len(name) == 0 {
+			if u, err := user.Current(); err == nil {
+				name = u.Username
+			}
+		}
+		password, err = readAskPass(cli.StrCat("Enter your credentials for proxy ", ctx.Proxy), name, true)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	proxyCredential.user, proxyCredential.password = name, password
+	return name, password, nil
+}
+
+// forgetProxyCredential proxy rejected it, ask again next time
+func forgetProxyCredential() {
+	proxyCredential.Lock()
+	defer proxyCredential.Unlock()
+	proxyCredential.user, proxyCredential.password = "", ""
+}
+
+// askCredentialPassphrase passphrase of encrypted proxy credential file
+func askCredentialPassphrase(path string) (string, error) {
+	if p := os.Getenv("TUNNEL_CREDENTIAL_PASSPHRASE"); len(p) != 0 {
+		return p, nil
+	}
+	if pty.IsTerminal(os.Stdin) {
+		defer fmt.Fprintln(os.Stderr)
+		return pty.ReadPassword(cli.StrCat("Passphrase for ", path))
+	}
+	return readAskPass(cli.StrCat("Enter passphrase for ", path), "", true)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/pty"
+)
+
+// session recording and replay in asciicast v2 format https://docs.asciinema.org/manual/asciicast/v2/
+
+// long only flags
+const (
+	optRecord      = 1002
+	optRecordInput = 1003
+)
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder write events of one session, output and input streams are written concurrently
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	bw    *bufio.Writer
+	start time.Time
+}
+
+func newRecorder(path string, hdr *castHeader) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{f: f, bw: bufio.NewWriter(f), start: time.Now()}
+	hdr.Version = 2
+	hdr.Timestamp = r.start.Unix()
+	line, err := json.Marshal(hdr)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	_, _ = r.bw.Write(append(line, '\n'))
+	return r, nil
+}
+
+// event append [time, code, data]
+func (r *recorder) event(code string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bw == nil {
+		return
+	}
+	r.writeEvent(code, string(data))
+}
+
+func (r *recorder) writeEvent(code, data string) {
+	line, err := json.Marshal([]interface{}{
+		json.Number(strconv.FormatFloat(time.Since(r.start).Seconds(), 'f', 6, 64)), code, data,
+	})
+	if err != nil {
+		return
+	}
+	_, _ = r.bw.Write(append(line, '\n'))
+	if code == "o" {
+		_ = r.bw.Flush() // keep the recording usable when tunnelssh is killed
+	}
+}
+
+// resize window-change as "r" event
+func (r *recorder) resize(w, h int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bw != nil {
+		r.writeEvent("r", cli.StrCat(strconv.Itoa(w), "x", strconv.Itoa(h)))
+	}
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bw == nil {
+		return nil
+	}
+	_ = r.bw.Flush()
+	r.bw = nil
+	return r.f.Close()
+}
+
+// recordWriter tee of a session stream, stdout and stderr share code "o" but are written concurrently
+type recordWriter struct {
+	w       io.Writer
+	rec     *recorder
+	code    string
+	pending []byte // incomplete UTF-8 sequence of this stream
+}
+
+func (rw *recordWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if n > 0 {
+		rw.record(p[:n])
+	}
+	return n, err
+}
+
+// record keep events to whole UTF-8 sequences
+func (rw *recordWriter) record(p []byte) {
+	data := p
+	if len(rw.pending) != 0 {
+		data = append(rw.pending, p...)
+	}
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	rw.pending = append([]byte(nil), data[cut:]...)
+	if cut != 0 {
+		rw.rec.event(rw.code, data[:cut])
+	}
+}
+
+// startRecord --record, size of the session terminal
+func (sc *SSHClient) startRecord(w, h int) error {
+	if len(sc.recordFile) == 0 {
+		return nil
+	}
+	hdr := &castHeader{
+		Width:  w,
+		Height: h,
+		Title:  cli.StrCat("tunnelssh ", sc.host),
+		Env:    map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	rec, err := newRecorder(sc.recordFile, hdr)
+	if err != nil {
+		return cli.ErrorCat("record: ", err.Error())
+	}
+	DebugPrint("Recording session to %s", sc.recordFile)
+	sc.rec = rec
+	return nil
+}
+
+// replay
+
+type replayOption struct {
+	speed     float64
+	idleLimit float64
+}
+
+func replayUsage() {
+	fmt.Fprintf(os.Stdout, `tunnelssh replay - play back a session recorded with --record
+usage: %s replay <option> file.cast
+  -h|--help             Show usage text and quit
+  -s|--speed            Playback speed, 2 is twice as fast (default 1)
+  -i|--idle-time-limit  Limit idle time between events to seconds
+
+`, os.Args[0])
+}
+
+// Invoke replay args
+func (ro *replayOption) Invoke(val int, oa, raw string) error {
+	switch val {
+	case 'h':
+		replayUsage()
+		os.Exit(0)
+	case 's':
+		v, err := strconv.ParseFloat(oa, 64)
+		if err != nil || v <= 0 {
+			return cli.ErrorCat("invalid speed: ", oa)
+		}
+		ro.speed = v
+	case 'i':
+		v, err := strconv.ParseFloat(oa, 64)
+		if err != nil || v <= 0 {
+			return cli.ErrorCat("invalid idle time limit: ", oa)
+		}
+		ro.idleLimit = v
+	}
+	return nil
+}
+
+// play write output events of path to out
+func (ro *replayOption) play(path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	line, err := br.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return cli.ErrorCat(path, ": missing header")
+	}
+	var hdr castHeader
+	if err := json.Unmarshal(line, &hdr); err != nil || hdr.Version != 2 {
+		return cli.ErrorCat(path, ": not an asciicast v2 file")
+	}
+	if w, h, err := pty.GetWinSize(); err == nil && (w < hdr.Width || h < hdr.Height) {
+		fmt.Fprintf(os.Stderr, "recorded on %dx%d terminal, current %dx%d\n", hdr.Width, hdr.Height, w, h)
+	}
+	var last float64
+	for lineNo := 2; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 {
+			var ev []interface{}
+			if jerr := json.Unmarshal(line, &ev); jerr != nil || len(ev) != 3 {
+				return cli.ErrorCat(path, ":", strconv.Itoa(lineNo), ": bad event")
+			}
+			t, _ := ev[0].(float64)
+			code, _ := ev[1].(string)
+			data, _ := ev[2].(string)
+			delay := t - last
+			if ro.idleLimit > 0 && delay > ro.idleLimit {
+				delay = ro.idleLimit
+			}
+			last = t
+			if delay > 0 {
+				time.Sleep(time.Duration(delay / ro.speed * float64(time.Second)))
+			}
+			switch code {
+			case "o":
+				if _, err := io.WriteString(out, data); err != nil {
+					return err
+				}
+			case "r":
+				// the local terminal is not resized, like the header size it is only a hint
+			default:
+				// "i" input and "m" marker are not played back
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func replayMain(args []string) int {
+	ro := &replayOption{speed: 1}
+	var ae cli.ParseArgs
+	ae.Add("help", cli.NOARG, 'h')
+	ae.Add("speed", cli.REQUIRED, 's')
+	ae.Add("idle-time-limit", cli.REQUIRED, 'i')
+	if err := ae.Execute(args, ro); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		return 1
+	}
+	if len(ae.Unresolved()) != 1 {
+		replayUsage()
+		return 1
+	}
+	if err := ro.play(ae.Unresolved()[0], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s\n", err)
+		return 1
+	}
+	return 0
+}
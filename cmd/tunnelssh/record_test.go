@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	rec, err := newRecorder(path, &castHeader{Width: 80, Height: 24, Title: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var screen, remote bytes.Buffer
+	out := &recordWriter{w: &screen, rec: rec, code: "o"}
+	in := &recordWriter{w: &remote, rec: rec, code: "i"}
+	euro := []byte("€")
+	_, _ = out.Write([]byte("$ "))
+	_, _ = in.Write([]byte("echo hi\r"))
+	// a UTF-8 sequence split between two reads
+	_, _ = out.Write(append([]byte("hi "), euro[:1]...))
+	rec.resize(120, 40)
+	_, _ = out.Write(append(euro[1:], "\r\n"...))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines:\n%s", len(lines), buf)
+	}
+	if !strings.Contains(lines[0], `"version":2`) || !strings.Contains(lines[4], `"r","120x40"`) {
+		t.Fatalf("bad recording:\n%s", buf)
+	}
+	var played bytes.Buffer
+	ro := &replayOption{speed: 1000}
+	if err := ro.play(path, &played); err != nil {
+		t.Fatal(err)
+	}
+	if played.String() != screen.String() || played.String() != "$ hi €\r\n" {
+		t.Fatalf("replay %q, recorded %q", played.String(), screen.String())
+	}
+}
+
+func TestReplayBadFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty.cast": "",
+		"v1.cast":    `{"version":1,"width":80,"height":24}` + "\n",
+		"event.cast": `{"version":2,"width":80,"height":24}` + "\n" + `[0.1,"o"]` + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&replayOption{speed: 1}).play(path, &bytes.Buffer{}); err == nil {
+			t.Errorf("%s: played", name)
+		}
+	}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// tunnelssh scp mode (tunnelscp). SFTP is used by default, legacy scp protocol when
+// the server has no sftp subsystem or -O is given. Remote to remote copies always
+// go through the local host so both connections traverse the proxy.
+
+func scpUsage() {
+	fmt.Fprintf(os.Stdout, `tunnelscp - scp compatible file copy over tunnelssh connection
+usage: %s scp <option> source ... target
+  -h|--help        Show usage text and quit
+  -V|--verbose     Make the operation more talkative
+  -r               Recursively copy entire directories
+  -p               Preserves modification times, access times, and modes from the original file
+  -P|--port        Port to connect to on the remote host.
+  -i|--identity    Selects a file from which the identity (private key) is read
+  -o|--option      Partially compatible with SSH: SetEnv, ServerAliveInterval, ServerAliveCountMax, ConnectTimeout
+  -3               Copies between two remote hosts are transferred through the local host (always on)
+  -O               Use the legacy SCP protocol for file transfers instead of the SFTP protocol
+  -q               Quiet mode
+  -k|--insecure    Ignore the check of the server public key. Only for testing
+  -4               Forces ssh to use IPv4 addresses only.
+  -6               Forces ssh to use IPv6 addresses only.
+
+`, os.Args[0])
+}
+
+// scpFS file tree used by copy
+type scpFS interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string, perm os.FileMode) (io.WriteCloser, error)
+	Mkdir(name string, perm os.FileMode) error
+	Chtimes(name string, mtime time.Time) error
+	Join(elem ...string) string
+	Base(name string) string
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+func (localFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (localFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (localFS) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(name, mtime, mtime)
+}
+
+func (localFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (localFS) Base(name string) string {
+	return filepath.Base(name)
+}
+
+type sftpFS struct {
+	c *sftp.Client
+}
+
+func (s *sftpFS) Stat(name string) (os.FileInfo, error) {
+	return s.c.Stat(name)
+}
+
+func (s *sftpFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return s.c.ReadDir(name)
+}
+
+func (s *sftpFS) Open(name string) (io.ReadCloser, error) {
+	return s.c.Open(name)
+}
+
+func (s *sftpFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	a := &sftp.Attributes{}
+	a.SetPermissions(perm)
+	return s.c.OpenFile(name, sftp.FlagWrite|sftp.FlagCreate|sftp.FlagTrunc, a)
+}
+
+func (s *sftpFS) Mkdir(name string, perm os.FileMode) error {
+	if err := s.c.Mkdir(name); err != nil {
+		return err
+	}
+	return s.c.Chmod(name, perm|os.ModeDir)
+}
+
+func (s *sftpFS) Chtimes(name string, mtime time.Time) error {
+	a := &sftp.Attributes{}
+	a.SetTimes(mtime, mtime)
+	return s.c.Setstat(name, a)
+}
+
+func (s *sftpFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (s *sftpFS) Base(name string) string {
+	return path.Base(name)
+}
+
+type scpOption struct {
+	recursive bool
+	preserve  bool
+	legacy    bool
+	quiet     bool
+	flags     [][3]string // replayed on every SSHClient
+}
+
+// Invoke scp flags
+func (o *scpOption) Invoke(val int, oa, raw string) error {
+	switch val {
+	case 'h':
+		scpUsage()
+		os.Exit(0)
+	case 'r':
+		o.recursive = true
+	case 'p':
+		o.preserve = true
+	case 'O':
+		o.legacy = true
+	case 'q':
+		o.quiet = true
+	case '3':
+	case 'P':
+		o.flags = append(o.flags, [3]string{"p", oa, raw})
+	case 'V':
+		IsDebugMode = true
+	default:
+		o.flags = append(o.flags, [3]string{string(rune(val)), oa, raw})
+	}
+	return nil
+}
+
+// scpOperand parsed source/target
+type scpOperand struct {
+	host string // empty: local
+	path string
+}
+
+// parseOperand like scp: 'host:path' is remote unless a '/' comes before ':' or it is a drive letter
+func parseOperand(s string) scpOperand {
+	colon := strings.IndexByte(s, ':')
+	if strings.HasPrefix(s, "[") || (strings.Contains(s, "@[") && colon != -1) {
+		host, p := splitRemote(s)
+		return scpOperand{host: host, path: p}
+	}
+	if colon <= 0 || strings.ContainsAny(s[:colon], "/\\") {
+		return scpOperand{path: s}
+	}
+	if colon == 1 && ((s[0] >= 'a' && s[0] <= 'z') || (s[0] >= 'A' && s[0] <= 'Z')) && len(os.Getenv("SystemRoot")) != 0 {
+		return scpOperand{path: s} // C:\path on Windows
+	}
+	return scpOperand{host: s[:colon], path: s[colon+1:]}
+}
+
+// scpRemote connected remote side
+type scpRemote struct {
+	sc   *SSHClient
+	fs   *sftpFS // nil: legacy protocol
+	host string
+}
+
+func (o *scpOption) connect(host string) (*scpRemote, error) {
+	sc := NewSSHClient()
+	for _, f := range o.flags {
+		if err := sc.Invoke(int(f[0][0]), f[1], f[2]); err != nil {
+			return nil, err
+		}
+	}
+	if err := sc.Prepare(host); err != nil {
+		return nil, err
+	}
+	if err := sc.Connect(); err != nil {
+		return nil, cli.ErrorCat("Dial ", sc.host, ": ", err.Error())
+	}
+	r := &scpRemote{sc: sc, host: host}
+	if o.legacy {
+		return r, nil
+	}
+	c, err := sftp.NewClient(sc.ssh)
+	if err != nil {
+		DebugPrint("%s: sftp subsystem unavailable (%v), fallback to legacy scp protocol", host, err)
+		return r, nil
+	}
+	r.fs = &sftpFS{c: c}
+	return r, nil
+}
+
+func (r *scpRemote) Close() error {
+	if r.fs != nil {
+		_ = r.fs.c.Close()
+	}
+	return r.sc.Close()
+}
+
+func remoteDir(p string) string {
+	if len(p) == 0 {
+		return "."
+	}
+	return p
+}
+
+// resolveTarget copy into target when it's a directory
+func resolveTarget(fs scpFS, target, name string, multiple bool) (string, error) {
+	if fi, err := fs.Stat(target); err == nil && fi.IsDir() {
+		return fs.Join(target, name), nil
+	}
+	if multiple {
+		return "", cli.ErrorCat(target, ": not a directory")
+	}
+	return target, nil
+}
+
+func (o *scpOption) copyTree(src scpFS, srcPath string, dst scpFS, dstPath string) error {
+	fi, err := src.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !o.recursive {
+			return cli.ErrorCat(srcPath, ": not a regular file")
+		}
+		if err := dst.Mkdir(dstPath, fi.Mode().Perm()|0700); err != nil {
+			if dfi, serr := dst.Stat(dstPath); serr != nil || !dfi.IsDir() {
+				return err
+			}
+		}
+		entries, err := src.ReadDir(srcPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Mode()&os.ModeSymlink != 0 && !e.IsDir() {
+				if _, err := src.Stat(src.Join(srcPath, e.Name())); err != nil {
+					continue
+				}
+			}
+			if err := o.copyTree(src, src.Join(srcPath, e.Name()), dst, dst.Join(dstPath, e.Name())); err != nil {
+				return err
+			}
+		}
+		if o.preserve {
+			_ = dst.Chtimes(dstPath, fi.ModTime())
+		}
+		return nil
+	}
+	if !o.quiet {
+		fmt.Fprintf(os.Stderr, "%s -> %s (%d bytes)\n", srcPath, dstPath, fi.Size())
+	}
+	perm := os.FileMode(0644)
+	if o.preserve {
+		perm = fi.Mode().Perm()
+	}
+	r, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.Create(dstPath, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if o.preserve {
+		_ = dst.Chtimes(dstPath, fi.ModTime())
+	}
+	return nil
+}
+
+// legacy scp protocol
+// https://web.archive.org/web/20170215184048/https://blogs.oracle.com/janp/entry/how_the_scp_protocol_works
+
+type scpLegacy struct {
+	sess *ssh.Session
+	w    io.WriteCloser
+	r    *bufio.Reader
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (o *scpOption) startLegacy(conn *ssh.Client, mode, p string, targetDir bool) (*scpLegacy, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	l := &scpLegacy{sess: sess}
+	if l.w, err = sess.StdinPipe(); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	l.r = bufio.NewReader(out)
+	sess.Stderr = os.Stderr
+	cmd := "scp " + mode
+	if o.recursive {
+		cmd += " -r"
+	}
+	if o.preserve {
+		cmd += " -p"
+	}
+	if targetDir {
+		cmd += " -d"
+	}
+	cmd = cli.StrCat(cmd, " -- ", shellQuote(remoteDir(p)))
+	DebugPrint("legacy scp: %s", cmd)
+	if err := sess.Start(cmd); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *scpLegacy) ack() error {
+	b, err := l.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := l.r.ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if b == 1 {
+		fmt.Fprintf(os.Stderr, "scp: %s\n", msg)
+		return nil
+	}
+	return cli.ErrorCat("scp: ", msg)
+}
+
+func (l *scpLegacy) command(format string, a ...interface{}) error {
+	if _, err := fmt.Fprintf(l.w, format, a...); err != nil {
+		return err
+	}
+	return l.ack()
+}
+
+func (l *scpLegacy) Close() error {
+	_ = l.w.Close()
+	err := l.sess.Wait()
+	l.sess.Close()
+	return err
+}
+
+// Send we are source, remote is sink (scp -t)
+func (o *scpOption) legacySend(l *scpLegacy, src scpFS, p string) error {
+	fi, err := src.Stat(p)
+	if err != nil {
+		return err
+	}
+	name := src.Base(p)
+	if o.preserve {
+		mt := fi.ModTime().Unix()
+		if err := l.command("T%d 0 %d 0\n", mt, mt); err != nil {
+			return err
+		}
+	}
+	if fi.IsDir() {
+		if !o.recursive {
+			return cli.ErrorCat(p, ": not a regular file")
+		}
+		if err := l.command("D%04o 0 %s\n", fi.Mode().Perm(), name); err != nil {
+			return err
+		}
+		entries, err := src.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := o.legacySend(l, src, src.Join(p, e.Name())); err != nil {
+				return err
+			}
+		}
+		return l.command("E\n")
+	}
+	if !o.quiet {
+		fmt.Fprintf(os.Stderr, "%s (%d bytes)\n", p, fi.Size())
+	}
+	r, err := src.Open(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := l.command("C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), name); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(l.w, r, fi.Size()); err != nil {
+		return err
+	}
+	if _, err := l.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return l.ack()
+}
+
+// Receive we are sink, remote is source (scp -f)
+func (o *scpOption) legacyReceive(l *scpLegacy, dst scpFS, target string) error {
+	targetIsDir := false
+	if fi, err := dst.Stat(target); err == nil && fi.IsDir() {
+		targetIsDir = true
+	}
+	var dirs []string
+	var mtime time.Time
+	hasTime := false
+	next := func(name string) string {
+		if len(dirs) != 0 {
+			return dst.Join(dirs[len(dirs)-1], name)
+		}
+		if targetIsDir {
+			return dst.Join(target, name)
+		}
+		return target
+	}
+	sendAck := func() error {
+		_, err := l.w.Write([]byte{0})
+		return err
+	}
+	if err := sendAck(); err != nil {
+		return err
+	}
+	for {
+		line, err := l.r.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			return errors.New("scp: protocol error: empty record")
+		}
+		switch line[0] {
+		case 1:
+			fmt.Fprintf(os.Stderr, "scp: %s\n", line[1:])
+			continue
+		case 2:
+			return cli.ErrorCat("scp: ", line[1:])
+		case 'T':
+			fields := strings.Fields(line[1:])
+			if len(fields) < 1 {
+				return errors.New("scp: protocol error: bad time record")
+			}
+			sec, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			mtime = time.Unix(sec, 0)
+			hasTime = true
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("scp: protocol error: unexpected E record")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 {
+				return cli.ErrorCat("scp: protocol error: bad record: ", line)
+			}
+			mode, err := strconv.ParseUint(fields[0], 8, 32)
+			if err != nil {
+				return err
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			p := next(fields[2])
+			if line[0] == 'D' {
+				if err := dst.Mkdir(p, os.FileMode(mode)|0700); err != nil {
+					if fi, serr := dst.Stat(p); serr != nil || !fi.IsDir() {
+						return err
+					}
+				}
+				if hasTime {
+					_ = dst.Chtimes(p, mtime)
+				}
+				dirs = append(dirs, p)
+				break
+			}
+			if !o.quiet {
+				fmt.Fprintf(os.Stderr, "%s (%d bytes)\n", p, size)
+			}
+			perm := os.FileMode(0644)
+			if o.preserve {
+				perm = os.FileMode(mode)
+			}
+			w, err := dst.Create(p, perm)
+			if err != nil {
+				return err
+			}
+			if err := sendAck(); err != nil {
+				w.Close()
+				return err
+			}
+			if _, err := io.CopyN(w, l.r, size); err != nil {
+				w.Close()
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			if err := l.ack(); err != nil {
+				return err
+			}
+			if hasTime {
+				_ = dst.Chtimes(p, mtime)
+			}
+			hasTime = false
+		default:
+			return cli.ErrorCat("scp: protocol error: ", line)
+		}
+		if err := sendAck(); err != nil {
+			return err
+		}
+	}
+}
+
+// upload local or sftp tree to remote
+func (o *scpOption) upload(src scpFS, srcs []string, dst *scpRemote, target string) error {
+	target = remoteDir(target)
+	multiple := len(srcs) > 1
+	if dst.fs != nil {
+		for _, s := range srcs {
+			p, err := resolveTarget(dst.fs, target, src.Base(s), multiple)
+			if err != nil {
+				return err
+			}
+			if err := o.copyTree(src, s, dst.fs, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	l, err := o.startLegacy(dst.sc.ssh, "-t", target, multiple)
+	if err != nil {
+		return err
+	}
+	if err := l.ack(); err != nil {
+		l.Close()
+		return err
+	}
+	for _, s := range srcs {
+		if err := o.legacySend(l, src, s); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	return l.Close()
+}
+
+// download remote paths to local or sftp tree
+func (o *scpOption) download(src *scpRemote, srcs []string, dst scpFS, target string) error {
+	multiple := len(srcs) > 1
+	if src.fs != nil {
+		for _, s := range srcs {
+			s = remoteDir(s)
+			p, err := resolveTarget(dst, target, src.fs.Base(s), multiple)
+			if err != nil {
+				return err
+			}
+			if err := o.copyTree(src.fs, s, dst, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range srcs {
+		l, err := o.startLegacy(src.sc.ssh, "-f", s, false)
+		if err != nil {
+			return err
+		}
+		if err := o.legacyReceive(l, dst, target); err != nil {
+			l.Close()
+			return err
+		}
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRemote remote to remote through local host
+func (o *scpOption) copyRemote(src *scpRemote, srcs []string, dst *scpRemote, target string) error {
+	if dst.fs != nil {
+		return o.download(src, srcs, dst.fs, remoteDir(target))
+	}
+	if src.fs != nil {
+		return o.upload(src.fs, srcs, dst, target)
+	}
+	// both sides only speak legacy scp, stage in a temporary directory
+	tmp, err := os.MkdirTemp("", "tunnelscp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := o.download(src, srcs, localFS{}, tmp); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	staged := make([]string, 0, len(entries))
+	for _, e := range entries {
+		staged = append(staged, filepath.Join(tmp, e.Name()))
+	}
+	return o.upload(localFS{}, staged, dst, target)
+}
+
+func (o *scpOption) run(operands []string) error {
+	target := parseOperand(operands[len(operands)-1])
+	sources := make([]scpOperand, 0, len(operands)-1)
+	for _, s := range operands[:len(operands)-1] {
+		sources = append(sources, parseOperand(s))
+	}
+	remotes := make(map[string]*scpRemote)
+	defer func() {
+		for _, r := range remotes {
+			r.Close()
+		}
+	}()
+	remote := func(host string) (*scpRemote, error) {
+		if r, ok := remotes[host]; ok {
+			return r, nil
+		}
+		r, err := o.connect(host)
+		if err != nil {
+			return nil, err
+		}
+		remotes[host] = r
+		return r, nil
+	}
+	var local []string
+	for i, s := range sources {
+		if len(s.host) == 0 {
+			local = append(local, s.path)
+			if i != len(sources)-1 {
+				continue
+			}
+		}
+		if len(local) != 0 {
+			if len(target.host) == 0 {
+				return cli.ErrorCat("local to local copy is not supported, use cp")
+			}
+			dst, err := remote(target.host)
+			if err != nil {
+				return err
+			}
+			if err := o.upload(localFS{}, local, dst, target.path); err != nil {
+				return err
+			}
+			local = nil
+		}
+		if len(s.host) == 0 {
+			continue
+		}
+		src, err := remote(s.host)
+		if err != nil {
+			return err
+		}
+		srcs := []string{s.path}
+		if len(target.host) == 0 {
+			if err := o.download(src, srcs, localFS{}, target.path); err != nil {
+				return err
+			}
+			continue
+		}
+		dst, err := remote(target.host)
+		if err != nil {
+			return err
+		}
+		if err := o.copyRemote(src, srcs, dst, target.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scpMain(args []string) int {
+	o := &scpOption{}
+	var ae cli.ParseArgs
+	ae.Add("help", cli.NOARG, 'h')
+	ae.Add("verbose", cli.NOARG, 'V')
+	ae.Add("recursive", cli.NOARG, 'r')
+	ae.Add("preserve", cli.NOARG, 'p')
+	ae.Add("port", cli.REQUIRED, 'P')
+	ae.Add("identity", cli.REQUIRED, 'i')
+	ae.Add("option", cli.REQUIRED, 'o')
+	ae.Add("through-local", cli.NOARG, '3')
+	ae.Add("legacy", cli.NOARG, 'O')
+	ae.Add("quiet", cli.NOARG, 'q')
+	ae.Add("insecure", cli.NOARG, 'k')
+	ae.Add("pkcs11", cli.REQUIRED, 'I')
+	ae.Add("ipv4", cli.NOARG, '4')
+	ae.Add("ipv6", cli.NOARG, '6')
+	if cli.IsTrue(os.Getenv("TUNNEL_DEBUG")) {
+		IsDebugMode = true
+	}
+	if err := ae.Execute(args, o); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		return 1
+	}
+	applyDebugMode()
+	if len(ae.Unresolved()) < 2 {
+		scpUsage()
+		return 1
+	}
+	if err := o.run(ae.Unresolved()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
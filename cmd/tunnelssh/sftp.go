@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/pty"
+	"github.com/balibuild/tunnelssh/sftp"
+)
+
+// tunnelssh sftp mode
+
+func sftpUsage() {
+	fmt.Fprintf(os.Stdout, `tunnelssh sftp - SFTP client over tunnelssh connection
+usage: %s sftp <option> [user@]host[:path]
+  -h|--help        Show usage text and quit
+  -V|--verbose     Make the operation more talkative
+  -P|--port        Port to connect to on the remote host.
+  -o|--option      Partially compatible with SSH: SetEnv, ServerAliveInterval, ServerAliveCountMax, ConnectTimeout
+  -i|--identity    Selects a file from which the identity (private key) is read
+  -b|--batch       Batch mode reads a series of commands from an input batchfile instead of stdin
+  -a               Attempt to continue interrupted transfers
+  -B|--buffer      Specify the size of the buffer (chunk) used by each read/write request
+  -R|--requests    Specify how many requests may be outstanding per channel
+  -n|--channels    Number of SFTP channels used by one transfer, default 4
+  --verify         Verify sha256 checksum after transfer, runs sha256sum on the remote
+  -q               Quiet mode, disable progress meter
+  -k|--insecure    Ignore the check of the server public key. Only for testing
+  -4               Forces ssh to use IPv4 addresses only.
+  -6               Forces ssh to use IPv6 addresses only.
+
+`, os.Args[0])
+}
+
+const sftpHelp = `Available commands:
+bye                                Quit sftp
+cd path                            Change remote directory to 'path'
+chmod mode path                    Change permissions of file 'path' to 'mode'
+exit                               Quit sftp
+get [-a] [-r] [-p] remote [local]  Download file
+help                               Display this help text
+lcd path                           Change local directory to 'path'
+lls [path]                         Display local directory listing
+lmkdir path                        Create local directory
+ln -s oldpath newpath              Link remote file
+lpwd                               Print local working directory
+ls [-l] [path]                     Display remote directory listing
+mkdir path                         Create remote directory
+put [-a] [-r] [-p] local [remote]  Upload file
+pwd                                Display remote working directory
+quit                               Quit sftp
+reget remote [local]               Resume download file
+reput local [remote]               Resume upload file
+rename oldpath newpath             Rename remote file
+rm path                            Delete remote file
+rmdir path                         Remove remote directory
+?                                  Synonym for help
+`
+
+// optVerify long only flag
+const optVerify = 1000
+
+type sftpOption struct {
+	sc       *SSHClient
+	batch    string
+	t        *sftpTransfer
+	channels int
+}
+
+// Invoke sftp flags, shared flags are handled by SSHClient
+func (so *sftpOption) Invoke(val int, oa, raw string) error {
+	switch val {
+	case 'h':
+		sftpUsage()
+		os.Exit(0)
+	case 'b':
+		so.batch = oa
+	case 'a':
+		so.t.resume = true
+	case 'q':
+		so.t.quiet = true
+	case optVerify:
+		so.t.verify = true
+	case 'B', 'R', 'n':
+		n, err := strconv.Atoi(oa)
+		if err != nil || n <= 0 {
+			return cli.ErrorCat("invalid value '", oa, "' of -", string(rune(val)))
+		}
+		switch val {
+		case 'B':
+			if n > sftp.MaxDataLength {
+				n = sftp.MaxDataLength
+			}
+			so.t.chunk = n
+		case 'R':
+			so.t.requests = n
+		default:
+			so.channels = n
+		}
+	case 'P':
+		return so.sc.Invoke('p', oa, raw)
+	default:
+		return so.sc.Invoke(val, oa, raw)
+	}
+	return nil
+}
+
+// splitRemote [user@]host[:path]
+func splitRemote(s string) (host, p string) {
+	start := strings.IndexByte(s, '@') + 1
+	if start < len(s) && s[start] == '[' {
+		if end := strings.IndexByte(s[start:], ']'); end != -1 {
+			hostEnd := start + end + 1
+			host = s[:start] + s[start+1:hostEnd-1]
+			if hostEnd < len(s) && s[hostEnd] == ':' {
+				return host, s[hostEnd+1:]
+			}
+			return host, ""
+		}
+	}
+	if pos := strings.IndexByte(s[start:], ':'); pos != -1 {
+		return s[:start+pos], s[start+pos+1:]
+	}
+	return s, ""
+}
+
+// splitCommandLine split line, support quotes and backslash escape
+func splitCommandLine(line string) []string {
+	var args []string
+	var cur strings.Builder
+	var quote byte
+	inArg := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				continue
+			}
+			if c == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				c = line[i]
+			}
+			cur.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+type sftpShell struct {
+	c    *sftp.Client
+	t    *sftpTransfer
+	cwd  string
+	out  io.Writer
+	lost func() error // connection torn down by keepalive
+}
+
+func (sh *sftpShell) remotePath(p string) string {
+	if len(p) == 0 {
+		return sh.cwd
+	}
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(sh.cwd, p)
+}
+
+// transferFlags flags of get/put
+type transferFlags struct {
+	recursive bool
+	preserve  bool
+	resume    bool
+}
+
+// sftpGet download remote file or directory
+func sftpGet(t *sftpTransfer, remote, local string, tf transferFlags) error {
+	c := t.clients[0]
+	fi, err := c.Stat(remote)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !tf.recursive {
+			return cli.ErrorCat("cannot download directory '", remote, "' without -r")
+		}
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return err
+		}
+		entries, err := c.ReadDir(remote)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			if err := sftpGet(t, path.Join(remote, e.Name()), filepath.Join(local, e.Name()), tf); err != nil {
+				return err
+			}
+		}
+		if tf.preserve {
+			_ = os.Chtimes(local, fi.ModTime(), fi.ModTime())
+		}
+		return nil
+	}
+	DebugPrint("Fetching %s to %s", remote, local)
+	if err := t.Download(remote, local, tf.resume); err != nil {
+		return err
+	}
+	if tf.preserve {
+		_ = os.Chmod(local, fi.Mode().Perm())
+		_ = os.Chtimes(local, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+// sftpPut upload local file or directory
+func sftpPut(t *sftpTransfer, local, remote string, tf transferFlags) error {
+	c := t.clients[0]
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !tf.recursive {
+			return cli.ErrorCat("cannot upload directory '", local, "' without -r")
+		}
+		if err := c.MkdirAll(remote); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Type()&os.ModeSymlink != 0 {
+				continue
+			}
+			if err := sftpPut(t, filepath.Join(local, e.Name()), path.Join(remote, e.Name()), tf); err != nil {
+				return err
+			}
+		}
+		if tf.preserve {
+			a := &sftp.Attributes{}
+			a.SetTimes(fi.ModTime(), fi.ModTime())
+			_ = c.Setstat(remote, a)
+		}
+		return nil
+	}
+	DebugPrint("Uploading %s to %s", local, remote)
+	if err := t.Upload(local, remote, tf.resume); err != nil {
+		return err
+	}
+	if tf.preserve {
+		a := &sftp.Attributes{}
+		a.SetPermissions(fi.Mode())
+		a.SetTimes(fi.ModTime(), fi.ModTime())
+		_ = c.Setstat(remote, a)
+	}
+	return nil
+}
+
+// parseTransferFlags -a -r -p flags of get/put
+func parseTransferFlags(args []string) (tf transferFlags, rest []string) {
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") || len(a) == 1 {
+			return tf, args[i:]
+		}
+		for _, c := range a[1:] {
+			switch c {
+			case 'a':
+				tf.resume = true
+			case 'r', 'R':
+				tf.recursive = true
+			case 'p', 'P':
+				tf.preserve = true
+			}
+		}
+	}
+	return tf, nil
+}
+
+func (sh *sftpShell) ls(args []string) error {
+	long := false
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		long = strings.ContainsAny(args[0], "l")
+		args = args[1:]
+	}
+	p := sh.cwd
+	if len(args) > 0 {
+		p = sh.remotePath(args[0])
+	}
+	fi, err := sh.c.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		fmt.Fprintln(sh.out, p)
+		return nil
+	}
+	entries, err := sh.c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if long {
+			if ln := e.(*sftp.FileInfo).LongName(); len(ln) != 0 {
+				fmt.Fprintln(sh.out, ln)
+				continue
+			}
+			fmt.Fprintf(sh.out, "%s %10d %s %s\n", e.Mode(), e.Size(), e.ModTime().Format("Jan _2 15:04"), e.Name())
+			continue
+		}
+		fmt.Fprintln(sh.out, e.Name())
+	}
+	return nil
+}
+
+// Execute run one command, return io.EOF when quit
+func (sh *sftpShell) Execute(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	need := func(n int) error {
+		if len(args)-1 < n {
+			return cli.ErrorCat(args[0], ": missing argument")
+		}
+		return nil
+	}
+	switch args[0] {
+	case "bye", "exit", "quit":
+		return io.EOF
+	case "help", "?":
+		_, _ = io.WriteString(sh.out, sftpHelp)
+	case "pwd":
+		fmt.Fprintf(sh.out, "Remote working directory: %s\n", sh.cwd)
+	case "lpwd":
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "Local working directory: %s\n", wd)
+	case "cd":
+		p := sh.cwd
+		if len(args) > 1 {
+			p = sh.remotePath(args[1])
+		}
+		fi, err := sh.c.Stat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return cli.ErrorCat("Can't change directory: \"", p, "\" is not a directory")
+		}
+		if sh.cwd, err = sh.c.RealPath(p); err != nil {
+			return err
+		}
+	case "lcd":
+		if err := need(1); err != nil {
+			return err
+		}
+		return os.Chdir(args[1])
+	case "ls", "dir":
+		return sh.ls(args[1:])
+	case "lls":
+		p := "."
+		if len(args) > 1 {
+			p = args[1]
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Fprintln(sh.out, e.Name())
+		}
+	case "lmkdir":
+		if err := need(1); err != nil {
+			return err
+		}
+		return os.Mkdir(args[1], 0755)
+	case "mkdir":
+		if err := need(1); err != nil {
+			return err
+		}
+		return sh.c.Mkdir(sh.remotePath(args[1]))
+	case "rmdir":
+		if err := need(1); err != nil {
+			return err
+		}
+		return sh.c.RemoveDirectory(sh.remotePath(args[1]))
+	case "rm":
+		if err := need(1); err != nil {
+			return err
+		}
+		return sh.c.Remove(sh.remotePath(args[1]))
+	case "rename":
+		if err := need(2); err != nil {
+			return err
+		}
+		return sh.c.Rename(sh.remotePath(args[1]), sh.remotePath(args[2]))
+	case "ln", "symlink":
+		a := args[1:]
+		if len(a) > 0 && a[0] == "-s" {
+			a = a[1:]
+		}
+		if len(a) < 2 {
+			return cli.ErrorCat(args[0], ": missing argument")
+		}
+		return sh.c.Symlink(a[0], sh.remotePath(a[1]))
+	case "chmod":
+		if err := need(2); err != nil {
+			return err
+		}
+		mode, err := strconv.ParseUint(args[1], 8, 32)
+		if err != nil {
+			return cli.ErrorCat("chmod: invalid mode '", args[1], "'")
+		}
+		return sh.c.Chmod(sh.remotePath(args[2]), os.FileMode(mode))
+	case "get", "reget":
+		tf, rest := parseTransferFlags(args[1:])
+		tf.resume = tf.resume || args[0] == "reget"
+		if len(rest) == 0 {
+			return cli.ErrorCat("get: missing argument")
+		}
+		remote := sh.remotePath(rest[0])
+		local := path.Base(remote)
+		if len(rest) > 1 {
+			local = rest[1]
+			if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+				local = filepath.Join(local, path.Base(remote))
+			}
+		}
+		fmt.Fprintf(sh.out, "Fetching %s to %s\n", remote, local)
+		return sftpGet(sh.t, remote, local, tf)
+	case "put", "reput":
+		tf, rest := parseTransferFlags(args[1:])
+		tf.resume = tf.resume || args[0] == "reput"
+		if len(rest) == 0 {
+			return cli.ErrorCat("put: missing argument")
+		}
+		local := rest[0]
+		remote := sh.remotePath(filepath.Base(local))
+		if len(rest) > 1 {
+			remote = sh.remotePath(rest[1])
+			if fi, err := sh.c.Stat(remote); err == nil && fi.IsDir() {
+				remote = path.Join(remote, filepath.Base(local))
+			}
+		}
+		fmt.Fprintf(sh.out, "Uploading %s to %s\n", local, remote)
+		return sftpPut(sh.t, local, remote, tf)
+	default:
+		return cli.ErrorCat("Invalid command: ", args[0])
+	}
+	return nil
+}
+
+// Run read commands from reader. In batch mode any failed command aborts unless prefixed with '-'
+func (sh *sftpShell) Run(r io.Reader, batch, interactive bool) error {
+	br := bufio.NewReader(r)
+	for {
+		if interactive {
+			_, _ = io.WriteString(sh.out, "sftp> ")
+		}
+		line, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignoreErr := false
+		if strings.HasPrefix(line, "-") {
+			ignoreErr = true
+			line = line[1:]
+		}
+		if batch {
+			fmt.Fprintf(sh.out, "sftp> %s\n", line)
+		}
+		if err := sh.Execute(splitCommandLine(line)); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			if sh.lost != nil {
+				if kerr := sh.lost(); kerr != nil {
+					return kerr
+				}
+			}
+			if batch && !ignoreErr {
+				return err
+			}
+		}
+	}
+}
+
+func sftpMain(args []string) int {
+	sc := NewSSHClient()
+	so := &sftpOption{sc: sc, t: &sftpTransfer{}, channels: defaultChannels}
+	var ae cli.ParseArgs
+	ae.Add("help", cli.NOARG, 'h')
+	ae.Add("verbose", cli.NOARG, 'V')
+	ae.Add("port", cli.REQUIRED, 'P')
+	ae.Add("option", cli.REQUIRED, 'o')
+	ae.Add("identity", cli.REQUIRED, 'i')
+	ae.Add("batch", cli.REQUIRED, 'b')
+	ae.Add("resume", cli.NOARG, 'a')
+	ae.Add("buffer", cli.REQUIRED, 'B')
+	ae.Add("requests", cli.REQUIRED, 'R')
+	ae.Add("channels", cli.REQUIRED, 'n')
+	ae.Add("verify", cli.NOARG, optVerify)
+	ae.Add("quiet", cli.NOARG, 'q')
+	ae.Add("insecure", cli.NOARG, 'k')
+	ae.Add("pkcs11", cli.REQUIRED, 'I')
+	ae.Add("ipv4", cli.NOARG, '4')
+	ae.Add("ipv6", cli.NOARG, '6')
+	if cli.IsTrue(os.Getenv("TUNNEL_DEBUG")) {
+		IsDebugMode = true
+	}
+	if err := ae.Execute(args, so); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		return 1
+	}
+	applyDebugMode()
+	if len(ae.Unresolved()) == 0 {
+		sftpUsage()
+		return 1
+	}
+	host, remoteDir := splitRemote(ae.Unresolved()[0])
+	if err := sc.Prepare(host); err != nil {
+		fmt.Fprintf(os.Stderr, "ParseArgv: %s\n", err)
+		return 1
+	}
+	if err := sc.Connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "Dial %s: %s\n", sc.host, err)
+		return 1
+	}
+	defer sc.Close()
+	c, err := sftp.NewClient(sc.ssh)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sftp subsystem: %s\n", err)
+		return 1
+	}
+	defer c.Close()
+	so.t.conn = sc.ssh
+	so.t.clients = []*sftp.Client{c}
+	so.t.openChannels(so.channels)
+	defer so.t.Close()
+	sh := &sftpShell{c: c, t: so.t, out: os.Stdout, lost: sc.keepAliveErr}
+	if sh.cwd, err = c.Getwd(); err != nil {
+		fmt.Fprintf(os.Stderr, "sftp: %s\n", err)
+		return 1
+	}
+	if len(remoteDir) != 0 {
+		p := sh.remotePath(remoteDir)
+		if fi, err := c.Stat(p); err == nil && !fi.IsDir() {
+			fmt.Fprintf(os.Stdout, "Fetching %s to %s\n", p, path.Base(p))
+			if err := sftpGet(so.t, p, path.Base(p), transferFlags{}); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return 1
+			}
+			return 0
+		}
+		if err := sh.Execute([]string{"cd", remoteDir}); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+	}
+	if len(so.batch) != 0 {
+		r := os.Stdin
+		if so.batch != "-" {
+			if r, err = os.Open(so.batch); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return 1
+			}
+			defer r.Close()
+		}
+		if err := sh.Run(r, true, false); err != nil {
+			if kerr := sc.keepAliveErr(); kerr != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", kerr)
+			}
+			return 1
+		}
+		return 0
+	}
+	if err := sh.Run(os.Stdin, false, pty.IsTerminal(os.Stdin)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
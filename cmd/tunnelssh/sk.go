@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// FIDO/U2F security key support
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.u2f
+
+// security key flags
+const (
+	SecurityKeyUserPresenceRequired     byte = 0x01
+	SecurityKeyUserVerificationRequired byte = 0x04
+	SecurityKeyResidentKey              byte = 0x20
+)
+
+// error
+var (
+	ErrNotSecurityKey = errors.New("not a security key")
+)
+
+// SecurityKey the private half of a sk-* key: the authenticator keeps the secret, we keep the handle
+type SecurityKey struct {
+	Key         ssh.PublicKey
+	Application string
+	Flags       byte
+	KeyHandle   []byte
+	Comment     string
+}
+
+// SecurityKeyBackend signs data with a security key
+type SecurityKeyBackend interface {
+	Name() string
+	Sign(key *SecurityKey, data []byte) (*ssh.Signature, error)
+}
+
+// SecurityKeyProvider select backend for security key signing
+type SecurityKeyProvider struct {
+	backends map[string]SecurityKeyBackend
+	name     string
+}
+
+// NewSecurityKeyProvider create provider, name is the default backend.
+// OpenSSH 'internal' middleware talks to the authenticator in ssh-agent for us
+func NewSecurityKeyProvider(name string) *SecurityKeyProvider {
+	if len(name) == 0 || name == "internal" {
+		name = "agent"
+	}
+	return &SecurityKeyProvider{backends: make(map[string]SecurityKeyBackend), name: name}
+}
+
+// CheckSecurityKeyProvider SecurityKeyProvider from -o or ssh_config, middleware libraries
+// cannot be loaded without cgo, only the authenticator in ssh-agent is usable
+func CheckSecurityKeyProvider(name string) error {
+	switch name {
+	case "", "internal", "agent":
+		return nil
+	}
+	return cli.ErrorCat("SecurityKeyProvider '", name, "' not supported, use 'internal' (signs via ssh-agent)")
+}
+
+// Register backend
+func (sp *SecurityKeyProvider) Register(b SecurityKeyBackend) {
+	sp.backends[b.Name()] = b
+}
+
+// Backend return current backend
+func (sp *SecurityKeyProvider) Backend() (SecurityKeyBackend, error) {
+	if b, ok := sp.backends[sp.name]; ok {
+		return b, nil
+	}
+	return nil, cli.ErrorCat("security key provider '", sp.name, "' not available")
+}
+
+// Signer make ssh.Signer from security key
+func (sp *SecurityKeyProvider) Signer(key *SecurityKey) ssh.Signer {
+	return &securityKeySigner{key: key, sp: sp}
+}
+
+type securityKeySigner struct {
+	key *SecurityKey
+	sp  *SecurityKeyProvider
+}
+
+func (s *securityKeySigner) PublicKey() ssh.PublicKey {
+	return s.key.Key
+}
+
+func (s *securityKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	b, err := s.sp.Backend()
+	if err != nil {
+		return nil, err
+	}
+	if s.key.Flags&SecurityKeyUserPresenceRequired != 0 {
+		_, _ = os.Stderr.WriteString(cli.StrCat("Confirm user presence for key ", keyTypeName(s.key.Key), " ", ssh.FingerprintSHA256(s.key.Key), "\n"))
+	}
+	DebugPrint("sign with security key %s via %s", ssh.FingerprintSHA256(s.key.Key), b.Name())
+	return b.Sign(s.key, data)
+}
+
+const skPrivateKeyMagic = "openssh-key-v1\x00"
+
+// ParseSecurityKey parse OpenSSH sk-* private key (key handle file)
+func ParseSecurityKey(buf []byte) (*SecurityKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, ErrNotSecurityKey
+	}
+	if !strings.HasPrefix(string(block.Bytes), skPrivateKeyMagic) {
+		return nil, ErrNotSecurityKey
+	}
+	var w struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(skPrivateKeyMagic):], &w); err != nil {
+		return nil, err
+	}
+	pub, err := ssh.ParsePublicKey(w.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Type() != ssh.KeyAlgoSKED25519 && pub.Type() != ssh.KeyAlgoSKECDSA256 {
+		return nil, ErrNotSecurityKey
+	}
+	if w.CipherName != "none" || w.KdfName != "none" {
+		return nil, cli.ErrorCat("encrypted security key handle is not supported: ", w.CipherName)
+	}
+	var pk struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(w.PrivKeyBlock, &pk); err != nil || pk.Check1 != pk.Check2 {
+		return nil, errors.New("malformed OpenSSH security key")
+	}
+	var fields struct {
+		Application string
+		Flags       byte
+		KeyHandle   []byte
+		Reserved    []byte
+		Comment     string
+		Pad         []byte `ssh:"rest"`
+	}
+	rest := pk.Rest
+	switch pk.Keytype {
+	case ssh.KeyAlgoSKED25519:
+		var k struct {
+			Pub  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &k); err != nil {
+			return nil, err
+		}
+		rest = k.Rest
+	case ssh.KeyAlgoSKECDSA256:
+		var k struct {
+			Curve string
+			Pub   []byte
+			Rest  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &k); err != nil {
+			return nil, err
+		}
+		rest = k.Rest
+	default:
+		return nil, ErrNotSecurityKey
+	}
+	if err := ssh.Unmarshal(rest, &fields); err != nil {
+		return nil, err
+	}
+	return &SecurityKey{
+		Key:         pub,
+		Application: fields.Application,
+		Flags:       fields.Flags,
+		KeyHandle:   fields.KeyHandle,
+		Comment:     fields.Comment,
+	}, nil
+}
+
+// agent backend: ssh-agent owns the authenticator conversation (ssh-add -K / ssh-add key_sk)
+type agentSecurityKey struct {
+	client agent.ExtendedAgent
+}
+
+func (a *agentSecurityKey) Name() string {
+	return "agent"
+}
+
+func (a *agentSecurityKey) Sign(key *SecurityKey, data []byte) (*ssh.Signature, error) {
+	return a.client.Sign(key.Key, data)
+}
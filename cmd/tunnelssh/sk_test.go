@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// software backend: compatible with OpenSSH sk-dummy, the key handle holds the private key
+// registered by tests only
+type softSecurityKey struct {
+	mu      sync.Mutex
+	counter uint32
+}
+
+func (s *softSecurityKey) Name() string {
+	return "soft"
+}
+
+func (s *softSecurityKey) Sign(key *SecurityKey, data []byte) (*ssh.Signature, error) {
+	s.mu.Lock()
+	s.counter++
+	counter := s.counter
+	s.mu.Unlock()
+	appDigest := sha256.Sum256([]byte(key.Application))
+	dataDigest := sha256.Sum256(data)
+	msg := make([]byte, 0, 32+1+4+32)
+	msg = append(msg, appDigest[:]...)
+	msg = append(msg, key.Flags)
+	msg = binary.BigEndian.AppendUint32(msg, counter)
+	msg = append(msg, dataDigest[:]...)
+	rest := ssh.Marshal(struct {
+		Flags   byte
+		Counter uint32
+	}{key.Flags, counter})
+	switch key.Key.Type() {
+	case ssh.KeyAlgoSKED25519:
+		if len(key.KeyHandle) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ed25519 key handle")
+		}
+		sig := ed25519.Sign(ed25519.PrivateKey(key.KeyHandle), msg)
+		return &ssh.Signature{Format: ssh.KeyAlgoSKED25519, Blob: sig, Rest: rest}, nil
+	case ssh.KeyAlgoSKECDSA256:
+		priv, err := x509.ParseECPrivateKey(key.KeyHandle)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(msg)
+		r, ss, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		blob := ssh.Marshal(struct {
+			R *big.Int
+			S *big.Int
+		}{r, ss})
+		return &ssh.Signature{Format: ssh.KeyAlgoSKECDSA256, Blob: blob, Rest: rest}, nil
+	}
+	return nil, cli.ErrorCat("unsupported security key type: ", key.Key.Type())
+}
+
+const testApplication = "ssh:"
+
+// marshalSecurityKey OpenSSH sk-* private key file, keyFields is the key type specific part
+func marshalSecurityKey(t *testing.T, pub ssh.PublicKey, keyFields []byte, flags byte, handle []byte) []byte {
+	t.Helper()
+	priv := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+	}{0x12345678, 0x12345678, pub.Type()})
+	priv = append(priv, keyFields...)
+	priv = append(priv, ssh.Marshal(struct {
+		Application string
+		Flags       byte
+		KeyHandle   []byte
+		Reserved    []byte
+		Comment     string
+	}{testApplication, flags, handle, nil, "test@sk"})...)
+	for i := 1; len(priv)%8 != 0; i++ {
+		priv = append(priv, byte(i))
+	}
+	body := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pub.Marshal(), priv})
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append([]byte(skPrivateKeyMagic), body...)})
+}
+
+func newEd25519SecurityKey(t *testing.T, flags byte) ([]byte, ed25519.PrivateKey) {
+	t.Helper()
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type        string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pubKey, testApplication}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := ssh.Marshal(struct{ Pub []byte }{pubKey})
+	return marshalSecurityKey(t, pub, fields, flags, privKey), privKey
+}
+
+func newECDSASecurityKey(t *testing.T, flags byte) []byte {
+	t.Helper()
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := elliptic.Marshal(elliptic.P256(), privKey.X, privKey.Y)
+	pub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type        string
+		Curve       string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKECDSA256, "nistp256", q, testApplication}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := ssh.Marshal(struct {
+		Curve string
+		Pub   []byte
+	}{"nistp256", q})
+	return marshalSecurityKey(t, pub, fields, flags, handle)
+}
+
+func TestParseSecurityKey(t *testing.T) {
+	buf, privKey := newEd25519SecurityKey(t, SecurityKeyUserPresenceRequired|SecurityKeyResidentKey)
+	key, err := ParseSecurityKey(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Key.Type() != ssh.KeyAlgoSKED25519 {
+		t.Fatalf("key type %s", key.Key.Type())
+	}
+	if key.Application != testApplication || key.Comment != "test@sk" {
+		t.Fatalf("application %q comment %q", key.Application, key.Comment)
+	}
+	if key.Flags != SecurityKeyUserPresenceRequired|SecurityKeyResidentKey {
+		t.Fatalf("flags %#x", key.Flags)
+	}
+	if string(key.KeyHandle) != string(privKey) {
+		t.Fatal("key handle mismatch")
+	}
+	key, err = ParseSecurityKey(newECDSASecurityKey(t, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Key.Type() != ssh.KeyAlgoSKECDSA256 || key.Flags != 0 {
+		t.Fatalf("key type %s flags %#x", key.Key.Type(), key.Flags)
+	}
+}
+
+func TestParseSecurityKeyNotSK(t *testing.T) {
+	if _, err := ParseSecurityKey([]byte("not a key")); !errors.Is(err, ErrNotSecurityKey) {
+		t.Fatalf("got %v", err)
+	}
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(privKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSecurityKey(pem.EncodeToMemory(block)); !errors.Is(err, ErrNotSecurityKey) {
+		t.Fatalf("plain ed25519 key: got %v", err)
+	}
+}
+
+func TestSecurityKeySignature(t *testing.T) {
+	data := []byte("session id and userauth request")
+	for name, buf := range map[string][]byte{
+		"ed25519": func() []byte { b, _ := newEd25519SecurityKey(t, 0); return b }(),
+		"ecdsa":   newECDSASecurityKey(t, 0),
+	} {
+		key, err := ParseSecurityKey(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		sp := NewSecurityKeyProvider("soft")
+		sp.Register(&softSecurityKey{})
+		signer := sp.Signer(key)
+		for i := uint32(1); i <= 2; i++ {
+			sig, err := signer.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if sig.Format != key.Key.Type() {
+				t.Fatalf("%s: signature format %s", name, sig.Format)
+			}
+			// flags byte and big endian counter follow the signature blob
+			if len(sig.Rest) != 5 || sig.Rest[0] != key.Flags || binary.BigEndian.Uint32(sig.Rest[1:]) != i {
+				t.Fatalf("%s: signature trailer %x", name, sig.Rest)
+			}
+			if err := signer.PublicKey().Verify(data, sig); err != nil {
+				t.Fatalf("%s: verify: %v", name, err)
+			}
+		}
+		if err := signer.PublicKey().Verify([]byte("other data"), mustSign(t, signer, data)); err == nil {
+			t.Fatalf("%s: signature verified for other data", name)
+		}
+	}
+}
+
+func mustSign(t *testing.T, signer ssh.Signer, data []byte) *ssh.Signature {
+	t.Helper()
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestSecurityKeyProviderBackend(t *testing.T) {
+	sp := NewSecurityKeyProvider("internal")
+	if _, err := sp.Backend(); err == nil {
+		t.Fatal("agent backend without registration")
+	}
+	sp.Register(&softSecurityKey{})
+	if _, err := sp.Backend(); err == nil {
+		t.Fatal("internal must map to agent, not soft")
+	}
+	if _, err := NewSecurityKeyProvider("soft").Signer(&SecurityKey{}).Sign(rand.Reader, nil); err == nil {
+		t.Fatal("sign without backend")
+	}
+}
+
+func TestCheckSecurityKeyProvider(t *testing.T) {
+	for _, name := range []string{"", "internal", "agent"} {
+		if err := CheckSecurityKeyProvider(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"/usr/lib/libsk-libfido2.so", "soft"} {
+		if err := CheckSecurityKeyProvider(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
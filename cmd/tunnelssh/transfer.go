@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/balibuild/tunnelssh/pty"
+	"github.com/balibuild/tunnelssh/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// large file transfer: chunks over several SFTP channels, resume and checksum
+
+// transfer defaults
+const (
+	defaultChannels = 4
+)
+
+// error
+var (
+	ErrNoRemoteChecksum = errors.New("remote has no sha256sum/shasum")
+)
+
+// sftpTransfer file transfer settings of sftp mode
+type sftpTransfer struct {
+	conn     *ssh.Client
+	clients  []*sftp.Client // clients[0] is owned by caller
+	requests int
+	chunk    int
+	resume   bool // -a all transfers
+	verify   bool // --verify, cleared when the remote cannot run sha256sum
+	quiet    bool
+}
+
+// openChannels open extra SFTP channels, OpenSSH allows 10 sessions per connection by default
+func (t *sftpTransfer) openChannels(channels int) {
+	for len(t.clients) < channels {
+		c, err := sftp.NewClient(t.conn)
+		if err != nil {
+			DebugPrint("open sftp channel %d: %v", len(t.clients)+1, err)
+			return
+		}
+		t.clients = append(t.clients, c)
+	}
+	DebugPrint("transfer over %d sftp channels, %d requests per channel", len(t.clients), t.requests)
+}
+
+// Close close extra channels
+func (t *sftpTransfer) Close() error {
+	for _, c := range t.clients[1:] {
+		_ = c.Close()
+	}
+	t.clients = t.clients[:1]
+	return nil
+}
+
+func (t *sftpTransfer) newTransfer(name string, resume bool) (*sftp.Transfer, *progressMeter) {
+	m := newProgressMeter(name, t.quiet)
+	return &sftp.Transfer{
+		Clients:   t.clients,
+		Requests:  t.requests,
+		ChunkSize: t.chunk,
+		Resume:    resume || t.resume,
+		Progress:  m.Update,
+	}, m
+}
+
+// Download remote regular file
+func (t *sftpTransfer) Download(remote, local string, resume bool) error {
+	tr, m := t.newTransfer(remote, resume)
+	if err := tr.Download(remote, local); err != nil {
+		m.Abort()
+		return err
+	}
+	m.Finish()
+	return t.check(local, remote)
+}
+
+// Upload local regular file
+func (t *sftpTransfer) Upload(local, remote string, resume bool) error {
+	tr, m := t.newTransfer(local, resume)
+	if err := tr.Upload(local, remote); err != nil {
+		m.Abort()
+		return err
+	}
+	m.Finish()
+	return t.check(local, remote)
+}
+
+// check compare sha256 of local and remote file
+func (t *sftpTransfer) check(local, remote string) error {
+	if !t.verify {
+		return nil
+	}
+	want, err := remoteSHA256(t.conn, remote)
+	if err == ErrNoRemoteChecksum {
+		// sftp-only, chroot or ForceCommand servers: warn once, not for every file
+		fmt.Fprintf(os.Stderr, "%s: checksum not verified: %v\n", remote, err)
+		t.verify = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	got, err := localSHA256(local)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return cli.ErrorCat("checksum mismatch: ", local, " sha256:", got, " ", remote, " sha256:", want)
+	}
+	DebugPrint("%s sha256:%s verified", remote, got)
+	return nil
+}
+
+func localSHA256(p string) (string, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteSHA256 run sha256sum on remote, SFTP v3 has no checksum request
+func remoteSHA256(conn *ssh.Client, p string) (string, error) {
+	for _, cmd := range []string{"sha256sum", "shasum -a 256"} {
+		sess, err := conn.NewSession()
+		if err != nil {
+			DebugPrint("%s: %v", cmd, err)
+			break // session refused, the other command won't do better
+		}
+		out, err := sess.Output(cli.StrCat(cmd, " -- ", shellQuote(p)))
+		sess.Close()
+		if err != nil {
+			DebugPrint("%s: %v", cmd, err)
+			continue
+		}
+		if fields := strings.Fields(string(out)); len(fields) != 0 && len(fields[0]) == sha256.Size*2 {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", ErrNoRemoteChecksum
+}
+
+// progressMeter transfer progress and throughput on stderr
+type progressMeter struct {
+	name  string
+	quiet bool
+	tty   bool
+	begin time.Time
+	last  time.Time
+	base  int64 // resumed bytes, not counted in throughput
+	done  int64
+	total int64
+	first bool
+}
+
+func newProgressMeter(name string, quiet bool) *progressMeter {
+	return &progressMeter{name: name, quiet: quiet, tty: pty.IsTerminal(os.Stderr), begin: time.Now(), first: true}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+func (m *progressMeter) rate() float64 {
+	elapsed := time.Since(m.begin).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(m.done-m.base) / elapsed
+}
+
+func (m *progressMeter) line() string {
+	percent := 100
+	if m.total > 0 {
+		percent = int(m.done * 100 / m.total)
+	}
+	return fmt.Sprintf("%s %3d%% %s %s/s", m.name, percent, formatBytes(float64(m.done)), formatBytes(m.rate()))
+}
+
+// Update sftp.Transfer progress callback
+func (m *progressMeter) Update(done, total int64) {
+	if m.first {
+		m.base = done
+		m.first = false
+		if done != 0 {
+			DebugPrint("%s: resume at %d", m.name, done)
+		}
+	}
+	m.done, m.total = done, total
+	if m.quiet || !m.tty || time.Since(m.last) < 200*time.Millisecond {
+		return
+	}
+	m.last = time.Now()
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s", m.line())
+}
+
+// Finish print summary
+func (m *progressMeter) Finish() {
+	if m.quiet {
+		return
+	}
+	if m.tty {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s %s\n", m.line(), time.Since(m.begin).Round(time.Millisecond))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s %s\n", m.line(), time.Since(m.begin).Round(time.Millisecond))
+}
+
+// Abort keep the partial line visible
+func (m *progressMeter) Abort() {
+	if !m.quiet && m.tty && !m.last.IsZero() {
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -73,3 +73,8 @@ func (sc *SSHClient) watchTerminalResize(ctx context.Context) <-chan struct{} {
 
 	return ch
 }
+
+// suspendProcess ~^Z, stop like a shell job until SIGCONT
+func suspendProcess() error {
+	return syscall.Kill(os.Getpid(), syscall.SIGTSTP)
+}
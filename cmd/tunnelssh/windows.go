@@ -208,3 +208,8 @@ func (sc *SSHClient) watchTerminalResize(ctx context.Context) <-chan struct{} {
 
 	return ch
 }
+
+// suspendProcess ~^Z, no job control on Windows
+func suspendProcess() error {
+	return cli.ErrorCat("suspend is not supported on Windows")
+}
@@ -0,0 +1,116 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package pty
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// termios to RFC 4254 8. Encoding of Terminal Modes, like OpenSSH ttymodes.c
+
+type termChar struct {
+	opcode uint8
+	index  int
+}
+
+type termFlag struct {
+	opcode uint8
+	flag   uint64
+}
+
+var termChars = []termChar{
+	{ssh.VINTR, unix.VINTR},
+	{ssh.VQUIT, unix.VQUIT},
+	{ssh.VERASE, unix.VERASE},
+	{ssh.VKILL, unix.VKILL},
+	{ssh.VEOF, unix.VEOF},
+	{ssh.VEOL, unix.VEOL},
+	{ssh.VEOL2, unix.VEOL2},
+	{ssh.VSTART, unix.VSTART},
+	{ssh.VSTOP, unix.VSTOP},
+	{ssh.VSUSP, unix.VSUSP},
+	{ssh.VREPRINT, unix.VREPRINT},
+	{ssh.VWERASE, unix.VWERASE},
+	{ssh.VLNEXT, unix.VLNEXT},
+	{ssh.VDISCARD, unix.VDISCARD},
+}
+
+var termIflags = []termFlag{
+	{ssh.IGNPAR, unix.IGNPAR},
+	{ssh.PARMRK, unix.PARMRK},
+	{ssh.INPCK, unix.INPCK},
+	{ssh.ISTRIP, unix.ISTRIP},
+	{ssh.INLCR, unix.INLCR},
+	{ssh.IGNCR, unix.IGNCR},
+	{ssh.ICRNL, unix.ICRNL},
+	{ssh.IXON, unix.IXON},
+	{ssh.IXANY, unix.IXANY},
+	{ssh.IXOFF, unix.IXOFF},
+	{ssh.IMAXBEL, unix.IMAXBEL},
+}
+
+var termLflags = []termFlag{
+	{ssh.ISIG, unix.ISIG},
+	{ssh.ICANON, unix.ICANON},
+	{ssh.ECHO, unix.ECHO},
+	{ssh.ECHOE, unix.ECHOE},
+	{ssh.ECHOK, unix.ECHOK},
+	{ssh.ECHONL, unix.ECHONL},
+	{ssh.NOFLSH, unix.NOFLSH},
+	{ssh.TOSTOP, unix.TOSTOP},
+	{ssh.IEXTEN, unix.IEXTEN},
+	{ssh.ECHOCTL, unix.ECHOCTL},
+	{ssh.ECHOKE, unix.ECHOKE},
+	{ssh.PENDIN, unix.PENDIN},
+}
+
+var termOflags = []termFlag{
+	{ssh.OPOST, unix.OPOST},
+	{ssh.ONLCR, unix.ONLCR},
+	{ssh.OCRNL, unix.OCRNL},
+	{ssh.ONOCR, unix.ONOCR},
+	{ssh.ONLRET, unix.ONLRET},
+}
+
+var termCflags = []termFlag{
+	{ssh.CS7, unix.CS7},
+	{ssh.CS8, unix.CS8},
+	{ssh.PARENB, unix.PARENB},
+	{ssh.PARODD, unix.PARODD},
+}
+
+func encodeFlags(modes ssh.TerminalModes, value uint64, flags []termFlag) {
+	for _, f := range flags {
+		if value&f.flag == f.flag {
+			modes[f.opcode] = 1
+			continue
+		}
+		modes[f.opcode] = 0
+	}
+}
+
+// TerminalModes pty-req modes from termios of fd
+func TerminalModes(fd *os.File) (ssh.TerminalModes, error) {
+	t, err := unix.IoctlGetTermios(int(fd.Fd()), ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+	modes := ssh.TerminalModes{}
+	for _, c := range append(termChars, extraChars...) {
+		v := uint32(t.Cc[c.index])
+		if t.Cc[c.index] == posixVDisable {
+			v = 255 // disabled, as OpenSSH encodes it
+		}
+		modes[c.opcode] = v
+	}
+	encodeFlags(modes, uint64(t.Iflag), append(termIflags, extraIflags...))
+	encodeFlags(modes, uint64(t.Lflag), append(termLflags, extraLflags...))
+	encodeFlags(modes, uint64(t.Oflag), append(termOflags, extraOflags...))
+	encodeFlags(modes, uint64(t.Cflag), termCflags)
+	modes[ssh.TTY_OP_ISPEED], modes[ssh.TTY_OP_OSPEED] = termiosSpeed(t)
+	return modes, nil
+}
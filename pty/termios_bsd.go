@@ -0,0 +1,29 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+// +build darwin freebsd netbsd openbsd dragonfly
+
+package pty
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlReadTermios = unix.TIOCGETA
+	posixVDisable    = 0xff
+)
+
+var extraChars = []termChar{
+	{ssh.VDSUSP, unix.VDSUSP},
+	{ssh.VSTATUS, unix.VSTATUS},
+}
+
+var extraIflags = []termFlag{}
+
+var extraLflags = []termFlag{}
+
+var extraOflags = []termFlag{}
+
+func termiosSpeed(t *unix.Termios) (uint32, uint32) {
+	return uint32(t.Ispeed), uint32(t.Ospeed)
+}
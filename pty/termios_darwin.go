@@ -0,0 +1,11 @@
+package pty
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// IUTF8 is macOS only among the BSDs
+	extraIflags = append(extraIflags, termFlag{ssh.IUTF8, unix.IUTF8})
+}
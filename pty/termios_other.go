@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package pty
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TerminalModes termios is not available, callers use their defaults
+func TerminalModes(fd *os.File) (ssh.TerminalModes, error) {
+	return nil, errors.New("terminal modes not supported")
+}
@@ -21,6 +21,15 @@ func GetWinSize() (w int, h int, err error) {
 	return int(wsz.Col), int(wsz.Row), nil
 }
 
+// GetWinSizeEx size with pixel dimensions, pixels are 0 when the terminal does not report them
+func GetWinSizeEx() (w, h, wpx, hpx int, err error) {
+	wsz, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return -1, -1, 0, 0, err
+	}
+	return int(wsz.Col), int(wsz.Row), int(wsz.Xpixel), int(wsz.Ypixel), nil
+}
+
 // IsTerminal todo
 func IsTerminal(fd *os.File) bool {
 	return isatty.IsTerminal(fd.Fd())
@@ -45,6 +45,12 @@ func GetWinSize() (w int, h int, err error) {
 	return int(info.Size.X), int(info.Size.Y), nil
 }
 
+// GetWinSizeEx size with pixel dimensions, console does not report pixels
+func GetWinSizeEx() (w, h, wpx, hpx int, err error) {
+	w, h, err = GetWinSize()
+	return w, h, 0, 0, err
+}
+
 // Windows Terminaol WT_SESSION todo
 // Mintty TTY
 
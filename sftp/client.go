@@ -0,0 +1,448 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// limits
+const (
+	maxPacketLength = 256 * 1024
+	// MaxDataLength read/write chunk, OpenSSH sftp-server accepts up to 256K but 32K is safe everywhere
+	MaxDataLength = 32 * 1024
+)
+
+// error
+var (
+	ErrClientClosed     = errors.New("sftp: client closed")
+	ErrUnexpectedPacket = errors.New("sftp: unexpected packet")
+)
+
+type response struct {
+	typ byte
+	d   *decoder
+}
+
+// Client SFTP v3 client. All methods are safe for concurrent use,
+// requests issued from several goroutines are in flight at the same time
+type Client struct {
+	r          io.Reader
+	w          io.WriteCloser
+	sess       *ssh.Session
+	wmu        sync.Mutex
+	mu         sync.Mutex
+	nextID     uint32
+	inflight   map[uint32]chan response
+	err        error
+	version    uint32
+	extensions map[string]string
+}
+
+// NewClient start sftp subsystem on ssh connection
+func NewClient(conn *ssh.Client) (*Client, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	c, err := NewClientPipe(r, w)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	c.sess = sess
+	return c, nil
+}
+
+// NewClientPipe create client over a pair of pipes (ssh subsystem or 'sftp-server' stdio)
+func NewClientPipe(r io.Reader, w io.WriteCloser) (*Client, error) {
+	c := &Client{r: r, w: w, inflight: make(map[uint32]chan response), extensions: make(map[string]string)}
+	init := &buffer{b: make([]byte, 4, 9)}
+	init.byte(fxpInit)
+	init.uint32(ProtocolVersion)
+	if _, err := w.Write(init.packet()); err != nil {
+		return nil, err
+	}
+	typ, body, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, ErrUnexpectedPacket
+	}
+	d := &decoder{b: body}
+	c.version = d.uint32()
+	for len(d.b) > 0 && d.err == nil {
+		name := d.string()
+		c.extensions[name] = d.string()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	go c.recvLoop()
+	return c, nil
+}
+
+func (c *Client) readPacket() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	if l == 0 || l > maxPacketLength {
+		return 0, nil, ErrShortPacket
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+func (c *Client) recvLoop() {
+	var err error
+	for {
+		var typ byte
+		var body []byte
+		if typ, body, err = c.readPacket(); err != nil {
+			break
+		}
+		d := &decoder{b: body}
+		id := d.uint32()
+		if d.err != nil {
+			err = d.err
+			break
+		}
+		c.mu.Lock()
+		ch, ok := c.inflight[id]
+		delete(c.inflight, id)
+		c.mu.Unlock()
+		if !ok {
+			err = ErrUnexpectedPacket
+			break
+		}
+		ch <- response{typ: typ, d: d}
+	}
+	if err == io.EOF {
+		err = ErrClientClosed
+	}
+	c.mu.Lock()
+	c.err = err
+	for id, ch := range c.inflight {
+		close(ch)
+		delete(c.inflight, id)
+	}
+	c.mu.Unlock()
+}
+
+// call send request and wait response
+func (c *Client) call(t byte, fill func(b *buffer)) (response, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return response{}, err
+	}
+	c.nextID++
+	id := c.nextID
+	c.inflight[id] = ch
+	c.mu.Unlock()
+	b := newRequest(t, id)
+	if fill != nil {
+		fill(b)
+	}
+	c.wmu.Lock()
+	_, err := c.w.Write(b.packet())
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.inflight, id)
+		c.mu.Unlock()
+		return response{}, err
+	}
+	resp, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		return response{}, err
+	}
+	return resp, nil
+}
+
+func statusError(resp response) error {
+	if resp.typ != fxpStatus {
+		return ErrUnexpectedPacket
+	}
+	code := resp.d.uint32()
+	msg := resp.d.string()
+	switch code {
+	case StatusOK:
+		return nil
+	case StatusEOF:
+		return io.EOF
+	}
+	return &StatusError{Code: code, Message: msg}
+}
+
+// expect status response
+func (c *Client) callStatus(t byte, fill func(b *buffer)) error {
+	resp, err := c.call(t, fill)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+func (c *Client) callHandle(t byte, fill func(b *buffer)) (string, error) {
+	resp, err := c.call(t, fill)
+	if err != nil {
+		return "", err
+	}
+	if resp.typ != fxpHandle {
+		return "", statusError(resp)
+	}
+	h := resp.d.string()
+	return h, resp.d.err
+}
+
+func (c *Client) callAttrs(t byte, fill func(b *buffer)) (*Attributes, error) {
+	resp, err := c.call(t, fill)
+	if err != nil {
+		return nil, err
+	}
+	if resp.typ != fxpAttrs {
+		return nil, statusError(resp)
+	}
+	a := resp.d.attrs()
+	return a, resp.d.err
+}
+
+func (c *Client) callNames(t byte, fill func(b *buffer)) ([]*FileInfo, error) {
+	resp, err := c.call(t, fill)
+	if err != nil {
+		return nil, err
+	}
+	if resp.typ != fxpName {
+		return nil, statusError(resp)
+	}
+	n := resp.d.uint32()
+	names := make([]*FileInfo, 0, n)
+	for i := uint32(0); i < n && resp.d.err == nil; i++ {
+		fi := &FileInfo{name: resp.d.string(), longname: resp.d.string()}
+		fi.attrs = resp.d.attrs()
+		names = append(names, fi)
+	}
+	return names, resp.d.err
+}
+
+// Version server protocol version
+func (c *Client) Version() uint32 {
+	return c.version
+}
+
+// HasExtension server announced extension
+func (c *Client) HasExtension(name string) bool {
+	_, ok := c.extensions[name]
+	return ok
+}
+
+// Close close sftp session
+func (c *Client) Close() error {
+	err := c.w.Close()
+	if c.sess != nil {
+		_ = c.sess.Close()
+	}
+	return err
+}
+
+// RealPath canonicalize path on server
+func (c *Client) RealPath(p string) (string, error) {
+	names, err := c.callNames(fxpRealpath, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", ErrUnexpectedPacket
+	}
+	return names[0].name, nil
+}
+
+// Getwd server working directory
+func (c *Client) Getwd() (string, error) {
+	return c.RealPath(".")
+}
+
+func (c *Client) stat(t byte, p string) (os.FileInfo, error) {
+	a, err := c.callAttrs(t, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return &FileInfo{name: path.Base(p), attrs: a}, nil
+}
+
+// Stat follow symlink
+func (c *Client) Stat(p string) (os.FileInfo, error) {
+	return c.stat(fxpStat, p)
+}
+
+// Lstat not follow symlink
+func (c *Client) Lstat(p string) (os.FileInfo, error) {
+	return c.stat(fxpLstat, p)
+}
+
+// Setstat change attributes
+func (c *Client) Setstat(p string, a *Attributes) error {
+	return c.callStatus(fxpSetstat, func(b *buffer) {
+		b.string(p)
+		b.attrs(a)
+	})
+}
+
+// Chmod todo
+func (c *Client) Chmod(p string, mode os.FileMode) error {
+	a := &Attributes{}
+	a.SetPermissions(mode)
+	return c.Setstat(p, a)
+}
+
+// ReadDir list directory, '.' and '..' are skipped
+func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
+	handle, err := c.callHandle(fxpOpendir, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return nil, &os.PathError{Op: "opendir", Path: p, Err: err}
+	}
+	defer c.closeHandle(handle)
+	var entries []os.FileInfo
+	for {
+		names, err := c.callNames(fxpReaddir, func(b *buffer) { b.string(handle) })
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, &os.PathError{Op: "readdir", Path: p, Err: err}
+		}
+		for _, fi := range names {
+			if fi.name == "." || fi.name == ".." {
+				continue
+			}
+			entries = append(entries, fi)
+		}
+	}
+}
+
+// Mkdir create directory
+func (c *Client) Mkdir(p string) error {
+	return c.callStatus(fxpMkdir, func(b *buffer) {
+		b.string(p)
+		b.attrs(nil)
+	})
+}
+
+// MkdirAll create directory and parents
+func (c *Client) MkdirAll(p string) error {
+	if fi, err := c.Stat(p); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+	}
+	if parent := path.Dir(p); parent != p && parent != "." && parent != "/" {
+		if err := c.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	return c.Mkdir(p)
+}
+
+// Remove remove file
+func (c *Client) Remove(p string) error {
+	return c.callStatus(fxpRemove, func(b *buffer) { b.string(p) })
+}
+
+// RemoveDirectory remove empty directory
+func (c *Client) RemoveDirectory(p string) error {
+	return c.callStatus(fxpRmdir, func(b *buffer) { b.string(p) })
+}
+
+// Rename rename file, use posix-rename@openssh.com when available (overwrite target)
+func (c *Client) Rename(oldname, newname string) error {
+	if c.HasExtension("posix-rename@openssh.com") {
+		return c.callStatus(fxpExtended, func(b *buffer) {
+			b.string("posix-rename@openssh.com")
+			b.string(oldname)
+			b.string(newname)
+		})
+	}
+	return c.callStatus(fxpRename, func(b *buffer) {
+		b.string(oldname)
+		b.string(newname)
+	})
+}
+
+// ReadLink todo
+func (c *Client) ReadLink(p string) (string, error) {
+	names, err := c.callNames(fxpReadlink, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", ErrUnexpectedPacket
+	}
+	return names[0].name, nil
+}
+
+// Symlink OpenSSH sftp-server swaps the arguments, we follow OpenSSH
+func (c *Client) Symlink(oldname, newname string) error {
+	return c.callStatus(fxpSymlink, func(b *buffer) {
+		b.string(oldname)
+		b.string(newname)
+	})
+}
+
+func (c *Client) closeHandle(handle string) error {
+	return c.callStatus(fxpClose, func(b *buffer) { b.string(handle) })
+}
+
+// OpenFile open file with SFTP flags
+func (c *Client) OpenFile(p string, flags uint32, a *Attributes) (*File, error) {
+	handle, err := c.callHandle(fxpOpen, func(b *buffer) {
+		b.string(p)
+		b.uint32(flags)
+		b.attrs(a)
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return &File{c: c, name: p, handle: handle}, nil
+}
+
+// Open open file for reading
+func (c *Client) Open(p string) (*File, error) {
+	return c.OpenFile(p, FlagRead, nil)
+}
+
+// Create create or truncate file for writing
+func (c *Client) Create(p string) (*File, error) {
+	return c.OpenFile(p, FlagWrite|FlagCreate|FlagTrunc, nil)
+}
@@ -0,0 +1,280 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+)
+
+// fakeServer server side of a client on net.Pipe
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+type fakeRequest struct {
+	typ byte
+	id  uint32
+	d   *decoder
+}
+
+// newFakeClient client after the version exchange, the server announces extensions
+func newFakeClient(t *testing.T, extensions ...string) (*Client, *fakeServer) {
+	t.Helper()
+	cc, sc := net.Pipe()
+	s := &fakeServer{t: t, conn: sc}
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+	errC := make(chan error, 1)
+	go func() {
+		req, err := s.read()
+		if err != nil {
+			errC <- err
+			return
+		}
+		if req.typ != fxpInit || req.id != ProtocolVersion {
+			errC <- errors.New("bad init")
+			return
+		}
+		b := newRequest(fxpVersion, ProtocolVersion)
+		for _, e := range extensions {
+			b.string(e)
+			b.string("1")
+		}
+		_, err = sc.Write(b.packet())
+		errC <- err
+	}()
+	c, err := NewClientPipe(cc, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// read request, id is the version of SSH_FXP_INIT
+func (s *fakeServer) read() (*fakeRequest, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(s.conn, buf); err != nil {
+		return nil, err
+	}
+	d := &decoder{b: buf}
+	return &fakeRequest{typ: d.byte(), id: d.uint32(), d: d}, d.err
+}
+
+func (s *fakeServer) reply(typ byte, id uint32, fill func(b *buffer)) {
+	b := newRequest(typ, id)
+	if fill != nil {
+		fill(b)
+	}
+	if _, err := s.conn.Write(b.packet()); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func (s *fakeServer) status(id, code uint32, msg string) {
+	s.reply(fxpStatus, id, func(b *buffer) {
+		b.uint32(code)
+		b.string(msg)
+		b.string("")
+	})
+}
+
+// serve answer requests in order until the pipe is closed
+func (s *fakeServer) serve(handle func(req *fakeRequest)) {
+	go func() {
+		for {
+			req, err := s.read()
+			if err != nil {
+				return
+			}
+			handle(req)
+		}
+	}()
+}
+
+func TestClientVersion(t *testing.T) {
+	c, _ := newFakeClient(t, "posix-rename@openssh.com")
+	if c.Version() != ProtocolVersion {
+		t.Fatalf("version %d", c.Version())
+	}
+	if !c.HasExtension("posix-rename@openssh.com") || c.HasExtension("statvfs@openssh.com") {
+		t.Fatal("extensions not parsed")
+	}
+}
+
+func TestClientOutOfOrderResponses(t *testing.T) {
+	c, s := newFakeClient(t)
+	paths := []string{"/a", "/bb", "/ccc", "/dddd"}
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, p := range paths {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			fi, err := c.Stat(p)
+			if err == nil {
+				sizes[i] = fi.Size()
+			}
+			errs[i] = err
+		}(i, p)
+	}
+	// all requests are in flight before the first response
+	reqs := make([]*fakeRequest, 0, len(paths))
+	for range paths {
+		req, err := s.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.typ != fxpStat {
+			t.Fatalf("request type %d", req.typ)
+		}
+		reqs = append(reqs, req)
+	}
+	for i := len(reqs) - 1; i >= 0; i-- {
+		size := uint64(len(reqs[i].d.string()))
+		s.reply(fxpAttrs, reqs[i].id, func(b *buffer) {
+			a := &Attributes{}
+			a.SetSize(size)
+			b.attrs(a)
+		})
+	}
+	wg.Wait()
+	for i, p := range paths {
+		if errs[i] != nil {
+			t.Fatalf("%s: %v", p, errs[i])
+		}
+		if sizes[i] != int64(len(p)) {
+			t.Fatalf("%s: got size %d of another request", p, sizes[i])
+		}
+	}
+}
+
+func TestClientStatusErrors(t *testing.T) {
+	c, s := newFakeClient(t)
+	codes := map[string]uint32{
+		"/ok":      StatusOK,
+		"/missing": StatusNoSuchFile,
+		"/denied":  StatusPermissionDenied,
+		"/full":    StatusFailure,
+		"/eof":     StatusEOF,
+	}
+	s.serve(func(req *fakeRequest) {
+		p := req.d.string()
+		msg := ""
+		if p == "/full" {
+			msg = "disk full"
+		}
+		s.status(req.id, codes[p], msg)
+	})
+	if err := c.Remove("/ok"); err != nil {
+		t.Fatalf("ok: %v", err)
+	}
+	if err := c.Remove("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing: %v", err)
+	}
+	if _, err := c.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stat missing: %v", err)
+	}
+	if err := c.Remove("/denied"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("denied: %v", err)
+	}
+	var se *StatusError
+	if err := c.Remove("/full"); !errors.As(err, &se) || se.Code != StatusFailure || se.Message != "disk full" {
+		t.Fatalf("failure: %v", err)
+	}
+	if err := c.Remove("/eof"); err != io.EOF {
+		t.Fatalf("eof: %v", err)
+	}
+}
+
+func TestClientRead(t *testing.T) {
+	c, s := newFakeClient(t)
+	content := []byte("hello sftp")
+	s.serve(func(req *fakeRequest) {
+		switch req.typ {
+		case fxpOpen:
+			s.reply(fxpHandle, req.id, func(b *buffer) { b.string("h1") })
+		case fxpRead:
+			handle, off, n := req.d.string(), req.d.uint64(), req.d.uint32()
+			if handle != "h1" {
+				s.status(req.id, StatusFailure, "bad handle")
+				return
+			}
+			if off >= uint64(len(content)) {
+				s.status(req.id, StatusEOF, "")
+				return
+			}
+			end := off + uint64(n)
+			if end > uint64(len(content)) {
+				end = uint64(len(content))
+			}
+			s.reply(fxpData, req.id, func(b *buffer) { b.bytes(content[off:end]) })
+		case fxpClose:
+			s.status(req.id, StatusOK, "")
+		}
+	})
+	f, err := c.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil || string(got) != string(content) {
+		t.Fatalf("read %q %v", got, err)
+	}
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, 6); err != nil || string(buf[:n]) != "sftp" {
+		t.Fatalf("ReadAt %q %v", buf[:n], err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	c, s := newFakeClient(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Stat("/pending")
+		done <- err
+	}()
+	if _, err := s.read(); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	if err := <-done; !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("pending request: %v", err)
+	}
+	if err := c.Remove("/after"); err != ErrClientClosed {
+		t.Fatalf("request after close: %v", err)
+	}
+}
+
+func TestClientUnexpectedResponse(t *testing.T) {
+	c, s := newFakeClient(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Remove("/x")
+	}()
+	req, err := s.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.status(req.id+100, StatusOK, "") // id never sent
+	if err := <-done; err != ErrUnexpectedPacket {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// error
+var (
+	ErrInvalidWhence = errors.New("sftp: invalid whence")
+)
+
+// File remote file
+type File struct {
+	c      *Client
+	name   string
+	handle string
+	mu     sync.Mutex
+	offset int64
+}
+
+// Name todo
+func (f *File) Name() string {
+	return f.name
+}
+
+// Close todo
+func (f *File) Close() error {
+	return f.c.closeHandle(f.handle)
+}
+
+// Stat fstat
+func (f *File) Stat() (os.FileInfo, error) {
+	a, err := f.c.callAttrs(fxpFstat, func(b *buffer) { b.string(f.handle) })
+	if err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: f.name, Err: err}
+	}
+	return &FileInfo{name: path.Base(f.name), attrs: a}, nil
+}
+
+// Setstat fsetstat
+func (f *File) Setstat(a *Attributes) error {
+	return f.c.callStatus(fxpFsetstat, func(b *buffer) {
+		b.string(f.handle)
+		b.attrs(a)
+	})
+}
+
+// Truncate todo
+func (f *File) Truncate(size int64) error {
+	a := &Attributes{}
+	a.SetSize(uint64(size))
+	return f.Setstat(a)
+}
+
+// readChunk single SSH_FXP_READ
+func (f *File) readChunk(b []byte, off int64) (int, error) {
+	resp, err := f.c.call(fxpRead, func(rb *buffer) {
+		rb.string(f.handle)
+		rb.uint64(uint64(off))
+		rb.uint32(uint32(len(b)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.typ != fxpData {
+		return 0, statusError(resp)
+	}
+	data := resp.d.bytes()
+	if resp.d.err != nil {
+		return 0, resp.d.err
+	}
+	return copy(b, data), nil
+}
+
+// ReadAt implements io.ReaderAt
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > MaxDataLength {
+			chunk = chunk[:MaxDataLength]
+		}
+		m, err := f.readChunk(chunk, off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+// Read implements io.Reader
+func (f *File) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(b) > MaxDataLength {
+		b = b[:MaxDataLength]
+	}
+	n, err := f.readChunk(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt implements io.WriterAt
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > MaxDataLength {
+			chunk = chunk[:MaxDataLength]
+		}
+		err := f.c.callStatus(fxpWrite, func(wb *buffer) {
+			wb.string(f.handle)
+			wb.uint64(uint64(off + int64(n)))
+			wb.bytes(chunk)
+		})
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Write implements io.Writer
+func (f *File) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.WriteAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += fi.Size()
+	default:
+		return f.offset, ErrInvalidWhence
+	}
+	if offset < 0 {
+		return f.offset, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
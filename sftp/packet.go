@@ -0,0 +1,403 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+)
+
+// SFTP version 3
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+
+// protocol version
+const (
+	ProtocolVersion = 3
+)
+
+// packet types
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// open flags
+const (
+	FlagRead   = 0x00000001
+	FlagWrite  = 0x00000002
+	FlagAppend = 0x00000004
+	FlagCreate = 0x00000008
+	FlagTrunc  = 0x00000010
+	FlagExcl   = 0x00000020
+)
+
+// attributes flags
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+// status code
+const (
+	StatusOK               = 0
+	StatusEOF              = 1
+	StatusNoSuchFile       = 2
+	StatusPermissionDenied = 3
+	StatusFailure          = 4
+	StatusBadMessage       = 5
+	StatusNoConnection     = 6
+	StatusConnectionLost   = 7
+	StatusOpUnsupported    = 8
+)
+
+// posix file type bits
+const (
+	modeTypeMask = 0170000
+	modeFIFO     = 0010000
+	modeChar     = 0020000
+	modeDir      = 0040000
+	modeBlock    = 0060000
+	modeRegular  = 0100000
+	modeSymlink  = 0120000
+	modeSocket   = 0140000
+	modeSetuid   = 0004000
+	modeSetgid   = 0002000
+	modeSticky   = 0001000
+)
+
+// error
+var (
+	ErrShortPacket = errors.New("sftp: short packet")
+)
+
+type buffer struct {
+	b []byte
+}
+
+func newRequest(t byte, id uint32) *buffer {
+	b := &buffer{b: make([]byte, 4, 64)}
+	b.byte(t)
+	b.uint32(id)
+	return b
+}
+
+func (b *buffer) byte(v byte) {
+	b.b = append(b.b, v)
+}
+
+func (b *buffer) uint32(v uint32) {
+	b.b = binary.BigEndian.AppendUint32(b.b, v)
+}
+
+func (b *buffer) uint64(v uint64) {
+	b.b = binary.BigEndian.AppendUint64(b.b, v)
+}
+
+func (b *buffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+
+func (b *buffer) bytes(p []byte) {
+	b.uint32(uint32(len(p)))
+	b.b = append(b.b, p...)
+}
+
+func (b *buffer) attrs(a *Attributes) {
+	if a == nil {
+		b.uint32(0)
+		return
+	}
+	b.uint32(a.Flags)
+	if a.Flags&attrSize != 0 {
+		b.uint64(a.Size)
+	}
+	if a.Flags&attrUIDGID != 0 {
+		b.uint32(a.UID)
+		b.uint32(a.GID)
+	}
+	if a.Flags&attrPermissions != 0 {
+		b.uint32(a.Permissions)
+	}
+	if a.Flags&attrACModTime != 0 {
+		b.uint32(a.Atime)
+		b.uint32(a.Mtime)
+	}
+}
+
+// packet return length prefixed packet
+func (b *buffer) packet() []byte {
+	binary.BigEndian.PutUint32(b.b, uint32(len(b.b)-4))
+	return b.b
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.err = ErrShortPacket
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.err = ErrShortPacket
+		d.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.err = ErrShortPacket
+		d.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if uint32(len(d.b)) < n {
+		d.err = ErrShortPacket
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) attrs() *Attributes {
+	a := &Attributes{Flags: d.uint32()}
+	if a.Flags&attrSize != 0 {
+		a.Size = d.uint64()
+	}
+	if a.Flags&attrUIDGID != 0 {
+		a.UID = d.uint32()
+		a.GID = d.uint32()
+	}
+	if a.Flags&attrPermissions != 0 {
+		a.Permissions = d.uint32()
+	}
+	if a.Flags&attrACModTime != 0 {
+		a.Atime = d.uint32()
+		a.Mtime = d.uint32()
+	}
+	if a.Flags&attrExtended != 0 {
+		n := d.uint32()
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			_ = d.string()
+			_ = d.string()
+		}
+	}
+	return a
+}
+
+// Attributes file attributes
+type Attributes struct {
+	Flags       uint32
+	Size        uint64
+	UID         uint32
+	GID         uint32
+	Permissions uint32
+	Atime       uint32
+	Mtime       uint32
+}
+
+// SetSize todo
+func (a *Attributes) SetSize(size uint64) {
+	a.Flags |= attrSize
+	a.Size = size
+}
+
+// SetPermissions todo
+func (a *Attributes) SetPermissions(mode os.FileMode) {
+	a.Flags |= attrPermissions
+	a.Permissions = fromFileMode(mode)
+}
+
+// SetTimes todo
+func (a *Attributes) SetTimes(atime, mtime time.Time) {
+	a.Flags |= attrACModTime
+	a.Atime = uint32(atime.Unix())
+	a.Mtime = uint32(mtime.Unix())
+}
+
+func toFileMode(perm uint32) os.FileMode {
+	m := os.FileMode(perm & 0777)
+	switch perm & modeTypeMask {
+	case modeDir:
+		m |= os.ModeDir
+	case modeSymlink:
+		m |= os.ModeSymlink
+	case modeFIFO:
+		m |= os.ModeNamedPipe
+	case modeChar:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case modeBlock:
+		m |= os.ModeDevice
+	case modeSocket:
+		m |= os.ModeSocket
+	}
+	if perm&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if perm&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if perm&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func fromFileMode(m os.FileMode) uint32 {
+	perm := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		perm |= modeDir
+	case m&os.ModeSymlink != 0:
+		perm |= modeSymlink
+	case m&os.ModeNamedPipe != 0:
+		perm |= modeFIFO
+	case m&os.ModeCharDevice != 0:
+		perm |= modeChar
+	case m&os.ModeDevice != 0:
+		perm |= modeBlock
+	case m&os.ModeSocket != 0:
+		perm |= modeSocket
+	default:
+		perm |= modeRegular
+	}
+	if m&os.ModeSetuid != 0 {
+		perm |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		perm |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		perm |= modeSticky
+	}
+	return perm
+}
+
+// FileInfo implements os.FileInfo
+type FileInfo struct {
+	name     string
+	longname string
+	attrs    *Attributes
+}
+
+// Name todo
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+// Size todo
+func (fi *FileInfo) Size() int64 {
+	return int64(fi.attrs.Size)
+}
+
+// Mode todo
+func (fi *FileInfo) Mode() os.FileMode {
+	return toFileMode(fi.attrs.Permissions)
+}
+
+// ModTime todo
+func (fi *FileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attrs.Mtime), 0)
+}
+
+// IsDir todo
+func (fi *FileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+// Sys return *Attributes
+func (fi *FileInfo) Sys() interface{} {
+	return fi.attrs
+}
+
+// LongName 'ls -l' style name sent by server
+func (fi *FileInfo) LongName() string {
+	return fi.longname
+}
+
+// StatusError SSH_FXP_STATUS
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Message) != 0 {
+		return "sftp: " + e.Message
+	}
+	switch e.Code {
+	case StatusEOF:
+		return "sftp: end of file"
+	case StatusNoSuchFile:
+		return "sftp: no such file"
+	case StatusPermissionDenied:
+		return "sftp: permission denied"
+	case StatusOpUnsupported:
+		return "sftp: operation unsupported"
+	}
+	return "sftp: failure"
+}
+
+// Is support errors.Is(err, os.ErrNotExist) and os.ErrPermission
+func (e *StatusError) Is(target error) bool {
+	switch e.Code {
+	case StatusNoSuchFile:
+		return target == os.ErrNotExist
+	case StatusPermissionDenied:
+		return target == os.ErrPermission
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package sftp
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	a := &Attributes{UID: 1000, GID: 100}
+	a.Flags |= attrUIDGID
+	a.SetSize(1 << 40)
+	a.SetPermissions(0755 | os.ModeDir)
+	a.Atime, a.Mtime, a.Flags = 1700000000, 1700000001, a.Flags|attrACModTime
+	b := newRequest(fxpOpen, 42)
+	b.string("/tmp/file")
+	b.uint64(1<<63 + 5)
+	b.bytes([]byte{0, 1, 2})
+	b.attrs(a)
+	b.attrs(nil)
+	p := b.packet()
+	if l := uint32(p[0])<<24 | uint32(p[1])<<16 | uint32(p[2])<<8 | uint32(p[3]); int(l) != len(p)-4 {
+		t.Fatalf("length prefix %d, packet %d", l, len(p)-4)
+	}
+	d := &decoder{b: p[4:]}
+	if typ, id := d.byte(), d.uint32(); typ != fxpOpen || id != 42 {
+		t.Fatalf("type %d id %d", typ, id)
+	}
+	if s := d.string(); s != "/tmp/file" {
+		t.Fatalf("string %q", s)
+	}
+	if v := d.uint64(); v != 1<<63+5 {
+		t.Fatalf("uint64 %d", v)
+	}
+	if v := d.bytes(); string(v) != "\x00\x01\x02" {
+		t.Fatalf("bytes %x", v)
+	}
+	if got := d.attrs(); *got != *a {
+		t.Fatalf("attrs %+v, want %+v", got, a)
+	}
+	if got := d.attrs(); got.Flags != 0 {
+		t.Fatalf("empty attrs %+v", got)
+	}
+	if d.err != nil || len(d.b) != 0 {
+		t.Fatalf("err %v, %d bytes left", d.err, len(d.b))
+	}
+}
+
+func TestDecoderExtendedAttrs(t *testing.T) {
+	b := &buffer{}
+	b.uint32(attrSize | attrExtended)
+	b.uint64(7)
+	b.uint32(1)
+	b.string("name@example.com")
+	b.string("value")
+	b.string("after")
+	d := &decoder{b: b.b}
+	if a := d.attrs(); a.Size != 7 {
+		t.Fatalf("size %d", a.Size)
+	}
+	if s := d.string(); s != "after" || d.err != nil {
+		t.Fatalf("extended pairs not skipped: %q %v", s, d.err)
+	}
+}
+
+func TestDecoderShortPacket(t *testing.T) {
+	for name, fn := range map[string]func(d *decoder){
+		"byte":   func(d *decoder) { d.byte() },
+		"uint32": func(d *decoder) { d.uint32() },
+		"uint64": func(d *decoder) { d.uint64() },
+		"string": func(d *decoder) { d.string() },
+		"attrs":  func(d *decoder) { d.attrs() },
+	} {
+		d := &decoder{}
+		fn(d)
+		if d.err != ErrShortPacket {
+			t.Fatalf("%s: %v", name, d.err)
+		}
+	}
+	// length beyond the packet
+	d := &decoder{b: []byte{0, 0, 0, 9, 'a'}}
+	if d.string(); d.err != ErrShortPacket {
+		t.Fatalf("string length: %v", d.err)
+	}
+}
+
+func TestFileModeRoundTrip(t *testing.T) {
+	for _, m := range []os.FileMode{
+		0644,
+		0755 | os.ModeDir,
+		0777 | os.ModeSymlink,
+		0600 | os.ModeNamedPipe,
+		0660 | os.ModeDevice | os.ModeCharDevice,
+		0660 | os.ModeDevice,
+		0755 | os.ModeSocket,
+		0755 | os.ModeSetuid | os.ModeSetgid,
+		0777 | os.ModeDir | os.ModeSticky,
+	} {
+		if got := toFileMode(fromFileMode(m)); got != m {
+			t.Errorf("%v: got %v", m, got)
+		}
+	}
+	if perm := fromFileMode(0644); perm != 0100644 {
+		t.Fatalf("regular file %o", perm)
+	}
+}
+
+func TestStatusErrorIs(t *testing.T) {
+	if !errors.Is(&StatusError{Code: StatusNoSuchFile}, os.ErrNotExist) {
+		t.Fatal("no such file is not os.ErrNotExist")
+	}
+	if !errors.Is(&StatusError{Code: StatusPermissionDenied}, os.ErrPermission) {
+		t.Fatal("permission denied is not os.ErrPermission")
+	}
+	if errors.Is(&StatusError{Code: StatusFailure}, os.ErrNotExist) {
+		t.Fatal("failure is os.ErrNotExist")
+	}
+	if msg := (&StatusError{Code: StatusFailure, Message: "disk full"}).Error(); msg != "sftp: disk full" {
+		t.Fatalf("message %q", msg)
+	}
+}
@@ -0,0 +1,262 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// transfer defaults
+const (
+	DefaultRequests = 16
+)
+
+// error
+var (
+	ErrNoClient = errors.New("sftp: transfer without client")
+)
+
+// Transfer chunked copy of a single file. Chunks are spread over all Clients (one
+// SFTP channel each) with Requests reads/writes in flight per channel.
+//
+// Chunks complete out of order. A chunk is only dispatched while it lies within one
+// window (Requests*len(Clients)*ChunkSize bytes) of the first unfinished chunk, so a
+// stalled request holds back the others and holes of a partial file are always inside
+// its last window. Resume restarts one window before the end of the partial file,
+// which is safe as long as the same window settings are used.
+type Transfer struct {
+	Clients   []*Client
+	Requests  int                     // per client, default DefaultRequests
+	ChunkSize int                     // default MaxDataLength
+	Resume    bool                    // continue from partial target
+	Progress  func(done, total int64) // called serialized
+}
+
+func (t *Transfer) requests() int {
+	if t.Requests <= 0 {
+		return DefaultRequests
+	}
+	return t.Requests
+}
+
+func (t *Transfer) chunkSize() int64 {
+	if t.ChunkSize <= 0 {
+		return MaxDataLength
+	}
+	return int64(t.ChunkSize)
+}
+
+// ResumeOffset offset to restart from when the partial target has size bytes
+func (t *Transfer) ResumeOffset(size int64) int64 {
+	chunk := t.chunkSize()
+	off := size - int64(t.requests()*len(t.Clients))*chunk
+	if off <= 0 {
+		return 0
+	}
+	return off - off%chunk
+}
+
+// run dispatch chunks [start,total) to workers, fn(i, off, buf) runs on client i
+func (t *Transfer) run(start, total int64, fn func(i int, off int64, buf []byte) error) error {
+	chunk := t.chunkSize()
+	workers := t.requests() * len(t.Clients)
+	window := int64(workers) * chunk
+	jobs := make(chan int64)
+	failed := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	var ferr error
+	done := start
+	contiguous := start // all chunks before are written
+	completed := make(map[int64]bool)
+	if t.Progress != nil {
+		t.Progress(done, total)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, chunk)
+			for off := range jobs {
+				n := chunk
+				if total-off < n {
+					n = total - off
+				}
+				err := fn(i, off, buf[:n])
+				mu.Lock()
+				if err != nil {
+					if ferr == nil {
+						ferr = err
+						close(failed)
+					}
+				} else {
+					done += n
+					completed[off] = true
+					for completed[contiguous] {
+						delete(completed, contiguous)
+						contiguous += chunk
+					}
+					if t.Progress != nil {
+						t.Progress(done, total)
+					}
+				}
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}(w % len(t.Clients))
+	}
+feed:
+	for off := start; off < total; off += chunk {
+		mu.Lock()
+		for ferr == nil && off >= contiguous+window {
+			cond.Wait()
+		}
+		stop := ferr != nil // the window does not move past a failed chunk
+		mu.Unlock()
+		if stop {
+			break
+		}
+		select {
+		case jobs <- off:
+		case <-failed:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return ferr
+}
+
+func closeFiles(files []*File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// Download copy remote file to local path
+func (t *Transfer) Download(remote, local string) (err error) {
+	if len(t.Clients) == 0 {
+		return ErrNoClient
+	}
+	fi, err := t.Clients[0].Stat(remote)
+	if err != nil {
+		return err
+	}
+	total := fi.Size()
+	flags := os.O_WRONLY | os.O_CREATE
+	if !t.Resume {
+		flags |= os.O_TRUNC
+	}
+	dst, err := os.OpenFile(local, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	var start int64
+	if t.Resume {
+		lfi, err := dst.Stat()
+		if err != nil {
+			return err
+		}
+		size := lfi.Size()
+		if size > total {
+			size = total
+		}
+		start = t.ResumeOffset(size)
+	}
+	files := make([]*File, 0, len(t.Clients))
+	defer func() { closeFiles(files) }()
+	for _, c := range t.Clients {
+		f, err := c.Open(remote)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	err = t.run(start, total, func(i int, off int64, buf []byte) error {
+		n, err := files[i].ReadAt(buf, off)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = dst.WriteAt(buf, off)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return dst.Truncate(total)
+}
+
+// Upload copy local file to remote path
+func (t *Transfer) Upload(local, remote string) error {
+	if len(t.Clients) == 0 {
+		return ErrNoClient
+	}
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	total := fi.Size()
+	flags := uint32(FlagWrite | FlagCreate)
+	if !t.Resume {
+		flags |= FlagTrunc
+	}
+	files := make([]*File, 0, len(t.Clients))
+	defer func() { closeFiles(files) }()
+	first, err := t.Clients[0].OpenFile(remote, flags, nil)
+	if err != nil {
+		return err
+	}
+	files = append(files, first)
+	var start int64
+	if t.Resume {
+		rfi, err := first.Stat()
+		if err != nil {
+			return err
+		}
+		size := rfi.Size()
+		if size > total {
+			size = total
+		}
+		start = t.ResumeOffset(size)
+	}
+	for _, c := range t.Clients[1:] {
+		f, err := c.OpenFile(remote, FlagWrite, nil)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	err = t.run(start, total, func(i int, off int64, buf []byte) error {
+		n, err := src.ReadAt(buf, off)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		_, err = files[i].WriteAt(buf, off)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return first.Truncate(total)
+}
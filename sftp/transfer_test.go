@@ -0,0 +1,64 @@
+package sftp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransferResumeAfterStalledChunk(t *testing.T) {
+	tr := &Transfer{Clients: []*Client{nil}, Requests: 4, ChunkSize: 10}
+	var mu sync.Mutex
+	var end int64 // extent of written data, the partial file size
+	errStalled := errors.New("stalled chunk failed")
+	err := tr.run(0, 1000, func(i int, off int64, buf []byte) error {
+		if off == 0 {
+			// the other workers keep going while the first chunk hangs
+			time.Sleep(50 * time.Millisecond)
+			return errStalled
+		}
+		mu.Lock()
+		if e := off + int64(len(buf)); e > end {
+			end = e
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != errStalled {
+		t.Fatalf("got %v", err)
+	}
+	if off := tr.ResumeOffset(end); off != 0 {
+		t.Fatalf("partial size %d resumes at %d past the hole at 0", end, off)
+	}
+}
+
+func TestTransferRunAllChunks(t *testing.T) {
+	tr := &Transfer{Clients: []*Client{nil, nil}, Requests: 3, ChunkSize: 7}
+	var mu sync.Mutex
+	seen := make(map[int64]int)
+	var done int64
+	tr.Progress = func(d, total int64) {
+		done = d
+	}
+	if err := tr.run(14, 100, func(i int, off int64, buf []byte) error {
+		mu.Lock()
+		seen[off] += len(buf)
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for off := int64(14); off < 100; off += 7 {
+		want := 7
+		if off+7 > 100 {
+			want = int(100 - off)
+		}
+		if seen[off] != want {
+			t.Fatalf("chunk %d: %d bytes", off, seen[off])
+		}
+	}
+	if len(seen) != 13 || done != 100 {
+		t.Fatalf("chunks %d done %d", len(seen), done)
+	}
+}
@@ -0,0 +1,240 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// Proxy credential storage
+//
+// TUNNEL_CREDENTIAL_STORE selects stores, comma separated, looked up in order:
+//   git              git credential helper protocol (default)
+//   secret-service   freedesktop Secret Service (GNOME Keyring, KWallet)
+//   file[:path]      encrypted file, passphrase from TUNNEL_CREDENTIAL_PASSPHRASE or asked
+//   none             disable
+
+// error
+var (
+	ErrCredentialNotFound = errors.New("credential not found")
+)
+
+// Credential proxy credential, Host is proxy host:port
+type Credential struct {
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// match same proxy, user matches any when empty
+func (c *Credential) match(o *Credential) bool {
+	return c.Protocol == o.Protocol && strings.EqualFold(c.Host, o.Host) && (len(c.User) == 0 || c.User == o.User)
+}
+
+// ProxyCredentialKey credential store key of proxy url, user from url when present
+func ProxyCredentialKey(proxyurl string) (*Credential, error) {
+	if !strings.Contains(proxyurl, "://") {
+		proxyurl = "http://" + proxyurl
+	}
+	u, err := url.Parse(proxyurl)
+	if err != nil {
+		return nil, cli.ErrorCat("invalid proxy url: ", proxyurl)
+	}
+	c := &Credential{Protocol: u.Scheme, Host: urlMakeAddress(u)}
+	if u.User != nil {
+		c.User = u.User.Username()
+	}
+	return c, nil
+}
+
+// CredentialStore keep proxy credentials out of proxy url
+type CredentialStore interface {
+	// Get fill User (when empty) and Password, ErrCredentialNotFound when not stored
+	Get(c *Credential) error
+	// Store credential accepted by proxy
+	Store(c *Credential) error
+	// Erase credential rejected by proxy
+	Erase(c *Credential) error
+}
+
+// CredentialStores lookup in order, store to the first
+type CredentialStores []CredentialStore
+
+// Get todo
+func (cs CredentialStores) Get(c *Credential) error {
+	var lastErr error = ErrCredentialNotFound
+	for _, s := range cs {
+		err := s.Get(c)
+		if err == nil {
+			return nil
+		}
+		if err != ErrCredentialNotFound {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Store todo
+func (cs CredentialStores) Store(c *Credential) error {
+	if len(cs) == 0 {
+		return nil
+	}
+	return cs[0].Store(c)
+}
+
+// Erase todo
+func (cs CredentialStores) Erase(c *Credential) error {
+	var lastErr error
+	for _, s := range cs {
+		if err := s.Erase(c); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// PassphraseFunc ask passphrase of encrypted credential file
+type PassphraseFunc func(path string) (string, error)
+
+// NewCredentialStore parse TUNNEL_CREDENTIAL_STORE style spec, empty spec means git
+func NewCredentialStore(spec string, passphrase PassphraseFunc) (CredentialStore, error) {
+	if len(strings.TrimSpace(spec)) == 0 {
+		spec = "git"
+	}
+	var cs CredentialStores
+	for _, s := range strings.Split(spec, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(s), ":")
+		switch strings.ToLower(name) {
+		case "git":
+			cs = append(cs, &GitCredentialStore{})
+		case "secret-service", "secretservice":
+			cs = append(cs, &SecretServiceStore{})
+		case "file":
+			cs = append(cs, &EncryptedFileStore{Path: arg, Passphrase: passphrase})
+		case "none", "":
+		default:
+			return nil, cli.ErrorCat("unsupported credential store '", name, "'")
+		}
+	}
+	return cs, nil
+}
+
+// DefaultCredentialStore from TUNNEL_CREDENTIAL_STORE
+func DefaultCredentialStore(passphrase PassphraseFunc) (CredentialStore, error) {
+	return NewCredentialStore(os.Getenv("TUNNEL_CREDENTIAL_STORE"), passphrase)
+}
+
+// GitCredentialStore git credential fill/approve/reject, uses credential.helper of git config
+type GitCredentialStore struct {
+	Git string // default git in PATH
+}
+
+func (g *GitCredentialStore) run(action string, c *Credential) ([]byte, error) {
+	git := g.Git
+	if len(git) == 0 {
+		git = "git"
+	}
+	var in bytes.Buffer
+	in.WriteString(cli.StrCat("protocol=", c.Protocol, "\nhost=", c.Host, "\n"))
+	if len(c.User) != 0 {
+		in.WriteString(cli.StrCat("username=", c.User, "\n"))
+	}
+	if len(c.Password) != 0 {
+		in.WriteString(cli.StrCat("password=", c.Password, "\n"))
+	}
+	in.WriteString("\n")
+	cmd := exec.Command(git, "credential", action)
+	cmd.Stdin = &in
+	// lookup only, never prompt: Git Credential Manager shows its dialog unless GCM_INTERACTIVE=never
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	return cmd.Output()
+}
+
+// Get todo
+func (g *GitCredentialStore) Get(c *Credential) error {
+	out, err := g.run("fill", c)
+	if err != nil {
+		return ErrCredentialNotFound // no helper or nothing stored
+	}
+	var user, password string
+	br := bufio.NewScanner(bytes.NewReader(out))
+	for br.Scan() {
+		k, v, ok := strings.Cut(br.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "username":
+			user = v
+		case "password":
+			password = v
+		}
+	}
+	if len(password) == 0 || (len(c.User) != 0 && user != c.User) {
+		return ErrCredentialNotFound
+	}
+	c.User, c.Password = user, password
+	return nil
+}
+
+// Store todo
+func (g *GitCredentialStore) Store(c *Credential) error {
+	_, err := g.run("approve", c)
+	return err
+}
+
+// Erase todo
+func (g *GitCredentialStore) Erase(c *Credential) error {
+	_, err := g.run("reject", c)
+	return err
+}
+
+func (bm *BoringMachine) credentialStore() CredentialStore {
+	bm.credMu.Lock()
+	defer bm.credMu.Unlock()
+	if bm.CredentialStore == nil {
+		cs, err := DefaultCredentialStore(bm.Passphrase)
+		if err != nil {
+			bm.DebugPrint("credential store: %v", err)
+			return nil
+		}
+		bm.CredentialStore = cs
+	}
+	return bm.CredentialStore
+}
+
+// approveCredential proxy accepted credential, keep what the user entered
+func (bm *BoringMachine) approveCredential(ctx *ProxyAuthContext) {
+	if ctx.source != credentialAsked || ctx.err != nil {
+		return
+	}
+	if store := bm.credentialStore(); store != nil {
+		cred := ctx.storeKey(ctx.user)
+		cred.Password = ctx.passwd
+		if err := store.Store(cred); err != nil {
+			bm.DebugPrint("store proxy credential: %v", err)
+		}
+	}
+}
+
+// rejectCredential proxy answered 407 to the stored credential itself, remove it
+func (bm *BoringMachine) rejectCredential(ctx *ProxyAuthContext) {
+	if ctx.source != credentialStore {
+		return
+	}
+	if store := bm.credentialStore(); store != nil {
+		cred := ctx.storeKey(ctx.user)
+		cred.Password = ctx.passwd
+		if err := store.Erase(cred); err != nil {
+			bm.DebugPrint("erase proxy credential: %v", err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encrypted credential file: scrypt derived key, AES-256-GCM sealed JSON
+
+// error
+var (
+	ErrCredentialPassphrase = errors.New("credential file: wrong passphrase or corrupted file")
+	ErrNoPassphrase         = errors.New("credential file: no passphrase (set TUNNEL_CREDENTIAL_PASSPHRASE)")
+)
+
+const credentialFileVersion = 1
+
+// EncryptedFileStore todo
+type EncryptedFileStore struct {
+	Path       string         // default ~/.tunnelssh/credentials
+	Passphrase PassphraseFunc // nil: TUNNEL_CREDENTIAL_PASSPHRASE
+	mu         sync.Mutex     // one passphrase prompt, no lost updates of concurrent dials
+	key        []byte
+	salt       []byte
+}
+
+type credentialFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+func (fs *EncryptedFileStore) path() string {
+	if len(fs.Path) != 0 {
+		return fs.Path
+	}
+	if p := os.Getenv("TUNNEL_CREDENTIAL_FILE"); len(p) != 0 {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".tunnelssh-credentials"
+	}
+	return filepath.Join(home, ".tunnelssh", "credentials")
+}
+
+func (fs *EncryptedFileStore) deriveKey(salt []byte) ([]byte, error) {
+	if fs.key != nil && string(fs.salt) == string(salt) {
+		return fs.key, nil
+	}
+	var passphrase string
+	if fs.Passphrase != nil {
+		var err error
+		if passphrase, err = fs.Passphrase(fs.path()); err != nil {
+			return nil, err
+		}
+	} else {
+		passphrase = os.Getenv("TUNNEL_CREDENTIAL_PASSPHRASE")
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	fs.key, fs.salt = key, salt
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load decrypt credentials, missing file is empty
+func (fs *EncryptedFileStore) load() ([]*Credential, error) {
+	b, err := os.ReadFile(fs.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var f credentialFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, cli.ErrorCat("credential file: ", err.Error())
+	}
+	if f.Version != credentialFileVersion {
+		return nil, cli.ErrorCat("credential file: unsupported version")
+	}
+	key, err := fs.deriveKey(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		fs.key, fs.salt = nil, nil // wrong passphrase, ask again next time
+		return nil, ErrCredentialPassphrase
+	}
+	var creds []*Credential
+	if err := json.Unmarshal(plain, &creds); err != nil {
+		return nil, cli.ErrorCat("credential file: ", err.Error())
+	}
+	return creds, nil
+}
+
+func (fs *EncryptedFileStore) save(creds []*Credential) error {
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	salt := fs.salt
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+	key, err := fs.deriveKey(salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	f := credentialFile{Version: credentialFileVersion, Salt: salt, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Data = aead.Seal(nil, f.Nonce, plain, nil)
+	b, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+	p := fs.path()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Get todo
+func (fs *EncryptedFileStore) Get(c *Credential) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	creds, err := fs.load()
+	if err != nil {
+		return err
+	}
+	for _, e := range creds {
+		if c.match(e) {
+			c.User, c.Password = e.User, e.Password
+			return nil
+		}
+	}
+	return ErrCredentialNotFound
+}
+
+// Store todo
+func (fs *EncryptedFileStore) Store(c *Credential) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	creds, err := fs.load()
+	if err != nil {
+		return err
+	}
+	saved := &Credential{Protocol: c.Protocol, Host: c.Host, User: c.User, Password: c.Password}
+	replaced := false
+	for i, e := range creds {
+		if e.Protocol == c.Protocol && e.Host == c.Host && e.User == c.User {
+			creds[i], replaced = saved, true
+		}
+	}
+	if !replaced {
+		creds = append(creds, saved)
+	}
+	return fs.save(creds)
+}
+
+// Erase todo
+func (fs *EncryptedFileStore) Erase(c *Credential) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	creds, err := fs.load()
+	if err != nil {
+		return err
+	}
+	kept := creds[:0]
+	for _, e := range creds {
+		if !c.match(e) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(creds) {
+		return nil
+	}
+	return fs.save(kept)
+}
@@ -0,0 +1,31 @@
+package tunnel
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedFileStoreWrongPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	fs := &EncryptedFileStore{Path: path, Passphrase: func(string) (string, error) { return "secret", nil }}
+	if err := fs.Store(&Credential{Protocol: "http", Host: "proxy:8080", User: "alice", Password: "pw"}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	answers := []string{"wrong", "secret"}
+	asked := 0
+	fs2 := &EncryptedFileStore{Path: path, Passphrase: func(string) (string, error) {
+		p := answers[asked]
+		asked++
+		return p, nil
+	}}
+	c := &Credential{Protocol: "http", Host: "proxy:8080", User: "alice"}
+	if err := fs2.Get(c); err != ErrCredentialPassphrase {
+		t.Fatalf("get with wrong passphrase: %v", err)
+	}
+	if err := fs2.Get(c); err != nil {
+		t.Fatalf("get after retry: %v", err)
+	}
+	if asked != 2 || c.Password != "pw" {
+		t.Fatalf("asked %d times, password %q", asked, c.Password)
+	}
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Digest proxy authentication, RFC 7616 (MD5, SHA-256 and -sess variants, qop=auth, userhash)
+
+// error
+var (
+	ErrDigestAlgorithm = errors.New("digest: unsupported algorithm")
+	ErrDigestQop       = errors.New("digest: unsupported qop")
+)
+
+// DigestAuthenticator todo
+type DigestAuthenticator struct{}
+
+// Scheme todo
+func (*DigestAuthenticator) Scheme() string {
+	return "Digest"
+}
+
+// NewSession todo
+func (*DigestAuthenticator) NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error) {
+	user, password, err := ctx.Credential()
+	if err != nil {
+		return nil, err
+	}
+	return &digestSession{user: user, password: password, method: http.MethodConnect, uri: ctx.Target}, nil
+}
+
+type digestSession struct {
+	user     string
+	password string
+	method   string
+	uri      string // CONNECT request-target
+	nonce    string
+	nc       int
+	sent     bool
+	cnonce   func() (string, error) // nil: random
+}
+
+func digestCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func digestHash(algorithm string) (func() hash.Hash, bool, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New, false, nil
+	case "MD5-SESS":
+		return md5.New, true, nil
+	case "SHA-256":
+		return sha256.New, false, nil
+	case "SHA-256-SESS":
+		return sha256.New, true, nil
+	}
+	return nil, false, ErrDigestAlgorithm
+}
+
+// digestQop pick auth from qop options, empty when server sent none (RFC 2069 compatibility)
+func digestQop(qop string) (string, error) {
+	if len(qop) == 0 {
+		return "", nil
+	}
+	for _, q := range strings.Split(qop, ",") {
+		if strings.EqualFold(strings.TrimSpace(q), "auth") {
+			return "auth", nil
+		}
+	}
+	return "", ErrDigestQop
+}
+
+func digestQuote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// Authorize answer challenge, a second challenge is only accepted when server marks the nonce stale
+func (s *digestSession) Authorize(challenge string) (string, error) {
+	params := parseAuthParams(challenge)
+	if s.sent && !strings.EqualFold(params["stale"], "true") {
+		return "", ErrProxyAuthFailed
+	}
+	s.sent = true
+	newHash, sess, err := digestHash(params["algorithm"])
+	if err != nil {
+		return "", err
+	}
+	qop, err := digestQop(params["qop"])
+	if err != nil {
+		return "", err
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	nonce := params["nonce"]
+	if nonce != s.nonce {
+		s.nonce, s.nc = nonce, 0
+	}
+	s.nc++
+	nc := fmt.Sprintf("%08x", s.nc)
+	newCnonce := s.cnonce
+	if newCnonce == nil {
+		newCnonce = digestCnonce
+	}
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	realm := params["realm"]
+	ha1 := h(s.user, realm, s.password)
+	if sess {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(s.method, s.uri)
+	var response string
+	if len(qop) != 0 {
+		response = h(ha1, nonce, nc, cnonce, qop, ha2)
+	} else {
+		response = h(ha1, nonce, ha2)
+	}
+	// userhash: server asks to hide the user name, H(user:realm) is sent instead
+	userhash := strings.EqualFold(params["userhash"], "true")
+	username := s.user
+	if userhash {
+		username = h(s.user, realm)
+	}
+	var sb strings.Builder
+	sb.WriteString("Digest username=")
+	sb.WriteString(digestQuote(username))
+	sb.WriteString(", realm=")
+	sb.WriteString(digestQuote(realm))
+	sb.WriteString(", nonce=")
+	sb.WriteString(digestQuote(nonce))
+	sb.WriteString(", uri=")
+	sb.WriteString(digestQuote(s.uri))
+	if algorithm, ok := params["algorithm"]; ok {
+		sb.WriteString(", algorithm=")
+		sb.WriteString(algorithm)
+	}
+	sb.WriteString(", response=")
+	sb.WriteString(digestQuote(response))
+	if opaque, ok := params["opaque"]; ok {
+		sb.WriteString(", opaque=")
+		sb.WriteString(digestQuote(opaque))
+	}
+	if len(qop) != 0 {
+		sb.WriteString(", qop=")
+		sb.WriteString(qop)
+		sb.WriteString(", nc=")
+		sb.WriteString(nc)
+		sb.WriteString(", cnonce=")
+		sb.WriteString(digestQuote(cnonce))
+	}
+	if userhash {
+		sb.WriteString(", userhash=true")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// RFC 7616 3.9.1 example
+const (
+	digestTestRealm  = `realm="http-auth@example.org"`
+	digestTestNonce  = `nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"`
+	digestTestOpaque = `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+	digestTestCnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+)
+
+func newDigestTestSession() *digestSession {
+	return &digestSession{
+		user:     "Mufasa",
+		password: "Circle of Life",
+		method:   http.MethodGet,
+		uri:      "/dir/index.html",
+		cnonce:   func() (string, error) { return digestTestCnonce, nil },
+	}
+}
+
+func digestTestChallenge(extra string) string {
+	return digestTestRealm + `, qop="auth, auth-int", ` + extra + digestTestNonce + ", " + digestTestOpaque
+}
+
+func TestDigestRFC7616(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		response  string
+	}{
+		// responses given in RFC 7616 3.9.1
+		{"MD5", "algorithm=MD5, ", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "algorithm=SHA-256, ", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		// same inputs, HA1 = H(H(user:realm:password):nonce:cnonce)
+		{"MD5-sess", "algorithm=MD5-sess, ", "e783283f46242139c486a698fec7211d"},
+		{"SHA-256-sess", "algorithm=SHA-256-sess, ", "2fd51b3a77ad75bad6afad6003e818d767133c46d9e2749e7f5232ae1ea3efd7"},
+	}
+	for _, tc := range tests {
+		got, err := newDigestTestSession().Authorize(digestTestChallenge(tc.algorithm))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		params := parseAuthParams(got[len("Digest "):])
+		if params["response"] != tc.response {
+			t.Errorf("%s: response %s, want %s", tc.name, params["response"], tc.response)
+		}
+		if params["username"] != "Mufasa" || params["uri"] != "/dir/index.html" || params["qop"] != "auth" ||
+			params["nc"] != "00000001" || params["cnonce"] != digestTestCnonce {
+			t.Errorf("%s: %s", tc.name, got)
+		}
+		if params["opaque"] != "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS" {
+			t.Errorf("%s: opaque not echoed: %s", tc.name, got)
+		}
+	}
+}
+
+func TestDigestUserhash(t *testing.T) {
+	got, err := newDigestTestSession().Authorize(digestTestChallenge("algorithm=SHA-256, userhash=true, "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parseAuthParams(got[len("Digest "):])
+	// SHA-256("Mufasa:http-auth@example.org"), the response keeps the plain user name
+	if params["username"] != "a947aad205e80e429958a387394944c6b496301e79f89d35a4cc23b6ee12b5b6" || params["userhash"] != "true" {
+		t.Fatalf("userhash: %s", got)
+	}
+	if params["response"] != "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1" {
+		t.Fatalf("response %s", params["response"])
+	}
+}
+
+func TestDigestStale(t *testing.T) {
+	s := newDigestTestSession()
+	challenge := digestTestChallenge("algorithm=SHA-256, ")
+	if _, err := s.Authorize(challenge); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Authorize(challenge + ", stale=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc := parseAuthParams(got[len("Digest "):])["nc"]; nc != "00000002" {
+		t.Fatalf("nc %s after stale on same nonce", nc)
+	}
+	if _, err := s.Authorize(challenge); !errors.Is(err, ErrProxyAuthFailed) {
+		t.Fatalf("second challenge without stale: %v", err)
+	}
+}
+
+func TestDigestUnsupported(t *testing.T) {
+	if _, err := newDigestTestSession().Authorize(digestTestRealm + ", algorithm=SHA-512-256, " + digestTestNonce); !errors.Is(err, ErrDigestAlgorithm) {
+		t.Fatalf("algorithm: %v", err)
+	}
+	if _, err := newDigestTestSession().Authorize(digestTestRealm + `, qop="auth-int", ` + digestTestNonce); !errors.Is(err, ErrDigestQop) {
+		t.Fatalf("qop: %v", err)
+	}
+}
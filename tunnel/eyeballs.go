@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// Happy Eyeballs Version 2 (RFC 8305) for network "tcp": AAAA and A are looked up
+// concurrently, addresses are tried alternating families starting with IPv6, a new
+// attempt starts every connectionAttemptDelay or as soon as the previous one failed.
+
+const (
+	resolutionDelay        = 50 * time.Millisecond
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// error
+var (
+	ErrNoSuitableAddress = errors.New("no suitable address found")
+)
+
+type lookupResult struct {
+	v6  bool
+	ips []net.IP
+	err error
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialNetwork tcp uses Happy Eyeballs, tcp4/tcp6 and other networks dial as is
+func (bm *BoringMachine) dialNetwork(ctx context.Context, network, address string) (net.Conn, error) {
+	if network == "tcp" {
+		return bm.dialHappyEyeballs(ctx, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (bm *BoringMachine) dialHappyEyeballs(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.DialContext(ctx, "tcp", address)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	lookups := make(chan lookupResult, 2)
+	for _, family := range []string{"ip6", "ip4"} {
+		go func(family string) {
+			ips, err := net.DefaultResolver.LookupIP(ctx, family, host)
+			lookups <- lookupResult{v6: family == "ip6", ips: ips, err: err}
+		}(family)
+	}
+	results := make(chan dialResult)
+	attempt := func(ip net.IP) {
+		addr := net.JoinHostPort(ip.String(), port)
+		bm.DebugPrint("happy eyeballs: connect %s", addr)
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			select {
+			case results <- dialResult{conn: conn, err: err}:
+			case <-done:
+				if conn != nil {
+					_ = conn.Close()
+				}
+			}
+		}()
+	}
+	var v6, v4 []net.IP
+	var lookupErr, dialErr error
+	var resolutionC, attemptC <-chan time.Time
+	pending, inflight := 2, 0
+	v6Done, holdV4, canAttempt, preferV6 := false, false, true, true
+	for {
+		if canAttempt && (len(v6) != 0 || (len(v4) != 0 && !holdV4)) {
+			if len(v6) != 0 && (preferV6 || len(v4) == 0 || holdV4) {
+				attempt(v6[0])
+				v6, preferV6 = v6[1:], false
+			} else {
+				attempt(v4[0])
+				v4, preferV6 = v4[1:], true
+			}
+			inflight++
+			canAttempt, attemptC = false, time.After(connectionAttemptDelay)
+			continue
+		}
+		if pending == 0 && inflight == 0 && len(v6) == 0 && len(v4) == 0 {
+			switch {
+			case dialErr != nil:
+				return nil, dialErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			}
+			return nil, cli.ErrorCat(host, ": ", ErrNoSuitableAddress.Error())
+		}
+		select {
+		case r := <-lookups:
+			pending--
+			if r.err != nil {
+				lookupErr = r.err
+			}
+			if r.v6 {
+				v6, v6Done, holdV4 = append(v6, r.ips...), true, false
+				resolutionC = nil
+				continue
+			}
+			v4 = append(v4, r.ips...)
+			if !v6Done {
+				// give AAAA a moment, IPv6 is preferred
+				holdV4, resolutionC = true, time.After(resolutionDelay)
+			}
+		case <-resolutionC:
+			holdV4, resolutionC = false, nil
+		case <-attemptC:
+			canAttempt, attemptC = true, nil
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			dialErr = r.err
+			canAttempt, attemptC = true, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// resolveFamily resolve host of address to a literal of network tcp4 or tcp6
+func resolveFamily(ctx context.Context, network, address string) (string, error) {
+	if network != "tcp4" && network != "tcp6" {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	want4 := network == "tcp4"
+	if ip := net.ParseIP(host); ip != nil {
+		if (ip.To4() != nil) != want4 {
+			return "", cli.ErrorCat(host, ": address family mismatch, network ", network)
+		}
+		return address, nil
+	}
+	family := "ip6"
+	if want4 {
+		family = "ip4"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, family, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", cli.ErrorCat(host, ": ", ErrNoSuitableAddress.Error())
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialHappyEyeballs(t *testing.T) {
+	echo := newEchoServer(t) // IPv4 only, an IPv6 attempt to localhost is refused
+	_, port, _ := net.SplitHostPort(echo)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := testBoringMachine().dialNetwork(ctx, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+	if _, err := testBoringMachine().dialNetwork(ctx, "tcp", "no-such-host.invalid:22"); err == nil {
+		t.Fatal("expected lookup failure")
+	}
+}
+
+func TestResolveFamily(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		network, address, want string
+		fail                   bool
+	}{
+		{"tcp", "localhost:22", "localhost:22", false},
+		{"tcp4", "localhost:22", "127.0.0.1:22", false},
+		{"tcp4", "10.0.0.1:22", "10.0.0.1:22", false},
+		{"tcp4", "[::1]:22", "", true},
+		{"tcp6", "10.0.0.1:22", "", true},
+		{"tcp6", "[::1]:22", "[::1]:22", false},
+	}
+	for _, tc := range tests {
+		got, err := resolveFamily(ctx, tc.network, tc.address)
+		if (err != nil) != tc.fail || got != tc.want {
+			t.Errorf("resolveFamily(%s, %s) = %q, %v", tc.network, tc.address, got, err)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package tunnel
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"context"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/balibuild/tunnelssh/cli"
@@ -22,46 +25,228 @@ func (pc *proxyconn) Read(b []byte) (int, error) {
 	return pc.br.Read(b)
 }
 
-// DialTunnelHTTP use http proxy
-func (bm *BoringMachine) DialTunnelHTTP(u *url.URL, paddr, addr string, timeout time.Duration) (net.Conn, error) {
-	var err error
-	var conn net.Conn
-	if u.Scheme == "https" {
-		d := &net.Dialer{Timeout: timeout}
-		conn, err = tls.DialWithDialer(d, "tcp", paddr, nil)
-	} else {
-		conn, err = net.DialTimeout("tcp", paddr, timeout)
+// CloseWrite half-close, the proxy forwards FIN to the target
+func (pc *proxyconn) CloseWrite() error {
+	if cw, ok := pc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
+	return ErrCloseWriteUnsupported
+}
+
+// dialProxy plain http:// proxy, https:// proxies use dialProxyTLS
+func (bm *BoringMachine) dialProxy(ctx context.Context, paddr string) (*proxyconn, error) {
+	conn, err := bm.dialNetwork(ctx, "tcp", paddr)
 	if err != nil {
 		return nil, cli.ErrorCat("Counld't establish connection to proxy: ", err.Error())
 	}
+	return &proxyconn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// connect send CONNECT request and read response header
+func (pc *proxyconn) connect(addr, authorization string) (*http.Response, error) {
 	var buf bytes.Buffer
 	buf.Grow(512)
-	ph, _ := splitHostPort(addr)
 	_, _ = buf.WriteString("CONNECT ")
 	_, _ = buf.WriteString(addr)
-	_, _ = buf.WriteString(" HTTP/1.1\nHost: ")
-	_, _ = buf.WriteString(ph) // Host information
-	_, _ = buf.WriteString("\nProxy-Connection: Keep-Alive\nContent-Length: 0\nUser-Agent:SSH/9.0\n")
-	if u.User != nil {
-		_, _ = buf.WriteString("\nProxy-Authorization: Basic ")
-		_, _ = buf.WriteString(basicAuth(u.User))
+	_, _ = buf.WriteString(" HTTP/1.1\r\nHost: ")
+	_, _ = buf.WriteString(addr)
+	_, _ = buf.WriteString("\r\nProxy-Connection: Keep-Alive\r\nContent-Length: 0\r\nUser-Agent: SSH/9.0\r\n")
+	if len(authorization) != 0 {
+		_, _ = buf.WriteString("Proxy-Authorization: ")
+		_, _ = buf.WriteString(authorization)
+		_, _ = buf.WriteString("\r\n")
 	}
-	_, _ = buf.WriteString("\r\n\r\n")
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		conn.Close()
+	_, _ = buf.WriteString("\r\n")
+	if _, err := pc.Write(buf.Bytes()); err != nil {
 		return nil, cli.ErrorCat("Counld't send CONNECT request to proxy: ", err.Error())
 	}
-	pc := &proxyconn{Conn: conn, br: bufio.NewReader(conn)}
-	resp, err := http.ReadResponse(pc.br, nil)
-	if err != nil {
-		pc.Close()
-		return nil, cli.ErrorCat("reading HTTP response from CONNECT to ", addr, " via proxy ", paddr, " failed: ", err.Error())
+	return http.ReadResponse(pc.br, nil)
+}
+
+// reusable drain 407 body, report whether the connection can carry the next request
+func reusable(resp *http.Response) bool {
+	defer resp.Body.Close()
+	if resp.Close || strings.EqualFold(resp.Header.Get("Proxy-Connection"), "close") {
+		return false
+	}
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		return false // body delimited by close
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return err == nil && n < 64*1024
+}
+
+func (bm *BoringMachine) proxyAuthenticators() []ProxyAuthenticator {
+	if bm.ProxyAuth != nil {
+		return bm.ProxyAuth
+	}
+	return DefaultProxyAuthenticators()
+}
+
+// selectProxyAuth first authenticator offered by proxy which can start a session, schemes in failed are skipped
+func (bm *BoringMachine) selectProxyAuth(ctx *ProxyAuthContext, challenges []*proxyChallenge, failed map[string]bool) (ProxyAuthSession, string, error) {
+	var lastErr error = ErrProxyAuthFailed
+	for _, a := range bm.proxyAuthenticators() {
+		if failed[a.Scheme()] || findChallenge(challenges, a.Scheme()) == nil {
+			continue
+		}
+		s, err := a.NewSession(ctx)
+		if err != nil {
+			bm.DebugPrint("proxy auth %s unavailable: %v", a.Scheme(), err)
+			lastErr = err
+			continue
+		}
+		bm.DebugPrint("proxy auth use %s", a.Scheme())
+		return s, a.Scheme(), nil
+	}
+	return nil, "", lastErr
+}
+
+// credentialRejected proxy answered 407 to the user and password, Negotiate sends the kerberos ticket instead
+func credentialRejected(scheme string, err error) bool {
+	return errors.Is(err, ErrProxyAuthFailed) && !strings.EqualFold(scheme, "Negotiate")
+}
+
+// DialTunnelHTTP use http proxy, 407 challenges are answered by ProxyAuth authenticators
+func (bm *BoringMachine) DialTunnelHTTP(u *url.URL, paddr, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return bm.DialTunnelHTTPContext(ctx, u, paddr, addr)
+}
+
+// DialTunnelHTTPContext todo
+func (bm *BoringMachine) DialTunnelHTTPContext(dctx context.Context, u *url.URL, paddr, addr string) (net.Conn, error) {
+	ctx := &ProxyAuthContext{URL: u, Proxy: paddr, Target: addr, bm: bm}
+	var session ProxyAuthSession
+	var scheme, authorization string
+	preemptive := false
+	if _, ok := u.User.Password(); ok {
+		// preemptive Basic like before, replaced when proxy offers a stronger scheme
+		if s, err := (&BasicAuthenticator{}).NewSession(ctx); err == nil {
+			session, scheme, preemptive = s, "Basic", true
+			authorization, _ = s.Authorize("")
+		}
+	}
+	authFailed := func(err error) error {
+		return &ProxyAuthError{Proxy: paddr, Err: err}
+	}
+	var cc *h2client // shared h2 connection, never closed here
+	reused := false  // cc from pool, the proxy may have closed it meanwhile
+	var pc *proxyconn
+	var stop func() bool // interrupt CONNECT on pc when dctx is done
+	closeProxy := func() {
+		if pc != nil {
+			stop()
+			pc.Close()
+			pc = nil
+		}
 	}
-	if resp.StatusCode != 200 {
-		pc.Close()
-		return nil, cli.ErrorCat("proxy error from ", paddr, " while dialing ", addr, ":", resp.Status)
+	h1only := false
+	failed := make(map[string]bool) // schemes which could not answer, eg: Negotiate with an expired ticket
+	for round := 0; round < maxProxyAuthRounds; round++ {
+		var err error
+		if cc == nil && pc == nil {
+			if u.Scheme == "https" {
+				cc, pc, reused, err = bm.dialProxyTLS(dctx, u, paddr, h1only)
+			} else {
+				pc, err = bm.dialProxy(dctx, paddr)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if pc != nil {
+				stop = watchContext(dctx, pc)
+			}
+		}
+		var resp *http.Response
+		var conn net.Conn
+		if cc != nil {
+			if resp, conn, err = h2Connect(dctx, cc, addr, authorization); err != nil {
+				if dctx.Err() != nil {
+					return nil, cli.ErrorCat("HTTP/2 CONNECT to ", addr, " via proxy ", paddr, ": ", dctx.Err().Error())
+				}
+				h2Drop(paddr, cc)
+				cc = nil
+				if reused {
+					bm.DebugPrint("pooled HTTP/2 connection to %s failed: %v, redial", paddr, err)
+					continue
+				}
+				if !h1only {
+					bm.DebugPrint("HTTP/2 CONNECT via %s failed: %v, fall back to HTTP/1.1", paddr, err)
+					h1only = true
+					continue
+				}
+				return nil, cli.ErrorCat("HTTP/2 CONNECT to ", addr, " via proxy ", paddr, " failed: ", err.Error())
+			}
+		} else {
+			if resp, err = pc.connect(addr, authorization); err != nil {
+				closeProxy()
+				if dctx.Err() != nil {
+					return nil, cli.ErrorCat("CONNECT to ", addr, " via proxy ", paddr, ": ", dctx.Err().Error())
+				}
+				return nil, cli.ErrorCat("reading HTTP response from CONNECT to ", addr, " via proxy ", paddr, " failed: ", err.Error())
+			}
+			conn = pc
+		}
+		if resp.StatusCode == http.StatusOK {
+			if pc != nil && !stop() {
+				pc.Close()
+				return nil, cli.ErrorCat("CONNECT to ", addr, " via proxy ", paddr, ": ", dctx.Err().Error())
+			}
+			bm.DebugPrint("Establish connection to proxy(%s %s): %s", u.Scheme, resp.Proto, paddr)
+			bm.approveCredential(ctx)
+			return conn, nil
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			resp.Body.Close()
+			closeProxy()
+			return nil, cli.ErrorCat("proxy error from ", paddr, " while dialing ", addr, ":", resp.Status)
+		}
+		challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+		if pc != nil && !reusable(resp) {
+			bm.DebugPrint("proxy closed connection after 407, reconnect")
+			closeProxy()
+		}
+		if cc != nil {
+			resp.Body.Close() // stream ends, next round opens a new one
+		}
+		ch := findChallenge(challenges, scheme)
+		if session == nil || ch == nil || preemptive {
+			s, sch, err := bm.selectProxyAuth(ctx, challenges, failed)
+			if err != nil {
+				closeProxy()
+				return nil, authFailed(err)
+			}
+			// Basic again after preemptive Basic: keep spent session, it reports failure
+			if !preemptive || sch != scheme {
+				session, scheme = s, sch
+			}
+			preemptive = false
+			ch = findChallenge(challenges, scheme)
+		}
+		for {
+			if authorization, err = session.Authorize(ch.Params); err == nil {
+				break
+			}
+			authErr := cli.ErrorCat(scheme, ": ", err.Error())
+			if credentialRejected(scheme, err) {
+				closeProxy()
+				// only a 407 answering the credential itself means the stored password is wrong
+				bm.rejectCredential(ctx)
+				return nil, authFailed(authErr)
+			}
+			// try the other schemes offered by the proxy
+			bm.DebugPrint("proxy auth %s failed: %v", scheme, err)
+			failed[scheme] = true
+			s, sch, serr := bm.selectProxyAuth(ctx, challenges, failed)
+			if serr != nil {
+				closeProxy()
+				return nil, authFailed(authErr)
+			}
+			session, scheme = s, sch
+			ch = findChallenge(challenges, scheme)
+		}
 	}
-	bm.DebugPrint("Establish connection to proxy(%s): %s", u.Scheme, paddr)
-	return pc, nil
+	closeProxy()
+	return nil, authFailed(errors.New("too many rounds"))
 }
@@ -0,0 +1,185 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2 CONNECT (RFC 9113 8.5) for https:// proxies, selected by ALPN. One TLS
+// connection per proxy is shared by all tunnels of the process, each tunnel is a stream.
+
+// h2client pooled h2 connection
+type h2client struct {
+	*http2.ClientConn
+	conn net.Conn
+}
+
+var h2pool = struct {
+	sync.Mutex
+	transport *http2.Transport
+	conns     map[string]*h2client
+}{
+	transport: &http2.Transport{},
+	conns:     make(map[string]*h2client),
+}
+
+func h2Get(paddr string) *h2client {
+	h2pool.Lock()
+	defer h2pool.Unlock()
+	cc := h2pool.conns[paddr]
+	if cc != nil && !cc.CanTakeNewRequest() {
+		delete(h2pool.conns, paddr)
+		return nil
+	}
+	return cc
+}
+
+func h2Put(paddr string, cc *h2client) {
+	h2pool.Lock()
+	defer h2pool.Unlock()
+	h2pool.conns[paddr] = cc
+}
+
+func h2Drop(paddr string, cc *h2client) {
+	h2pool.Lock()
+	defer h2pool.Unlock()
+	if h2pool.conns[paddr] == cc {
+		delete(h2pool.conns, paddr)
+	}
+	_ = cc.Close()
+}
+
+// dialProxyTLS pooled h2 connection (reused is true), or a new connection, HTTP/1.1 when proxy does not speak h2
+func (bm *BoringMachine) dialProxyTLS(ctx context.Context, u *url.URL, paddr string, h1only bool) (cc *h2client, pc *proxyconn, reused bool, err error) {
+	if !h1only {
+		if cc := h2Get(paddr); cc != nil {
+			bm.DebugPrint("reuse HTTP/2 connection to proxy %s", paddr)
+			return cc, nil, true, nil
+		}
+	}
+	config, err := bm.proxyTLSConfig(paddr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	config.NextProtos = []string{"h2", "http/1.1"}
+	if h1only {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	c, err := bm.dialNetwork(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, nil, false, cli.ErrorCat("Counld't establish connection to proxy: ", err.Error())
+	}
+	conn := tls.Client(c, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, nil, false, cli.ErrorCat("Counld't establish connection to proxy: ", err.Error())
+	}
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		bm.DebugPrint("proxy %s use HTTP/1.1", paddr)
+		return nil, &proxyconn{Conn: conn, br: bufio.NewReader(conn)}, false, nil
+	}
+	h2c, err := h2pool.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, false, cli.ErrorCat("proxy ", paddr, " HTTP/2: ", err.Error())
+	}
+	bm.DebugPrint("proxy %s use HTTP/2", paddr)
+	cc = &h2client{ClientConn: h2c, conn: conn}
+	h2Put(paddr, cc)
+	return cc, nil, false, nil
+}
+
+// h2conn tunnel over one h2 stream
+type h2conn struct {
+	net.Conn // TLS connection to proxy, for addresses only
+	body     io.ReadCloser
+	pw       *io.PipeWriter
+	cancel   context.CancelFunc
+	once     sync.Once
+}
+
+func (c *h2conn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *h2conn) Write(b []byte) (int, error) {
+	return c.pw.Write(b)
+}
+
+// CloseWrite END_STREAM on request side
+func (c *h2conn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+// Close reset stream, shared TLS connection stays open
+func (c *h2conn) Close() error {
+	c.once.Do(func() {
+		_ = c.pw.Close()
+		_ = c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+// SetDeadline deadline of stream not supported
+func (c *h2conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline todo
+func (c *h2conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline todo
+func (c *h2conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// h2Connect CONNECT on a new stream, conn is nil unless proxy answered 200.
+// ctx bounds the request only, the stream lives until conn is closed.
+func h2Connect(ctx context.Context, cc *h2client, addr, authorization string) (*http.Response, net.Conn, error) {
+	sctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Host: addr},
+		Host:          addr,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	req.Header.Set("User-Agent", "SSH/9.0")
+	if len(authorization) != 0 {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	resp, err := cc.RoundTrip(req.WithContext(sctx))
+	if !stop() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		pw.Close()
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		cancel()
+		return resp, nil, nil
+	}
+	return resp, &h2conn{Conn: cc.conn, body: resp.Body, pw: pw, cancel: cancel}, nil
+}
@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// h2Proxy TLS CONNECT proxy speaking h2 and HTTP/1.1, tunnels to an echo handler
+type h2Proxy struct {
+	srv    *httptest.Server
+	mu     sync.Mutex
+	protos []int // ProtoMajor of every CONNECT
+}
+
+func (p *h2Proxy) connects() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.protos...)
+}
+
+func (p *h2Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.protos = append(p.protos, r.ProtoMajor)
+	p.mu.Unlock()
+	if r.ProtoMajor == 1 {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		_, _ = io.Copy(c, brw)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			_, _ = w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// newH2Proxy trusted through TUNNEL_PROXY_CACERT
+func newH2Proxy(t *testing.T) *h2Proxy {
+	p := &h2Proxy{}
+	p.srv = httptest.NewUnstartedServer(p)
+	p.srv.EnableHTTP2 = true
+	p.srv.StartTLS()
+	t.Cleanup(p.srv.Close)
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TUNNEL_PROXY_CONFIG", filepath.Join(dir, "proxy.json"))
+	t.Setenv("TUNNEL_PROXY_CACERT", ca)
+	return p
+}
+
+func (p *h2Proxy) addr() string {
+	return p.srv.Listener.Addr().String()
+}
+
+// staleConn the proxy went away unnoticed: reads block, writes fail once broken
+type staleConn struct {
+	net.Conn
+	broken atomic.Bool
+}
+
+func (c *staleConn) Write(b []byte) (int, error) {
+	if c.broken.Load() {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func dialH2(t *testing.T, bm *BoringMachine, paddr string) net.Conn {
+	t.Helper()
+	u, _ := url.Parse("https://" + paddr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := bm.DialTunnelHTTPContext(ctx, u, paddr, "echo.test:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDialTunnelHTTP2(t *testing.T) {
+	p := newH2Proxy(t)
+	bm := testBoringMachine()
+	c := dialH2(t, bm, p.addr())
+	defer c.Close()
+	echoRoundTrip(t, c)
+	c2 := dialH2(t, bm, p.addr())
+	defer c2.Close()
+	echoRoundTrip(t, c2)
+	if got := p.connects(); len(got) != 2 || got[0] != 2 || got[1] != 2 {
+		t.Fatalf("CONNECT protocols %v, want h2 twice", got)
+	}
+	cc := h2Get(p.addr())
+	if cc == nil {
+		t.Fatal("h2 connection not pooled")
+	}
+	h2Drop(p.addr(), cc)
+}
+
+func TestDialTunnelHTTP2StalePooledConn(t *testing.T) {
+	p := newH2Proxy(t)
+	bm := testBoringMachine()
+	config, err := bm.proxyTLSConfig(p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.NextProtos = []string{"h2"}
+	raw, err := net.Dial("tcp", p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &staleConn{Conn: raw}
+	conn := tls.Client(sc, config)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	h2c, err := h2pool.transport.NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := &h2client{ClientConn: h2c, conn: conn}
+	h2Put(p.addr(), stale)
+	sc.broken.Store(true)
+	c := dialH2(t, bm, p.addr())
+	defer c.Close()
+	echoRoundTrip(t, c)
+	// stale connection dropped, redialed h2 instead of falling back to HTTP/1.1
+	if got := p.connects(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("CONNECT protocols %v, want one h2", got)
+	}
+	cc := h2Get(p.addr())
+	if cc == nil || cc == stale {
+		t.Fatal("stale h2 connection kept in pool")
+	}
+	h2Drop(p.addr(), cc)
+}
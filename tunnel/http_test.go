@@ -0,0 +1,384 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// proxyReply 407 answer of the fake proxy
+type proxyReply struct {
+	authenticate []string // Proxy-Authenticate values
+	close        bool     // close connection after 407
+}
+
+// connectProxy in-process HTTP/1.1 CONNECT proxy, auth is asked before a request is tunneled
+type connectProxy struct {
+	addr           string
+	auth           func(req *http.Request) *proxyReply // nil reply: 200
+	mu             sync.Mutex
+	conns          int
+	authorizations []string // Proxy-Authorization of every request
+}
+
+func (p *connectProxy) stats() (int, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns, append([]string(nil), p.authorizations...)
+}
+
+func newConnectProxy(t *testing.T, auth func(req *http.Request) *proxyReply) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{addr: l.Addr().String(), auth: auth}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.conns++
+			p.mu.Unlock()
+			go p.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *connectProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		p.mu.Lock()
+		p.authorizations = append(p.authorizations, req.Header.Get("Proxy-Authorization"))
+		p.mu.Unlock()
+		if p.auth != nil {
+			if reply := p.auth(req); reply != nil {
+				var b strings.Builder
+				b.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n")
+				for _, v := range reply.authenticate {
+					b.WriteString("Proxy-Authenticate: " + v + "\r\n")
+				}
+				if reply.close {
+					b.WriteString("Proxy-Connection: close\r\n")
+				}
+				b.WriteString("Content-Length: 0\r\n\r\n")
+				io.WriteString(c, b.String())
+				if reply.close {
+					return
+				}
+				continue
+			}
+		}
+		peer, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer peer.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(peer, br)
+			peer.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(c, peer)
+		return
+	}
+}
+
+func TestDialTunnelHTTPContext(t *testing.T) {
+	echo := newEchoServer(t)
+	paddr := newConnectProxy(t, nil).addr
+	u := &url.URL{Scheme: "http", Host: paddr}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := testBoringMachine().DialTunnelHTTPContext(ctx, u, paddr, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel() // done ctx must not affect established tunnel
+	echoRoundTrip(t, c)
+}
+
+func TestDialTunnelHTTPCloseWrite(t *testing.T) {
+	echo := newEchoServer(t)
+	paddr := newConnectProxy(t, nil).addr
+	u := &url.URL{Scheme: "http", Host: paddr}
+	c, err := testBoringMachine().DialTunnelHTTP(u, paddr, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msg := "one-shot request"
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseWrite(c); err != nil {
+		t.Fatal(err)
+	}
+	// echo server closes after EOF, so the read ends instead of hanging
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatalf("got %q", b)
+	}
+}
+
+func TestDialTunnelHTTPCancel(t *testing.T) {
+	paddr := silentProxy(t)
+	u := &url.URL{Scheme: "http", Host: paddr}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testBoringMachine().DialTunnelHTTPContext(ctx, u, paddr, "example.com:22")
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("cancel took %v", d)
+	}
+}
+
+func TestDialContextNoFallbackWhenCanceled(t *testing.T) {
+	paddr := silentProxy(t)
+	bm := testBoringMachine()
+	bm.Setting = &ProxySettings{ProxyServer: "http://" + paddr}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	// unroutable target, a direct fallback would block until its own timeout
+	_, err := bm.DialContext(ctx, "tcp", "10.255.255.1:22")
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+// basicProxy require Basic user:pass, challenges are the Proxy-Authenticate values of 407
+func basicProxy(t *testing.T, challenges []string, close bool) *connectProxy {
+	want := "Basic " + basicAuth(url.UserPassword("user", "pass"))
+	return newConnectProxy(t, func(req *http.Request) *proxyReply {
+		if req.Header.Get("Proxy-Authorization") == want {
+			return nil
+		}
+		return &proxyReply{authenticate: challenges, close: close}
+	})
+}
+
+func askingBoringMachine(password string) *BoringMachine {
+	bm := testBoringMachine()
+	bm.AskCredential = func(ctx *ProxyAuthContext, user string) (string, string, error) {
+		return "user", password, nil
+	}
+	return bm
+}
+
+func TestProxyAuthBasicRetry(t *testing.T) {
+	echo := newEchoServer(t)
+	p := basicProxy(t, []string{`Basic realm="proxy"`}, false)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	c, err := askingBoringMachine("pass").DialTunnelHTTP(u, p.addr, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+	conns, auths := p.stats()
+	if conns != 1 || len(auths) != 2 || len(auths[0]) != 0 || !strings.HasPrefix(auths[1], "Basic ") {
+		t.Fatalf("conns %d authorizations %q", conns, auths)
+	}
+}
+
+func TestProxyAuthBasicRejected(t *testing.T) {
+	p := basicProxy(t, []string{`Basic realm="proxy"`}, false)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	_, err := askingBoringMachine("wrong").DialTunnelHTTP(u, p.addr, "127.0.0.1:1", 5*time.Second)
+	var authErr *ProxyAuthError
+	if !errors.As(err, &authErr) || !strings.Contains(err.Error(), ErrProxyAuthFailed.Error()) {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+	if _, auths := p.stats(); len(auths) != 2 {
+		t.Fatalf("authorizations %q", auths)
+	}
+}
+
+func TestProxyAuthReconnectAfterClose(t *testing.T) {
+	echo := newEchoServer(t)
+	p := basicProxy(t, []string{`Basic realm="proxy"`}, true)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	c, err := askingBoringMachine("pass").DialTunnelHTTP(u, p.addr, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+	if conns, _ := p.stats(); conns != 2 {
+		t.Fatalf("expected reconnect, got %d connections", conns)
+	}
+}
+
+func TestProxyAuthMaxRounds(t *testing.T) {
+	// stale nonce every time, Digest would answer forever
+	p := newConnectProxy(t, func(req *http.Request) *proxyReply {
+		return &proxyReply{authenticate: []string{`Digest realm="proxy", nonce="n", qop="auth", stale=true`}}
+	})
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	_, err := askingBoringMachine("pass").DialTunnelHTTP(u, p.addr, "127.0.0.1:1", 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "too many rounds") {
+		t.Fatalf("expected too many rounds, got %v", err)
+	}
+	if _, auths := p.stats(); len(auths) != maxProxyAuthRounds {
+		t.Fatalf("%d requests, want %d", len(auths), maxProxyAuthRounds)
+	}
+}
+
+func TestProxyAuthSchemeSelection(t *testing.T) {
+	echo := newEchoServer(t)
+	p := newConnectProxy(t, func(req *http.Request) *proxyReply {
+		if strings.HasPrefix(req.Header.Get("Proxy-Authorization"), "Digest ") {
+			return nil
+		}
+		// several headers, Digest is preferred over Basic, Unknown is ignored
+		return &proxyReply{authenticate: []string{
+			`Basic realm="proxy"`,
+			`Unknown token="x", Digest realm="proxy", nonce="abc", qop="auth"`,
+		}}
+	})
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	c, err := askingBoringMachine("pass").DialTunnelHTTP(u, p.addr, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+	if _, auths := p.stats(); len(auths) != 2 || !strings.HasPrefix(auths[1], "Digest ") {
+		t.Fatalf("authorizations %q", auths)
+	}
+}
+
+// brokenAuthenticator session starts but cannot answer, like Negotiate with an expired ticket
+type brokenAuthenticator struct {
+	scheme string
+}
+
+func (a *brokenAuthenticator) Scheme() string {
+	return a.scheme
+}
+
+func (a *brokenAuthenticator) NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error) {
+	return a, nil
+}
+
+func (a *brokenAuthenticator) Authorize(challenge string) (string, error) {
+	return "", errors.New("ticket expired")
+}
+
+func TestProxyAuthFallbackAfterAuthorizeError(t *testing.T) {
+	echo := newEchoServer(t)
+	p := basicProxy(t, []string{"Negotiate", `Basic realm="proxy"`}, false)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	bm := askingBoringMachine("pass")
+	bm.ProxyAuth = []ProxyAuthenticator{&brokenAuthenticator{scheme: "Negotiate"}, &BasicAuthenticator{}}
+	c, err := bm.DialTunnelHTTP(u, p.addr, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+}
+
+// memoryStore credential store of one proxy password, counts erases
+type memoryStore struct {
+	password string
+	erased   int
+}
+
+func (m *memoryStore) Get(c *Credential) error {
+	c.User, c.Password = "user", m.password
+	return nil
+}
+
+func (m *memoryStore) Store(c *Credential) error {
+	return nil
+}
+
+func (m *memoryStore) Erase(c *Credential) error {
+	m.erased++
+	return nil
+}
+
+func TestProxyAuthEraseRejectedCredential(t *testing.T) {
+	p := basicProxy(t, []string{`Basic realm="proxy"`}, false)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	store := &memoryStore{password: "wrong"}
+	bm := &BoringMachine{CredentialStore: store}
+	if _, err := bm.DialTunnelHTTP(u, p.addr, "127.0.0.1:1", 5*time.Second); err == nil {
+		t.Fatal("expected auth failure")
+	}
+	if store.erased != 1 {
+		t.Fatalf("rejected credential erased %d times", store.erased)
+	}
+}
+
+func TestProxyAuthKeepCredentialOnOtherFailures(t *testing.T) {
+	cases := map[string][]string{
+		"too many rounds": {`Digest realm="proxy", nonce="n", qop="auth", stale=true`},
+		"no scheme":       {`Unknown realm="proxy"`},
+		"bad algorithm":   {`Digest realm="proxy", nonce="n", algorithm=SHA-512-256`},
+	}
+	for name, challenges := range cases {
+		p := newConnectProxy(t, func(req *http.Request) *proxyReply {
+			return &proxyReply{authenticate: challenges}
+		})
+		u := &url.URL{Scheme: "http", Host: p.addr}
+		store := &memoryStore{password: "pass"}
+		bm := &BoringMachine{CredentialStore: store}
+		if _, err := bm.DialTunnelHTTP(u, p.addr, "127.0.0.1:1", 5*time.Second); err == nil {
+			t.Fatalf("%s: expected failure", name)
+		}
+		if store.erased != 0 {
+			t.Fatalf("%s: credential erased", name)
+		}
+	}
+}
+
+func TestProxyAuthSharedBoringMachine(t *testing.T) {
+	t.Setenv("TUNNEL_CREDENTIAL_STORE", "none")
+	echo := newEchoServer(t)
+	p := basicProxy(t, []string{`Basic realm="proxy"`}, false)
+	u := &url.URL{Scheme: "http", Host: p.addr}
+	bm := askingBoringMachine("pass")
+	bm.CredentialStore = nil // created lazily by the first 407
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := bm.DialTunnelHTTP(u, p.addr, echo, 5*time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Negotiate (SPNEGO/Kerberos) proxy authentication, RFC 4559
+//
+// krb5.conf: KRB5_CONFIG, /etc/krb5.conf (Windows: %ProgramData%\MIT\Kerberos5\krb5.ini)
+// Credential in order:
+//   user@REALM + password in proxy url
+//   keytab KRB5_CLIENT_KTNAME with principal user@REALM from proxy url
+//   credential cache KRB5CCNAME or /tmp/krb5cc_<uid> (after kinit)
+
+// NegotiateAuthenticator Kerberos SPNEGO, service principal is HTTP/<proxy host>
+type NegotiateAuthenticator struct{}
+
+// Scheme todo
+func (*NegotiateAuthenticator) Scheme() string {
+	return "Negotiate"
+}
+
+func krb5ConfigPath() string {
+	if p := os.Getenv("KRB5_CONFIG"); len(p) != 0 {
+		return p
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "MIT", "Kerberos5", "krb5.ini")
+	}
+	return "/etc/krb5.conf"
+}
+
+func krb5CCachePath() string {
+	if p := os.Getenv("KRB5CCNAME"); len(p) != 0 {
+		return strings.TrimPrefix(p, "FILE:")
+	}
+	if u, err := user.Current(); err == nil && runtime.GOOS != "windows" {
+		return "/tmp/krb5cc_" + u.Uid
+	}
+	return ""
+}
+
+// splitPrincipal user@REALM, realm defaults to krb5.conf default_realm
+func splitPrincipal(principal string, cfg *config.Config) (string, string) {
+	if i := strings.LastIndexByte(principal, '@'); i != -1 {
+		return principal[:i], principal[i+1:]
+	}
+	return principal, cfg.LibDefaults.DefaultRealm
+}
+
+func newKrb5Client(ctx *ProxyAuthContext) (*client.Client, error) {
+	cfg, err := config.Load(krb5ConfigPath())
+	if err != nil {
+		return nil, cli.ErrorCat("negotiate: load krb5 config: ", err.Error())
+	}
+	settings := client.DisablePAFXFAST(true)
+	if u, password, err := ctx.URLCredential(); err == nil {
+		name, realm := splitPrincipal(u, cfg)
+		if len(password) != 0 {
+			return client.NewWithPassword(name, realm, password, cfg, settings), nil
+		}
+		if ktname := os.Getenv("KRB5_CLIENT_KTNAME"); len(ktname) != 0 {
+			kt, err := keytab.Load(strings.TrimPrefix(ktname, "FILE:"))
+			if err != nil {
+				return nil, cli.ErrorCat("negotiate: load keytab: ", err.Error())
+			}
+			return client.NewWithKeytab(name, realm, kt, cfg, settings), nil
+		}
+	}
+	ccpath := krb5CCachePath()
+	if len(ccpath) == 0 {
+		return nil, ErrProxyNoCredential
+	}
+	cc, err := credentials.LoadCCache(ccpath)
+	if err != nil {
+		return nil, cli.ErrorCat("negotiate: load credential cache: ", err.Error())
+	}
+	return client.NewFromCCache(cc, cfg, settings)
+}
+
+// NewSession todo
+func (*NegotiateAuthenticator) NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error) {
+	cl, err := newKrb5Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &negotiateSession{cl: cl, spn: "HTTP/" + ctx.ProxyHost()}, nil
+}
+
+type negotiateSession struct {
+	cl   *client.Client
+	spn  string
+	sent bool
+}
+
+// Authorize kerberos is one round, a second 407 means rejected
+func (s *negotiateSession) Authorize(challenge string) (string, error) {
+	if s.sent {
+		return "", ErrProxyAuthFailed
+	}
+	s.sent = true
+	sp := spnego.SPNEGOClient(s.cl, s.spn)
+	if err := sp.AcquireCred(); err != nil {
+		return "", cli.ErrorCat("negotiate: acquire credential: ", err.Error())
+	}
+	token, err := sp.InitSecContext()
+	if err != nil {
+		return "", cli.ErrorCat("negotiate: init security context for ", s.spn, ": ", err.Error())
+	}
+	b, err := token.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLMv2 proxy authentication
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp
+
+// ntlm negotiate flags
+const (
+	ntlmNegotiateUnicode        = 0x00000001
+	ntlmRequestTarget           = 0x00000004
+	ntlmNegotiateNTLM           = 0x00000200
+	ntlmNegotiateAlwaysSign     = 0x00008000
+	ntlmNegotiateExtendedSecure = 0x00080000
+	ntlmNegotiateTargetInfo     = 0x00800000
+	ntlmNegotiate128            = 0x20000000
+	ntlmNegotiate56             = 0x80000000
+)
+
+const (
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// error
+var (
+	ErrNTLMChallenge = errors.New("ntlm: invalid challenge message")
+)
+
+// NTLMAuthenticator NTLMv2, user is 'DOMAIN\user' or 'user'
+type NTLMAuthenticator struct{}
+
+// Scheme todo
+func (*NTLMAuthenticator) Scheme() string {
+	return "NTLM"
+}
+
+// NewSession todo
+func (*NTLMAuthenticator) NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error) {
+	user, password, err := ctx.Credential()
+	if err != nil {
+		return nil, err
+	}
+	s := &ntlmSession{user: user, password: password}
+	if domain, name, ok := strings.Cut(user, `\`); ok {
+		s.domain, s.user = domain, name
+	}
+	s.workstation, _ = os.Hostname()
+	if i := strings.IndexByte(s.workstation, '.'); i != -1 {
+		s.workstation = s.workstation[:i]
+	}
+	s.workstation = strings.ToUpper(s.workstation)
+	return s, nil
+}
+
+type ntlmSession struct {
+	domain      string
+	user        string
+	password    string
+	workstation string
+	round       int
+}
+
+func (s *ntlmSession) Authorize(challenge string) (string, error) {
+	s.round++
+	switch s.round {
+	case 1:
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+	case 2:
+		msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(challenge))
+		if err != nil || len(challenge) == 0 {
+			return "", ErrNTLMChallenge
+		}
+		auth, err := s.authenticateMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		return "NTLM " + base64.StdEncoding.EncodeToString(auth), nil
+	}
+	return "", ErrProxyAuthFailed
+}
+
+func ntlmNegotiateMessage() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateUnicode|ntlmRequestTarget|ntlmNegotiateNTLM|
+		ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSecure|ntlmNegotiateTargetInfo|ntlmNegotiate128|ntlmNegotiate56)
+	// empty domain and workstation security buffers
+	return b
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ntowfv2 NTOWFv2(password, user, domain)
+func ntowfv2(user, password, domain string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+// secbuf read security buffer
+func secbuf(msg []byte, off int) ([]byte, bool) {
+	if len(msg) < off+8 {
+		return nil, false
+	}
+	l := int(binary.LittleEndian.Uint16(msg[off:]))
+	p := int(binary.LittleEndian.Uint32(msg[off+4:]))
+	if p+l > len(msg) {
+		return nil, false
+	}
+	return msg[p : p+l], true
+}
+
+// ntlmTimestamp MsvAvTimestamp from target info, else now as FILETIME
+func ntlmTimestamp(targetInfo []byte) []byte {
+	for b := targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		l := int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL || len(b) < 4+l {
+			break
+		}
+		if id == ntlmAvTimestamp && l == 8 {
+			return b[4:12]
+		}
+		b = b[4+l:]
+	}
+	ts := make([]byte, 8)
+	// 100ns intervals since 1601-01-01
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()/100+116444736000000000))
+	return ts
+}
+
+func (s *ntlmSession) authenticateMessage(msg []byte) ([]byte, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, ErrNTLMChallenge
+	}
+	flags := binary.LittleEndian.Uint32(msg[20:])
+	serverChallenge := msg[24:32]
+	var targetInfo []byte
+	if len(msg) >= 48 {
+		targetInfo, _ = secbuf(msg, 40)
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	key := ntowfv2(s.user, s.password, s.domain)
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(ntlmTimestamp(targetInfo))
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+	ntProof := hmacMD5(key, serverChallenge, temp.Bytes())
+	ntResponse := append(ntProof, temp.Bytes()...)
+	lmResponse := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+
+	encode := func(v string) []byte {
+		if flags&ntlmNegotiateUnicode != 0 {
+			return utf16le(v)
+		}
+		return []byte(v)
+	}
+	payloads := [][]byte{lmResponse, ntResponse, encode(s.domain), encode(s.user), encode(s.workstation), nil}
+	const headerLen = 64
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	off := headerLen
+	for i, p := range payloads {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(p)))
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(b[pos+4:], uint32(off))
+		off += len(p)
+	}
+	binary.LittleEndian.PutUint32(b[60:], flags)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b, nil
+}
@@ -85,7 +85,7 @@ func schemePort(scheme string) string {
 		return "80"
 	case "https":
 		return "443"
-	case "socks5", "socks5h":
+	case "socks4", "socks4a", "socks5", "socks5h":
 		return "1080"
 	case "ssh":
 		return "22"
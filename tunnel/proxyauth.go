@@ -0,0 +1,274 @@
+package tunnel
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// HTTP proxy authentication (407 Proxy-Authenticate challenge/response)
+
+// error
+var (
+	ErrProxyAuthFailed   = errors.New("proxy authentication failed")
+	ErrProxyNoCredential = errors.New("no credential for proxy")
+)
+
+// ProxyAuthError proxy refused our credentials, dialing direct won't help
+type ProxyAuthError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyAuthError) Error() string {
+	return cli.StrCat("proxy ", e.Proxy, " authentication: ", e.Err.Error())
+}
+
+func (e *ProxyAuthError) Unwrap() error {
+	return e.Err
+}
+
+// maxProxyAuthRounds NTLM needs 3 requests, leave room for a reconnect
+const maxProxyAuthRounds = 6
+
+// ProxyCredentialFunc ask user for proxy credential, user is the name from proxy url (may be empty)
+type ProxyCredentialFunc func(ctx *ProxyAuthContext, user string) (string, string, error)
+
+// credential source
+const (
+	credentialNone = iota
+	credentialURL
+	credentialStore
+	credentialAsked
+)
+
+// ProxyAuthContext a CONNECT request through proxy
+type ProxyAuthContext struct {
+	URL      *url.URL // proxy url
+	Proxy    string   // proxy address host:port
+	Target   string   // CONNECT target host:port
+	bm       *BoringMachine
+	resolved bool
+	source   int
+	user     string
+	passwd   string
+	err      error
+}
+
+// ProxyHost proxy host without port
+func (c *ProxyAuthContext) ProxyHost() string {
+	host, _ := splitHostPort(c.Proxy)
+	return host
+}
+
+// URLCredential user and password from proxy url only
+func (c *ProxyAuthContext) URLCredential() (user, password string, err error) {
+	if c.URL.User == nil || len(c.URL.User.Username()) == 0 {
+		return "", "", ErrProxyNoCredential
+	}
+	password, _ = c.URL.User.Password()
+	return c.URL.User.Username(), password, nil
+}
+
+// storeKey credential store lookup key
+func (c *ProxyAuthContext) storeKey(user string) *Credential {
+	return &Credential{Protocol: c.URL.Scheme, Host: c.Proxy, User: user}
+}
+
+func (c *ProxyAuthContext) resolve() (string, string, int, error) {
+	var name string
+	if c.URL.User != nil {
+		name = c.URL.User.Username()
+		if password, ok := c.URL.User.Password(); ok && len(name) != 0 {
+			return name, password, credentialURL, nil
+		}
+	}
+	if c.bm == nil {
+		if len(name) == 0 {
+			return "", "", credentialNone, ErrProxyNoCredential
+		}
+		return name, "", credentialURL, nil
+	}
+	if store := c.bm.credentialStore(); store != nil {
+		cred := c.storeKey(name)
+		err := store.Get(cred)
+		if err == nil {
+			c.bm.DebugPrint("proxy credential for %s found in credential store", c.Proxy)
+			return cred.User, cred.Password, credentialStore, nil
+		}
+		if err != ErrCredentialNotFound {
+			c.bm.DebugPrint("proxy credential store: %v", err)
+		}
+	}
+	if c.bm.AskCredential != nil {
+		user, password, err := c.bm.AskCredential(c, name)
+		if err != nil {
+			return "", "", credentialNone, err
+		}
+		if len(user) == 0 {
+			return "", "", credentialNone, ErrProxyNoCredential
+		}
+		return user, password, credentialAsked, nil
+	}
+	if len(name) == 0 {
+		return "", "", credentialNone, ErrProxyNoCredential
+	}
+	return name, "", credentialURL, nil
+}
+
+// Credential user and password from proxy url, credential store, or asked
+// interactively (once per CONNECT)
+func (c *ProxyAuthContext) Credential() (user, password string, err error) {
+	if !c.resolved {
+		c.resolved = true
+		c.user, c.passwd, c.source, c.err = c.resolve()
+	}
+	return c.user, c.passwd, c.err
+}
+
+// ProxyAuthSession challenge/response state of one CONNECT
+type ProxyAuthSession interface {
+	// Authorize return Proxy-Authorization value answering challenge, challenge is
+	// the text after the scheme name of Proxy-Authenticate
+	Authorize(challenge string) (string, error)
+}
+
+// ProxyAuthenticator proxy authentication scheme
+type ProxyAuthenticator interface {
+	Scheme() string
+	// NewSession error when the scheme cannot be used (eg: no credential)
+	NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error)
+}
+
+// DefaultProxyAuthenticators in order of preference
+func DefaultProxyAuthenticators() []ProxyAuthenticator {
+	return []ProxyAuthenticator{
+		&NegotiateAuthenticator{},
+		&NTLMAuthenticator{},
+		&DigestAuthenticator{},
+		&BasicAuthenticator{},
+	}
+}
+
+// proxyChallenge one challenge of Proxy-Authenticate
+type proxyChallenge struct {
+	Scheme string
+	Params string
+}
+
+// splitQuoted split by sep outside quoted-string
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	escape := false
+	begin := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escape:
+			escape = false
+		case c == '\\' && quoted:
+			escape = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[begin:i])
+			begin = i + 1
+		}
+	}
+	return append(parts, s[begin:])
+}
+
+// parseChallenges parse Proxy-Authenticate values, one header may carry several
+// challenges: 'Negotiate, NTLM, Basic realm="proxy", charset="UTF-8"'
+func parseChallenges(values []string) []*proxyChallenge {
+	var challenges []*proxyChallenge
+	for _, v := range values {
+		for _, part := range splitQuoted(v, ',') {
+			part = strings.TrimSpace(part)
+			if len(part) == 0 {
+				continue
+			}
+			sp := strings.IndexAny(part, " \t")
+			eq := strings.IndexByte(part, '=')
+			// new challenge: lone token or token followed by space before any '='
+			if (sp == -1 && eq == -1) || (sp != -1 && (eq == -1 || sp < eq)) {
+				ch := &proxyChallenge{Scheme: part}
+				if sp != -1 {
+					ch.Scheme = part[:sp]
+					ch.Params = strings.TrimSpace(part[sp+1:])
+				}
+				challenges = append(challenges, ch)
+				continue
+			}
+			if len(challenges) == 0 {
+				continue
+			}
+			last := challenges[len(challenges)-1]
+			if len(last.Params) != 0 {
+				last.Params += ", "
+			}
+			last.Params += part
+		}
+	}
+	return challenges
+}
+
+func findChallenge(challenges []*proxyChallenge, scheme string) *proxyChallenge {
+	for _, ch := range challenges {
+		if strings.EqualFold(ch.Scheme, scheme) {
+			return ch
+		}
+	}
+	return nil
+}
+
+// parseAuthParams parse 'realm="x", nonce="y"' auth-params, keys are lower case
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range splitQuoted(s, ',') {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+			v = strings.ReplaceAll(v, `\\`, `\`)
+		}
+		params[strings.ToLower(strings.TrimSpace(k))] = v
+	}
+	return params
+}
+
+// BasicAuthenticator RFC 7617
+type BasicAuthenticator struct{}
+
+// Scheme todo
+func (*BasicAuthenticator) Scheme() string {
+	return "Basic"
+}
+
+// NewSession todo
+func (*BasicAuthenticator) NewSession(ctx *ProxyAuthContext) (ProxyAuthSession, error) {
+	user, password, err := ctx.Credential()
+	if err != nil {
+		return nil, err
+	}
+	return &basicSession{value: "Basic " + basicAuth(url.UserPassword(user, password))}, nil
+}
+
+type basicSession struct {
+	value string
+	sent  bool
+}
+
+func (s *basicSession) Authorize(challenge string) (string, error) {
+	if s.sent {
+		return "", ErrProxyAuthFailed
+	}
+	s.sent = true
+	return s.value, nil
+}
@@ -0,0 +1,220 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// challengeProxy CONNECT proxy, check decides on Proxy-Authorization: true tunnels,
+// otherwise 407 with the returned Proxy-Authenticate values on the same connection
+type challengeProxy struct {
+	addr  string
+	check func(authorization string) (bool, []string)
+	mu    sync.Mutex
+	auths []string
+}
+
+func newChallengeProxy(t *testing.T, check func(authorization string) (bool, []string)) *challengeProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &challengeProxy{addr: l.Addr().String(), check: check}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *challengeProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		auth := req.Header.Get("Proxy-Authorization")
+		p.mu.Lock()
+		p.auths = append(p.auths, auth)
+		p.mu.Unlock()
+		ok, authenticate := p.check(auth)
+		if ok {
+			_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return
+		}
+		var buf bytes.Buffer
+		buf.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n")
+		for _, v := range authenticate {
+			buf.WriteString("Proxy-Authenticate: " + v + "\r\n")
+		}
+		buf.WriteString("Content-Length: 0\r\n\r\n")
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (p *challengeProxy) authorizations() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.auths...)
+}
+
+func (p *challengeProxy) dial(t *testing.T, userinfo string) error {
+	t.Helper()
+	u, err := url.Parse("http://" + userinfo + "@" + p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := (&BoringMachine{}).DialTunnelHTTP(u, p.addr, "example.com:22", 5*time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestParseChallenges(t *testing.T) {
+	challenges := parseChallenges([]string{
+		`Negotiate, NTLM`,
+		`Digest realm="a, b", nonce="n", qop="auth,auth-int", Basic realm="proxy"`,
+	})
+	var schemes []string
+	for _, ch := range challenges {
+		schemes = append(schemes, ch.Scheme)
+	}
+	if strings.Join(schemes, " ") != "Negotiate NTLM Digest Basic" {
+		t.Fatalf("schemes %v", schemes)
+	}
+	params := parseAuthParams(findChallenge(challenges, "digest").Params)
+	if params["realm"] != "a, b" || params["nonce"] != "n" || params["qop"] != "auth,auth-int" {
+		t.Fatalf("digest params %v", params)
+	}
+	if findChallenge(challenges, "Basic").Params != `realm="proxy"` {
+		t.Fatalf("basic params %q", findChallenge(challenges, "Basic").Params)
+	}
+}
+
+func TestProxyAuthPreemptiveBasic(t *testing.T) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	p := newChallengeProxy(t, func(auth string) (bool, []string) {
+		return auth == want, []string{`Basic realm="proxy"`}
+	})
+	if err := p.dial(t, "user:secret"); err != nil {
+		t.Fatal(err)
+	}
+	if auths := p.authorizations(); len(auths) != 1 {
+		t.Fatalf("%d requests, want 1", len(auths))
+	}
+}
+
+func TestProxyAuthRejected(t *testing.T) {
+	p := newChallengeProxy(t, func(auth string) (bool, []string) {
+		return false, []string{`Basic realm="proxy"`}
+	})
+	err := p.dial(t, "user:wrong")
+	var perr *ProxyAuthError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v, want ProxyAuthError", err)
+	}
+	if auths := p.authorizations(); len(auths) != 1 {
+		t.Fatalf("%d requests, spent Basic credential sent again", len(auths))
+	}
+}
+
+func TestProxyAuthDigest(t *testing.T) {
+	challenge := `Digest realm="proxy", nonce="dcd98b7102dd2f0e", qop="auth", algorithm=SHA-256`
+	h := func(parts ...string) string {
+		d := sha256.Sum256([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d[:])
+	}
+	p := newChallengeProxy(t, func(auth string) (bool, []string) {
+		offer := []string{challenge, `Basic realm="proxy"`}
+		scheme, rest, _ := strings.Cut(auth, " ")
+		if scheme != "Digest" {
+			return false, offer
+		}
+		v := parseAuthParams(rest)
+		ha1 := h("user", "proxy", "secret")
+		ha2 := h("CONNECT", "example.com:22")
+		want := h(ha1, "dcd98b7102dd2f0e", v["nc"], v["cnonce"], "auth", ha2)
+		return v["username"] == "user" && v["uri"] == "example.com:22" && v["response"] == want, offer
+	})
+	if err := p.dial(t, "user:secret"); err != nil {
+		t.Fatal(err)
+	}
+	// preemptive Basic, then Digest preferred over Basic
+	auths := p.authorizations()
+	if len(auths) != 2 || !strings.HasPrefix(auths[0], "Basic ") || !strings.HasPrefix(auths[1], "Digest ") {
+		t.Fatalf("authorizations %q", auths)
+	}
+}
+
+// ntlmChallengeMessage type 2 message with unicode and an empty target info
+func ntlmChallengeMessage(serverChallenge []byte) []byte {
+	b := make([]byte, 48, 52)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[16:], 48) // empty target name
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo)
+	copy(b[24:32], serverChallenge)
+	binary.LittleEndian.PutUint16(b[40:], 4)
+	binary.LittleEndian.PutUint16(b[42:], 4)
+	binary.LittleEndian.PutUint32(b[44:], 48)
+	return append(b, 0, 0, 0, 0) // MsvAvEOL
+}
+
+func TestProxyAuthNTLM(t *testing.T) {
+	serverChallenge := []byte("12345678")
+	type2 := "NTLM " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage(serverChallenge))
+	p := newChallengeProxy(t, func(auth string) (bool, []string) {
+		scheme, rest, _ := strings.Cut(auth, " ")
+		if scheme != "NTLM" {
+			return false, []string{"NTLM"}
+		}
+		msg, err := base64.StdEncoding.DecodeString(rest)
+		if err != nil || len(msg) < 12 || !bytes.Equal(msg[:8], ntlmSignature) {
+			return false, []string{"NTLM"}
+		}
+		switch binary.LittleEndian.Uint32(msg[8:]) {
+		case 1:
+			return false, []string{type2}
+		case 3:
+			ntResponse, _ := secbuf(msg, 20)
+			domain, _ := secbuf(msg, 28)
+			user, _ := secbuf(msg, 36)
+			if len(ntResponse) < 16 || !bytes.Equal(domain, utf16le("DOM")) || !bytes.Equal(user, utf16le("user")) {
+				return false, []string{"NTLM"}
+			}
+			proof := hmacMD5(ntowfv2("user", "secret", "DOM"), serverChallenge, ntResponse[16:])
+			return bytes.Equal(proof, ntResponse[:16]), []string{"NTLM"}
+		}
+		return false, []string{"NTLM"}
+	})
+	if err := p.dial(t, `DOM%5Cuser:secret`); err != nil {
+		t.Fatal(err)
+	}
+	// preemptive Basic, negotiate, authenticate
+	if auths := p.authorizations(); len(auths) != 3 {
+		t.Fatalf("%d requests, want 3", len(auths))
+	}
+}
@@ -0,0 +1,200 @@
+//go:build linux
+// +build linux
+
+package tunnel
+
+import (
+	"github.com/balibuild/tunnelssh/cli"
+	"github.com/godbus/dbus/v5"
+)
+
+// freedesktop Secret Service API over session D-Bus
+// https://specifications.freedesktop.org/secret-service/latest/
+
+const (
+	secretServiceName       = "org.freedesktop.secrets"
+	secretServicePath       = "/org/freedesktop/secrets"
+	secretServiceInterface  = "org.freedesktop.Secret.Service"
+	secretItemInterface     = "org.freedesktop.Secret.Item"
+	secretPromptInterface   = "org.freedesktop.Secret.Prompt"
+	secretCollectionDefault = "/org/freedesktop/secrets/aliases/default"
+	secretAttributeService  = "tunnelssh-proxy"
+)
+
+// SecretServiceStore GNOME Keyring, KWallet and other Secret Service providers
+type SecretServiceStore struct {
+	Collection string // object path, default: alias default
+}
+
+type secretValue struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+type secretSession struct {
+	conn    *dbus.Conn
+	svc     dbus.BusObject
+	session dbus.ObjectPath
+}
+
+func openSecretSession() (*secretSession, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, cli.ErrorCat("secret service: ", err.Error())
+	}
+	s := &secretSession{conn: conn, svc: conn.Object(secretServiceName, secretServicePath)}
+	var output dbus.Variant
+	// plain: secret travels over the local session bus only
+	if err := s.svc.Call(secretServiceInterface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &s.session); err != nil {
+		return nil, cli.ErrorCat("secret service: open session: ", err.Error())
+	}
+	return s, nil
+}
+
+func (s *secretSession) Close() {
+	_ = s.conn.Object(secretServiceName, s.session).Call("org.freedesktop.Secret.Session.Close", 0).Err
+}
+
+// prompt run prompt (unlock keyring dialog) and wait for completion
+func (s *secretSession) prompt(p dbus.ObjectPath) (dbus.Variant, error) {
+	var result dbus.Variant
+	if p == "/" || len(p) == 0 {
+		return result, nil
+	}
+	if err := s.conn.AddMatchSignal(dbus.WithMatchObjectPath(p), dbus.WithMatchInterface(secretPromptInterface)); err != nil {
+		return result, err
+	}
+	defer func() {
+		_ = s.conn.RemoveMatchSignal(dbus.WithMatchObjectPath(p), dbus.WithMatchInterface(secretPromptInterface))
+	}()
+	ch := make(chan *dbus.Signal, 1)
+	s.conn.Signal(ch)
+	defer s.conn.RemoveSignal(ch)
+	if err := s.conn.Object(secretServiceName, p).Call(secretPromptInterface+".Prompt", 0, "").Err; err != nil {
+		return result, err
+	}
+	for sig := range ch {
+		if sig.Path != p || sig.Name != secretPromptInterface+".Completed" || len(sig.Body) < 2 {
+			continue
+		}
+		if dismissed, _ := sig.Body[0].(bool); dismissed {
+			return result, cli.ErrorCat("secret service: prompt dismissed")
+		}
+		result, _ = sig.Body[1].(dbus.Variant)
+		return result, nil
+	}
+	return result, cli.ErrorCat("secret service: prompt aborted")
+}
+
+func secretAttributes(c *Credential) map[string]string {
+	attrs := map[string]string{
+		"service":  secretAttributeService,
+		"protocol": c.Protocol,
+		"host":     c.Host,
+	}
+	if len(c.User) != 0 {
+		attrs["user"] = c.User
+	}
+	return attrs
+}
+
+// search unlocked items matching credential, unlock locked items on demand
+func (s *secretSession) search(c *Credential) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	if err := s.svc.Call(secretServiceInterface+".SearchItems", 0, secretAttributes(c)).Store(&unlocked, &locked); err != nil {
+		return nil, cli.ErrorCat("secret service: search: ", err.Error())
+	}
+	if len(locked) == 0 {
+		return unlocked, nil
+	}
+	var done []dbus.ObjectPath
+	var p dbus.ObjectPath
+	if err := s.svc.Call(secretServiceInterface+".Unlock", 0, locked).Store(&done, &p); err != nil {
+		return nil, cli.ErrorCat("secret service: unlock: ", err.Error())
+	}
+	result, err := s.prompt(p)
+	if err != nil {
+		return nil, err
+	}
+	if paths, ok := result.Value().([]dbus.ObjectPath); ok {
+		done = append(done, paths...)
+	}
+	return append(unlocked, done...), nil
+}
+
+// Get todo
+func (ss *SecretServiceStore) Get(c *Credential) error {
+	s, err := openSecretSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	items, err := s.search(c)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		obj := s.conn.Object(secretServiceName, item)
+		var secret secretValue
+		if err := obj.Call(secretItemInterface+".GetSecret", 0, s.session).Store(&secret); err != nil {
+			continue
+		}
+		attrs, err := obj.GetProperty(secretItemInterface + ".Attributes")
+		if err != nil {
+			continue
+		}
+		m, _ := attrs.Value().(map[string]string)
+		c.User, c.Password = m["user"], string(secret.Value)
+		return nil
+	}
+	return ErrCredentialNotFound
+}
+
+// Store todo
+func (ss *SecretServiceStore) Store(c *Credential) error {
+	s, err := openSecretSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	collection := dbus.ObjectPath(ss.Collection)
+	if len(collection) == 0 {
+		collection = secretCollectionDefault
+	}
+	props := map[string]dbus.Variant{
+		secretItemInterface + ".Label":      dbus.MakeVariant(cli.StrCat("TunnelSSH proxy ", c.User, "@", c.Host)),
+		secretItemInterface + ".Attributes": dbus.MakeVariant(secretAttributes(c)),
+	}
+	secret := secretValue{Session: s.session, Value: []byte(c.Password), ContentType: "text/plain"}
+	var item, p dbus.ObjectPath
+	if err := s.conn.Object(secretServiceName, collection).Call("org.freedesktop.Secret.Collection.CreateItem", 0, props, secret, true).Store(&item, &p); err != nil {
+		return cli.ErrorCat("secret service: create item: ", err.Error())
+	}
+	_, err = s.prompt(p)
+	return err
+}
+
+// Erase todo
+func (ss *SecretServiceStore) Erase(c *Credential) error {
+	s, err := openSecretSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	items, err := s.search(c)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var p dbus.ObjectPath
+		if err := s.conn.Object(secretServiceName, item).Call(secretItemInterface+".Delete", 0).Store(&p); err != nil {
+			return cli.ErrorCat("secret service: delete: ", err.Error())
+		}
+		if _, err := s.prompt(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
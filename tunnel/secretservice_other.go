@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import (
+	"errors"
+)
+
+// error
+var (
+	ErrSecretServiceUnsupported = errors.New("secret service: only supported on linux")
+)
+
+// SecretServiceStore freedesktop Secret Service, linux only
+type SecretServiceStore struct {
+	Collection string // object path, default: alias default
+}
+
+// Get todo
+func (ss *SecretServiceStore) Get(c *Credential) error {
+	return ErrSecretServiceUnsupported
+}
+
+// Store todo
+func (ss *SecretServiceStore) Store(c *Credential) error {
+	return ErrSecretServiceUnsupported
+}
+
+// Erase todo
+func (ss *SecretServiceStore) Erase(c *Credential) error {
+	return ErrSecretServiceUnsupported
+}
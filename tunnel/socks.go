@@ -0,0 +1,272 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// SOCKS client: socks4:// socks4a:// socks5:// (local DNS) socks5h:// (proxy DNS)
+// SOCKS4 RFC: https://www.openssh.com/txt/socks4.protocol
+// SOCKS5 RFC 1928, username/password RFC 1929
+
+// error
+var (
+	ErrSocksNoIPv4         = errors.New("socks4: target has no IPv4 address")
+	ErrSocksNoAcceptMethod = errors.New("socks5: no acceptable authentication method")
+	ErrSocksAuthFailed     = errors.New("socks5: username/password authentication failed")
+)
+
+const (
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+	socksCmdConnect    = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// DialTunnelSocks dial addr through SOCKS proxy paddr
+func (bm *BoringMachine) DialTunnelSocks(u *url.URL, paddr, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return bm.DialTunnelSocksContext(ctx, u, paddr, addr)
+}
+
+// DialTunnelSocks5 dial addr through SOCKS proxy paddr
+//
+// Deprecated: use DialTunnelSocks, which also speaks SOCKS4/4a
+func (bm *BoringMachine) DialTunnelSocks5(u *url.URL, paddr, addr string, timeout time.Duration) (net.Conn, error) {
+	return bm.DialTunnelSocks(u, paddr, addr, timeout)
+}
+
+// DialTunnelSocks5Context dial addr through SOCKS proxy paddr
+//
+// Deprecated: use DialTunnelSocksContext
+func (bm *BoringMachine) DialTunnelSocks5Context(ctx context.Context, u *url.URL, paddr, addr string) (net.Conn, error) {
+	return bm.DialTunnelSocksContext(ctx, u, paddr, addr)
+}
+
+// DialTunnelSocksContext todo
+func (bm *BoringMachine) DialTunnelSocksContext(ctx context.Context, u *url.URL, paddr, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, cli.ErrorCat("invalid port in address ", addr)
+	}
+	conn, err := bm.dialNetwork(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, cli.ErrorCat("Counld't establish connection to proxy: ", err.Error())
+	}
+	stop := watchContext(ctx, conn) // cancel interrupts handshake
+	switch u.Scheme {
+	case "socks4", "socks4a":
+		err = bm.socks4Handshake(ctx, conn, u, host, port)
+	default:
+		err = bm.socks5Handshake(ctx, conn, u, paddr, addr, host, port)
+	}
+	canceled := !stop()
+	if err != nil || canceled {
+		conn.Close()
+		if cerr := ctx.Err(); cerr != nil {
+			return nil, cli.ErrorCat("socks proxy ", paddr, ": ", cerr.Error())
+		}
+		return nil, err
+	}
+	bm.DebugPrint("Establish connection to proxy(%s): %s", u.Scheme, paddr)
+	return conn, nil
+}
+
+// resolveLocal resolve host locally, prefer IPv4 when want4
+func resolveLocal(ctx context.Context, host string, only4 bool) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if only4 && ip.To4() == nil {
+			return nil, ErrSocksNoIPv4
+		}
+		return ip, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	if only4 || len(ips) == 0 {
+		return nil, ErrSocksNoIPv4
+	}
+	return ips[0].IP, nil
+}
+
+func (bm *BoringMachine) socks4Handshake(ctx context.Context, conn net.Conn, u *url.URL, host string, port int) error {
+	req := []byte{4, socksCmdConnect, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	var domain string
+	ip := net.ParseIP(host).To4()
+	switch {
+	case ip != nil:
+	case u.Scheme == "socks4a":
+		// 0.0.0.x with x != 0 asks proxy to resolve domain
+		ip, domain = net.IPv4(0, 0, 0, 1).To4(), host
+	default:
+		var err error
+		if ip, err = resolveLocal(ctx, host, true); err != nil {
+			return err
+		}
+		ip = ip.To4()
+	}
+	copy(req[4:], ip)
+	if u.User != nil {
+		req = append(req, u.User.Username()...)
+	}
+	req = append(req, 0)
+	if len(domain) != 0 {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return cli.ErrorCat("socks4: read reply: ", err.Error())
+	}
+	switch resp[1] {
+	case 0x5a:
+		return nil
+	case 0x5c, 0x5d:
+		return cli.ErrorCat("socks4: request rejected, identd failed (", strconv.Itoa(int(resp[1])), ")")
+	}
+	return cli.ErrorCat("socks4: request rejected or failed (", strconv.Itoa(int(resp[1])), ")")
+}
+
+func (bm *BoringMachine) socks5Handshake(ctx context.Context, conn net.Conn, u *url.URL, paddr, addr, host string, port int) error {
+	if _, err := conn.Write([]byte{5, 2, socks5AuthNone, socks5AuthPassword}); err != nil {
+		return err
+	}
+	var sel [2]byte
+	if _, err := io.ReadFull(conn, sel[:]); err != nil {
+		return cli.ErrorCat("socks5: read method: ", err.Error())
+	}
+	if sel[0] != 5 {
+		return cli.ErrorCat("socks5: unexpected protocol version ", strconv.Itoa(int(sel[0])))
+	}
+	switch sel[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		actx := &ProxyAuthContext{URL: u, Proxy: paddr, Target: addr, bm: bm}
+		if err := socks5Password(conn, actx); err != nil {
+			bm.rejectCredential(actx)
+			return &ProxyAuthError{Proxy: paddr, Err: err}
+		}
+		bm.approveCredential(actx)
+	default:
+		return ErrSocksNoAcceptMethod
+	}
+	req := []byte{5, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil || u.Scheme != "socks5h" {
+		if ip == nil {
+			var err error
+			if ip, err = resolveLocal(ctx, host, false); err != nil {
+				return err
+			}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return cli.ErrorCat("socks5: host name too long: ", host)
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return cli.ErrorCat("socks5: read reply: ", err.Error())
+	}
+	if hdr[1] != 0 {
+		msg := "unknown error " + strconv.Itoa(int(hdr[1]))
+		if int(hdr[1]) < len(socks5Replies) {
+			msg = socks5Replies[hdr[1]]
+		}
+		return cli.ErrorCat("socks5: connect ", addr, ": ", msg)
+	}
+	// skip bound address
+	var l int
+	switch hdr[3] {
+	case socks5AtypIPv4:
+		l = net.IPv4len
+	case socks5AtypIPv6:
+		l = net.IPv6len
+	case socks5AtypDomain:
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		l = int(b[0])
+	default:
+		return cli.ErrorCat("socks5: unknown address type ", strconv.Itoa(int(hdr[3])))
+	}
+	_, err := io.ReadFull(conn, make([]byte, l+2))
+	return err
+}
+
+// socks5Password RFC 1929 sub-negotiation
+func socks5Password(conn net.Conn, actx *ProxyAuthContext) error {
+	user, password, err := actx.Credential()
+	if err != nil {
+		return err
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return cli.ErrorCat("socks5: read auth reply: ", err.Error())
+	}
+	if resp[1] != 0 {
+		return ErrSocksAuthFailed
+	}
+	return nil
+}
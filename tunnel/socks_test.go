@@ -0,0 +1,321 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socksServer in-process SOCKS4/4a/5 server, records the requested destination
+type socksServer struct {
+	l        net.Listener
+	user     string // require RFC 1929 auth when set
+	password string
+	mu       sync.Mutex
+	dests    []string
+}
+
+func newSocksServer(t *testing.T, user, password string) *socksServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{l: l, user: user, password: password}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *socksServer) lastDest() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dests) == 0 {
+		return ""
+	}
+	return s.dests[len(s.dests)-1]
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	ver, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	var dest string
+	var reply []byte
+	switch ver {
+	case 4:
+		var hdr [7]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return
+		}
+		if _, err := br.ReadString(0); err != nil {
+			return
+		}
+		host := net.IP(hdr[3:7]).String()
+		if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+			name, err := br.ReadString(0)
+			if err != nil {
+				return
+			}
+			host = strings.TrimSuffix(name, "\x00")
+		}
+		dest = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3]))))
+		reply = []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+	case 5:
+		n, _ := br.ReadByte()
+		methods := make([]byte, n)
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return
+		}
+		if len(s.user) != 0 {
+			c.Write([]byte{5, socks5AuthPassword})
+			var b [2]byte
+			if _, err := io.ReadFull(br, b[:]); err != nil {
+				return
+			}
+			u := make([]byte, b[1])
+			io.ReadFull(br, u)
+			pl, _ := br.ReadByte()
+			p := make([]byte, pl)
+			io.ReadFull(br, p)
+			if string(u) != s.user || string(p) != s.password {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		} else {
+			c.Write([]byte{5, socks5AuthNone})
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return
+		}
+		var host string
+		switch hdr[3] {
+		case socks5AtypIPv4, socks5AtypIPv6:
+			ip := make([]byte, net.IPv4len)
+			if hdr[3] == socks5AtypIPv6 {
+				ip = make([]byte, net.IPv6len)
+			}
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socks5AtypDomain:
+			l, _ := br.ReadByte()
+			name := make([]byte, l)
+			io.ReadFull(br, name)
+			host = string(name)
+		}
+		var port [2]byte
+		io.ReadFull(br, port[:])
+		dest = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+		reply = []byte{5, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.dests = append(s.dests, dest)
+	s.mu.Unlock()
+	target := dest
+	if h, p, _ := net.SplitHostPort(dest); h == "localhost" {
+		target = net.JoinHostPort("127.0.0.1", p)
+	}
+	peer, err := net.Dial("tcp", target)
+	if err != nil {
+		if ver == 5 {
+			c.Write([]byte{5, 5, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		} else {
+			c.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+		}
+		return
+	}
+	defer peer.Close()
+	c.Write(reply)
+	go io.Copy(peer, br)
+	io.Copy(c, peer)
+}
+
+func newEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func testBoringMachine() *BoringMachine {
+	return &BoringMachine{CredentialStore: CredentialStores{}}
+}
+
+func echoRoundTrip(t *testing.T, c net.Conn) {
+	t.Helper()
+	defer c.Close()
+	msg := "hello through socks"
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo got %q", buf)
+	}
+}
+
+func TestDialTunnelSocks(t *testing.T) {
+	echo := newEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	byName := net.JoinHostPort("localhost", port)
+	tests := []struct {
+		scheme string
+		target string
+		dest   string // seen by proxy
+	}{
+		{"socks5", echo, echo},
+		{"socks5", byName, echo},    // resolved locally
+		{"socks5h", byName, byName}, // resolved by proxy
+		{"socks4", byName, echo},    // resolved locally
+		{"socks4a", byName, byName}, // resolved by proxy
+		{"socks4a", echo, echo},     // IPv4 literal sent as is
+	}
+	for _, tc := range tests {
+		t.Run(tc.scheme+"/"+tc.target, func(t *testing.T) {
+			s := newSocksServer(t, "", "")
+			u := &url.URL{Scheme: tc.scheme, Host: s.l.Addr().String()}
+			c, err := testBoringMachine().DialTunnelSocks(u, u.Host, tc.target, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			echoRoundTrip(t, c)
+			if got := s.lastDest(); got != tc.dest && !(tc.dest == echo && strings.HasPrefix(got, "127.0.0.1:")) {
+				t.Fatalf("proxy saw destination %q, want %q", got, tc.dest)
+			}
+		})
+	}
+}
+
+func TestDialTunnelSocks5Auth(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newSocksServer(t, "alice", "secret")
+	u := &url.URL{Scheme: "socks5h", Host: s.l.Addr().String(), User: url.UserPassword("alice", "secret")}
+	c, err := testBoringMachine().DialTunnelSocks(u, u.Host, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+
+	u.User = url.UserPassword("alice", "wrong")
+	_, err = testBoringMachine().DialTunnelSocks(u, u.Host, echo, 5*time.Second)
+	var authErr *ProxyAuthError
+	if !errors.As(err, &authErr) || !errors.Is(err, ErrSocksAuthFailed) {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+
+	u.User = nil
+	_, err = testBoringMachine().DialTunnelSocks(u, u.Host, echo, 5*time.Second)
+	if !errors.Is(err, ErrProxyNoCredential) {
+		t.Fatalf("expected missing credential, got %v", err)
+	}
+}
+
+// TestDialTunnelSocks5 API kept for library callers
+func TestDialTunnelSocks5(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newSocksServer(t, "", "")
+	u := &url.URL{Scheme: "socks5", Host: s.l.Addr().String()}
+	c, err := testBoringMachine().DialTunnelSocks5(u, u.Host, echo, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c)
+}
+
+// silentProxy accepts and never answers
+func silentProxy(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestDialTunnelSocksTimeout(t *testing.T) {
+	paddr := silentProxy(t)
+	u := &url.URL{Scheme: "socks5", Host: paddr}
+	start := time.Now()
+	_, err := testBoringMachine().DialTunnelSocks(u, paddr, "127.0.0.1:22", 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("timeout took %v", d)
+	}
+}
+
+func TestDialTunnelSocksCancel(t *testing.T) {
+	paddr := silentProxy(t)
+	u := &url.URL{Scheme: "socks4a", Host: paddr}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testBoringMachine().DialTunnelSocksContext(ctx, u, paddr, "example.com:22")
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("cancel took %v", d)
+	}
+}
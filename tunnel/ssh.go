@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -58,6 +59,14 @@ func (conn *sshconn) Write(b []byte) (int, error) {
 	return conn.chcon.Write(b)
 }
 
+// CloseWrite send channel EOF
+func (conn *sshconn) CloseWrite() error {
+	if cw, ok := conn.chcon.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrCloseWriteUnsupported
+}
+
 // Close closes the connection.
 func (conn *sshconn) Close() error {
 	if conn.chcon != nil {
@@ -146,7 +155,14 @@ func (conn *sshconn) publicKeys() ([]ssh.Signer, error) {
 
 // DialTunnelSSH dial ssh tunnel (ssh over ssh)
 func (bm *BoringMachine) DialTunnelSSH(u *url.URL, paddr, addr string, timeout time.Duration) (net.Conn, error) {
-	config := &ssh.ClientConfig{Timeout: timeout}
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return bm.DialTunnelSSHContext(ctx, u, paddr, addr)
+}
+
+// DialTunnelSSHContext todo
+func (bm *BoringMachine) DialTunnelSSHContext(ctx context.Context, u *url.URL, paddr, addr string) (net.Conn, error) {
+	config := &ssh.ClientConfig{}
 	if u.User != nil {
 		config.User = u.User.Username()
 	} else {
@@ -160,11 +176,25 @@ func (bm *BoringMachine) DialTunnelSSH(u *url.URL, paddr, addr string, timeout t
 	}
 	conn := &sshconn{host: u.Host}
 	config.Auth = append(config.Auth, ssh.PublicKeysCallback(conn.publicKeys))
-	var err error
-	if conn.client, err = ssh.Dial("tcp", paddr, config); err != nil {
+	pconn, err := bm.dialNetwork(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, pconn) // cancel interrupts handshake
+	c, chans, reqs, err := ssh.NewClientConn(pconn, paddr, config)
+	if !stop() {
+		if err == nil {
+			_ = c.Close()
+		}
+		_ = pconn.Close()
+		return nil, cli.ErrorCat("ssh proxy ", paddr, ": ", ctx.Err().Error())
+	}
+	if err != nil {
+		_ = pconn.Close()
 		return nil, err
 	}
-	if conn.chcon, err = conn.client.Dial("tcp", addr); err != nil {
+	conn.client = ssh.NewClient(c, chans, reqs)
+	if conn.chcon, err = conn.client.DialContext(ctx, "tcp", addr); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
@@ -0,0 +1,251 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/balibuild/tunnelssh/cli"
+)
+
+// TLS options of https:// proxies
+//
+// environment:
+//   TUNNEL_PROXY_CACERT         PEM file of extra trusted CA
+//   TUNNEL_PROXY_CERT           client certificate (PEM), key may be in the same file
+//   TUNNEL_PROXY_KEY            client private key (PEM)
+//   TUNNEL_PROXY_PINNEDPUBKEY   'sha256//base64[;sha256//base64]' SPKI pins, like curl
+//   TUNNEL_PROXY_SERVERNAME     SNI and verified name, default proxy host
+//   SSL_CERT_FILE               extra trusted CA (system roots are kept)
+//
+// config file TUNNEL_PROXY_CONFIG or ~/.tunnelssh/proxy.json:
+//   {
+//     "default": { "cacert": "/etc/corp/ca.pem" },
+//     "proxies": {
+//       "mitm.corp:8443": { "cacert": "...", "cert": "...", "key": "...", "pin": ["sha256//..."], "server_name": "..." }
+//     }
+//   }
+// default section < environment < per proxy section (host:port or host)
+
+// error
+var (
+	ErrProxyPinMismatch = errors.New("proxy certificate does not match pinned public key")
+)
+
+// ProxyTLSOptions todo
+type ProxyTLSOptions struct {
+	CACert     string   `json:"cacert,omitempty"`
+	Cert       string   `json:"cert,omitempty"`
+	Key        string   `json:"key,omitempty"`
+	Pin        []string `json:"pin,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
+}
+
+type proxyConfigFile struct {
+	Default *ProxyTLSOptions            `json:"default,omitempty"`
+	Proxies map[string]*ProxyTLSOptions `json:"proxies,omitempty"`
+}
+
+// merge non-empty fields of o
+func (opts *ProxyTLSOptions) merge(o *ProxyTLSOptions) {
+	if o == nil {
+		return
+	}
+	if len(o.CACert) != 0 {
+		opts.CACert = o.CACert
+	}
+	if len(o.Cert) != 0 {
+		opts.Cert = o.Cert
+		opts.Key = o.Key // pair
+	}
+	if len(o.Key) != 0 {
+		opts.Key = o.Key
+	}
+	if len(o.Pin) != 0 {
+		opts.Pin = o.Pin
+	}
+	if len(o.ServerName) != 0 {
+		opts.ServerName = o.ServerName
+	}
+}
+
+func proxyConfigPath() string {
+	if p := os.Getenv("TUNNEL_PROXY_CONFIG"); len(p) != 0 {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".tunnelssh", "proxy.json")
+}
+
+func loadProxyConfig() (*proxyConfigFile, error) {
+	p := proxyConfigPath()
+	if len(p) == 0 {
+		return nil, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cf proxyConfigFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, cli.ErrorCat("proxy config ", p, ": ", err.Error())
+	}
+	return &cf, nil
+}
+
+func splitPins(s string) []string {
+	var pins []string
+	for _, p := range strings.Split(s, ";") {
+		if p = strings.TrimSpace(p); len(p) != 0 {
+			pins = append(pins, p)
+		}
+	}
+	return pins
+}
+
+// ResolveProxyTLSOptions options of proxy paddr (host:port)
+func ResolveProxyTLSOptions(paddr string) (*ProxyTLSOptions, error) {
+	opts := &ProxyTLSOptions{}
+	cf, err := loadProxyConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cf != nil {
+		opts.merge(cf.Default)
+	}
+	opts.merge(&ProxyTLSOptions{
+		CACert:     os.Getenv("TUNNEL_PROXY_CACERT"),
+		Cert:       os.Getenv("TUNNEL_PROXY_CERT"),
+		Key:        os.Getenv("TUNNEL_PROXY_KEY"),
+		Pin:        splitPins(os.Getenv("TUNNEL_PROXY_PINNEDPUBKEY")),
+		ServerName: os.Getenv("TUNNEL_PROXY_SERVERNAME"),
+	})
+	if cf != nil && cf.Proxies != nil {
+		host, _ := splitHostPort(paddr)
+		if o, ok := cf.Proxies[host]; ok {
+			opts.merge(o)
+		}
+		if o, ok := cf.Proxies[paddr]; ok {
+			opts.merge(o)
+		}
+	}
+	return opts, nil
+}
+
+func appendPEMFile(pool *x509.CertPool, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return cli.ErrorCat("no certificate found in ", file)
+	}
+	return nil
+}
+
+// pinVerifier accept the connection when the server certificate or a certificate of a verified chain matches a pin.
+// Extra certificates sent by the server are not trusted: anyone could append the public pinned certificate
+func pinVerifier(pins []string) (func(cs tls.ConnectionState) error, error) {
+	hashes := make([]string, 0, len(pins))
+	for _, p := range pins {
+		if !strings.HasPrefix(p, "sha256//") {
+			return nil, cli.ErrorCat("unsupported pin '", p, "', expected sha256//base64")
+		}
+		hashes = append(hashes, strings.TrimPrefix(p, "sha256//"))
+	}
+	match := func(cert *x509.Certificate) bool {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		spki := base64.StdEncoding.EncodeToString(sum[:])
+		for _, h := range hashes {
+			if h == spki {
+				return true
+			}
+		}
+		return false
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) != 0 && match(cs.PeerCertificates[0]) {
+			return nil
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if match(cert) {
+					return nil
+				}
+			}
+		}
+		return ErrProxyPinMismatch
+	}, nil
+}
+
+// Config tls.Config for proxy host
+func (opts *ProxyTLSOptions) Config(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if len(opts.ServerName) != 0 {
+		config.ServerName = opts.ServerName
+	}
+	certFile := os.Getenv("SSL_CERT_FILE")
+	if len(opts.CACert) != 0 || len(certFile) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if len(certFile) != 0 {
+			if err := appendPEMFile(pool, certFile); err != nil {
+				return nil, cli.ErrorCat("SSL_CERT_FILE: ", err.Error())
+			}
+		}
+		if len(opts.CACert) != 0 {
+			if err := appendPEMFile(pool, opts.CACert); err != nil {
+				return nil, cli.ErrorCat("proxy CA: ", err.Error())
+			}
+		}
+		config.RootCAs = pool
+	}
+	if len(opts.Cert) != 0 {
+		key := opts.Key
+		if len(key) == 0 {
+			key = opts.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.Cert, key)
+		if err != nil {
+			return nil, cli.ErrorCat("proxy client certificate: ", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(opts.Pin) != 0 {
+		verify, err := pinVerifier(opts.Pin)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = verify
+	}
+	return config, nil
+}
+
+// proxyTLSConfig tls.Config of proxy paddr
+func (bm *BoringMachine) proxyTLSConfig(paddr string) (*tls.Config, error) {
+	opts, err := ResolveProxyTLSOptions(paddr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := splitHostPort(paddr)
+	config, err := opts.Config(host)
+	if err != nil {
+		return nil, err
+	}
+	bm.DebugPrint("proxy %s TLS server name %s, cacert %q, client cert %q, %d pins", paddr, config.ServerName, opts.CACert, opts.Cert, len(opts.Pin))
+	return config, nil
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert signed by parent, self-signed when parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (tc *testCert) pin() string {
+	sum := sha256.Sum256(tc.cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handshake server sends chain, client trusts root and checks pins
+func handshake(t *testing.T, chain []*testCert, root *testCert, pins []string) error {
+	certificate := tls.Certificate{PrivateKey: chain[0].key}
+	for _, c := range chain {
+		certificate.Certificate = append(certificate.Certificate, c.cert.Raw)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(root.cert)
+	config, err := (&ProxyTLSOptions{Pin: pins}).Config("proxy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RootCAs = pool
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := tls.Server(b, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	go func() {
+		_ = server.Handshake()
+		server.Close()
+	}()
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	return tls.Client(a, config).Handshake()
+}
+
+func TestPinLeaf(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	leaf := newTestCert(t, "proxy.test", ca, false)
+	if err := handshake(t, []*testCert{leaf}, ca, []string{leaf.pin()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinVerifiedChain(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	leaf := newTestCert(t, "proxy.test", ca, false)
+	if err := handshake(t, []*testCert{leaf}, ca, []string{ca.pin()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinMismatch(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	leaf := newTestCert(t, "proxy.test", ca, false)
+	other := newTestCert(t, "other", nil, false)
+	if err := handshake(t, []*testCert{leaf}, ca, []string{other.pin()}); err == nil {
+		t.Fatal("expected pin mismatch")
+	}
+}
+
+func TestPinAppendedCertRejected(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	// the real proxy certificate is public, its pin is configured
+	pinned := newTestCert(t, "proxy.test", ca, false)
+	// attacker holds another certificate of a trusted CA and appends the pinned one
+	attacker := newTestCert(t, "proxy.test", ca, false)
+	err := handshake(t, []*testCert{attacker, pinned}, ca, []string{pinned.pin()})
+	if err == nil {
+		t.Fatal("appended pinned certificate must not satisfy the pin")
+	}
+}
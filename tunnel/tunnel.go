@@ -1,23 +1,82 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/balibuild/tunnelssh/cli"
+	"golang.org/x/net/proxy"
 )
 
 // Proxy library
 
 // BoringMachine todo
 type BoringMachine struct {
-	Setting *ProxySettings // proxy url
-	Debug   func(msg string)
+	Setting   *ProxySettings // proxy url
+	Debug     func(msg string)
+	ProxyAuth []ProxyAuthenticator // nil: DefaultProxyAuthenticators
+	// AskCredential called when proxy requires authentication and url has no credential
+	AskCredential ProxyCredentialFunc
+	// CredentialStore nil: DefaultCredentialStore
+	CredentialStore CredentialStore
+	// Passphrase of encrypted credential file for DefaultCredentialStore
+	Passphrase PassphraseFunc
+	credMu     sync.Mutex // lazy CredentialStore, dials may run concurrently
+}
+
+// BoringMachine can be used by packages expecting a proxy dialer
+var (
+	_ proxy.Dialer        = &BoringMachine{}
+	_ proxy.ContextDialer = &BoringMachine{}
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// error
+var (
+	ErrCloseWriteUnsupported = errors.New("half-close not supported by connection")
+)
+
+// CloseWrite half-close conn: FIN for TCP, channel EOF for ssh, END_STREAM for h2 tunnels
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrCloseWriteUnsupported
+}
+
+// withTimeout ctx bounded by timeout, timeout <= 0 keeps ctx
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// watchContext apply ctx deadline to conn and interrupt blocked I/O when ctx is done.
+// stop reports false when ctx was done before, the deadline is cleared otherwise.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	after := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(aLongTimeAgo)
+	})
+	return func() bool {
+		if !after() {
+			return false
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return true
+	}
 }
 
 // DebugPrint todo
@@ -41,6 +100,22 @@ func (bm *BoringMachine) Initialize() error {
 
 // DialTunnel todo
 func (bm *BoringMachine) DialTunnel(network string, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return bm.DialTunnelContext(ctx, network, address)
+}
+
+// DialTunnelContext dial address through proxy, ctx bounds connect and proxy handshake.
+// tcp4/tcp6: the proxy gets a resolved literal of that family.
+func (bm *BoringMachine) DialTunnelContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	literal, err := resolveFamily(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if literal != address {
+		bm.DebugPrint("%s resolved to %s (%s)", address, literal, network)
+		address = literal
+	}
 	proxyurl := bm.Setting.ProxyServer
 	if !strings.Contains(proxyurl, "://") {
 		proxyurl = "http://" + proxyurl // avoid proxy url parse failed
@@ -55,11 +130,11 @@ func (bm *BoringMachine) DialTunnel(network string, address string, timeout time
 	}
 	switch u.Scheme {
 	case "https", "http":
-		return bm.DialTunnelHTTP(u, proxyaddress, address, timeout)
-	case "socks5", "socks5h":
-		return bm.DialTunnelSocks5(u, proxyaddress, address, timeout)
+		return bm.DialTunnelHTTPContext(ctx, u, proxyaddress, address)
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return bm.DialTunnelSocksContext(ctx, u, proxyaddress, address)
 	case "ssh":
-		return bm.DialTunnelSSH(u, proxyaddress, address, timeout)
+		return bm.DialTunnelSSHContext(ctx, u, proxyaddress, address)
 	default:
 	}
 	return nil, cli.ErrorCat("not support current scheme", u.Scheme)
@@ -95,7 +170,14 @@ func isProxyOffline(err error) bool {
 
 // DialDirect todo
 func (bm *BoringMachine) DialDirect(network string, address string, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.DialTimeout(network, address, timeout)
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return bm.DialDirectContext(ctx, network, address)
+}
+
+// DialDirectContext tcp4/tcp6 dial that family only, tcp uses Happy Eyeballs
+func (bm *BoringMachine) DialDirectContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := bm.dialNetwork(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -103,17 +185,41 @@ func (bm *BoringMachine) DialDirect(network string, address string, timeout time
 	return conn, nil
 }
 
-// DialTimeout auto dial
-func (bm *BoringMachine) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+// DialContextTimeout tunnel when proxy is used, direct otherwise or when tunnel fails.
+// timeout > 0 bounds tunnel and direct attempt separately, ctx bounds both.
+func (bm *BoringMachine) DialContextTimeout(ctx context.Context, network string, address string, timeout time.Duration) (net.Conn, error) {
 	if bm.Setting == nil || !bm.Setting.UseProxy(address) {
-		return bm.DialDirect(network, address, timeout)
+		dctx, cancel := withTimeout(ctx, timeout)
+		defer cancel()
+		return bm.DialDirectContext(dctx, network, address)
 	}
-	conn, err := bm.DialTunnel(network, address, timeout)
-	if err == nil && !isProxyOffline(err) {
-		return conn, err
+	tctx, cancel := withTimeout(ctx, timeout)
+	conn, err := bm.DialTunnelContext(tctx, network, address)
+	cancel()
+	if err == nil {
+		return conn, nil
 	}
-	bm.DebugPrint("Tunnel cannot establish, try connect direct %s", address)
-	return bm.DialDirect(network, address, timeout)
+	var authErr *ProxyAuthError
+	if errors.As(err, &authErr) {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, err // canceled by caller, no fallback
+	}
+	bm.DebugPrint("Tunnel cannot establish (%v), try connect direct %s", err, address)
+	dctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	return bm.DialDirectContext(dctx, network, address)
+}
+
+// DialContext auto dial, implements proxy.ContextDialer
+func (bm *BoringMachine) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return bm.DialContextTimeout(ctx, network, address, 0)
+}
+
+// DialTimeout auto dial
+func (bm *BoringMachine) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+	return bm.DialContextTimeout(context.Background(), network, address, timeout)
 }
 
 // Dial todo